@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what fn prints to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		output <- string(out)
+	}()
+	fn()
+	w.Close()
+	return <-output
+}
+
+var csvTestProducts = []Product{
+	{Name: "Charizard ex #199", Console: "Pokemon Scarlet & Violet 151", LoosePrice: "$389.99"},
+}
+
+func TestSaveToCSVPermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0o755) })
+	t.Chdir(dir)
+
+	var err error
+	out := captureStdout(t, func() { err = saveToCSV(csvTestProducts, defaultCSVColumns) })
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("saveToCSV error = %v, want a permission error", err)
+	}
+	if !strings.Contains(out, "Charizard ex #199,Pokemon Scarlet & Violet 151,$389.99") {
+		t.Errorf("the CSV wasn't printed to stdout instead:\n%s", out)
+	}
+}
+
+func TestSaveToCSVUnwritablePath(t *testing.T) {
+	// a directory in the file's place can't be created over, even by root
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "pokemon_151_prices.csv"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+
+	var err error
+	out := captureStdout(t, func() { err = saveToCSV(csvTestProducts, defaultCSVColumns) })
+	if err == nil {
+		t.Error("saveToCSV succeeded, want an error")
+	}
+	if !strings.Contains(out, "Charizard ex #199,Pokemon Scarlet & Violet 151,$389.99") {
+		t.Errorf("the CSV wasn't printed to stdout instead:\n%s", out)
+	}
+}
@@ -0,0 +1,1514 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"Pokemonscraper/internal/collect"
+	"Pokemonscraper/internal/config"
+	"Pokemonscraper/internal/normalize"
+	"Pokemonscraper/internal/store"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly/v2"
+	"github.com/gocolly/colly/v2/debug"
+	"github.com/gocolly/colly/v2/queue"
+	"golang.org/x/net/html"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// we make a struct to handle all of attributes of the pokemon scraper ofr 151
+type Product struct {
+	Name          string
+	Console       string
+	LoosePrice    string
+	CompletePrice string
+	NewPrice      string
+	GradedPrice   string
+	URL           string
+	// SourceURL is the page the product was scraped from, e.g. a results
+	// page of a paginated search
+	SourceURL string
+	// Source names the target the product came from, see scrapeTarget
+	Source string
+	// Page is the number of the results page the product was found on,
+	// counting the target's first page as 1
+	Page int
+}
+
+// csvColumn is one column of the CSV output: the Product field it holds and
+// its header
+type csvColumn struct {
+	Field  string
+	Header string
+}
+
+// defaultCSVColumns is the CSV layout used when -csv-columns isn't set
+var defaultCSVColumns = []csvColumn{
+	{"Name", "Name"},
+	{"Console", "Console"},
+	{"LoosePrice", "Loose Price"},
+	{"CompletePrice", "Complete Price"},
+	{"NewPrice", "New Price"},
+	{"GradedPrice", "Graded Price"},
+	{"URL", "URL"},
+	{"Source", "Source"},
+	{"SourceURL", "Source URL"},
+}
+
+// defaultTarget is scraped when -targets isn't set
+var defaultTarget = scrapeTarget{
+	Source: "PriceCharting",
+	URL:    "https://www.pricecharting.com/search-products?q=pokemon+151&type=prices",
+}
+
+// scrapeTarget is one page to scrape and the source its products are
+// tagged with. Selectors, when set, replace -selectors for this target.
+type scrapeTarget struct {
+	Source           string   `json:"source"`
+	URL              string   `json:"url"`
+	Selectors        []string `json:"selectors"`
+	ReplaceSelectors bool     `json:"replace_selectors"`
+}
+
+// defaultSelectors are the row selectors tried when none are configured
+var defaultSelectors = []string{
+	"table#games_table tbody tr",
+	"table tbody tr",
+	"tr[data-game-id]",
+	".product-row",
+	".search-result",
+}
+
+// scrapeOptions holds the command line tunables for a scrape
+type scrapeOptions struct {
+	Selectors []string
+	Debugger  debug.Debugger
+
+	// Source is set on every product found
+	Source string
+
+	// DumpDir receives the HTML of pages that yield no products
+	DumpDir string
+
+	// ConsoleFilter keeps only products whose Console contains one of these
+	// substrings, case-insensitively. Empty keeps everything.
+	ConsoleFilter []string
+
+	// Strict aborts the scrape on the first row that can't be parsed
+	// instead of skipping it or keeping its unparsed cells
+	Strict bool
+
+	// ParseErrorPages runs the parsing callbacks on non-2xx pages too, for
+	// debugging selectors against what a site answers when it blocks us
+	ParseErrorPages bool
+
+	// Parallelism is how many pages are fetched at once and Delay the pause
+	// between requests. PriceCharting rate limits, the defaults are safe.
+	Parallelism int
+	Delay       time.Duration
+
+	// QueueDir keeps the pages still to visit on disk, see fileQueue
+	QueueDir string
+
+	// HTTP transport tuning, the defaults match http.DefaultTransport
+	MaxIdleConns       int
+	IdleConnTimeout    time.Duration
+	DisableKeepAlives  bool
+	DisableCompression bool
+}
+
+func main() {
+	selectorsFlag := flag.String("selectors", "", "comma-separated row selectors, merged in front of the built-in defaults")
+	replaceSelectors := flag.Bool("replace-selectors", false, "use only the -selectors list instead of merging it with the defaults")
+	sinkFlag := flag.String("sink", "csv", "where to write the results: csv, db or both")
+	timeout := flag.Duration("timeout", 0, "maximum runtime for the whole scrape, e.g. 10m (0 means no limit)")
+	maxIdleConns := flag.Int("max-idle-conns", 100, "maximum idle keep-alive connections kept open")
+	idleConnTimeout := flag.Duration("idle-conn-timeout", 90*time.Second, "how long an idle keep-alive connection is kept open")
+	disableKeepAlives := flag.Bool("disable-keep-alives", false, "open a new connection for every request")
+	disableCompression := flag.Bool("disable-compression", false, "don't ask the server for gzip compressed responses")
+	debugFlag := flag.Bool("debug", false, "log every colly request and response event")
+	debugFile := flag.String("debug-file", "", "write the -debug output to this file instead of stderr")
+	consoleFilter := flag.String("console-filter", "", "comma-separated substrings, only rows whose console contains one of them are kept")
+	inputFile := flag.String("input-file", "", "scrape a local HTML file instead of PriceCharting, for developing selectors offline")
+	dumpDir := flag.String("dump-dir", "", "save the HTML of pages that yield no products to this directory")
+	csvColumnsFlag := flag.String("csv-columns", "", "CSV columns in order as Field=header, e.g. Name=card,Console=set,LoosePrice=nm_price")
+	strict := flag.Bool("strict", false, "abort with an error on the first row that can't be parsed instead of skipping it")
+	pretty := flag.Bool("pretty", false, "print the summary's tables aligned for reading in a terminal")
+	parallelism := flag.Int("parallelism", 1, "how many pages to fetch at once, raise it at your own risk of being rate limited")
+	delay := flag.Duration("delay", 2*time.Second, "pause between requests to the same site")
+	parseErrorPages := flag.Bool("parse-error-pages", false, "parse pages answered with a non-2xx status too, for debugging")
+	targetsFile := flag.String("targets", "", "JSON file of targets to scrape into one output, each with a source, a url and optional selectors")
+	asciiFlag := flag.Bool("ascii", false, "transliterate the names in the CSV to ASCII (é becomes e) for tools that can't read UTF-8")
+	queueDir := flag.String("queue-dir", "", "keep the pages still to visit in this directory, so an interrupted or crashed scrape resumes from them on the next run")
+	sortFlag := flag.String("sort", "console", "order of the output rows: console (console, then name), name (name, then console) or none to keep the scrape order")
+	flag.Parse()
+
+	if *parallelism < 1 {
+		log.Fatal("-parallelism must be at least 1")
+	}
+	if *delay < 0 {
+		log.Fatal("-delay can't be negative")
+	}
+	if _, ok := productOrders[*sortFlag]; !ok {
+		log.Fatalf("-sort must be console, name or none, not %q", *sortFlag)
+	}
+
+	env := &config.Reader{}
+	normalizeConfig := normalize.ReadConfig(env)
+	if err := env.Err(); err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	normalize.Configure(normalizeConfig)
+
+	columns, err := parseCSVColumns(*csvColumnsFlag)
+	if err != nil {
+		log.Fatal("Invalid -csv-columns:", err)
+	}
+
+	debugger, closeDebugger, err := collect.NewDebugger(*debugFlag, *debugFile)
+	if err != nil {
+		log.Fatal("Error setting up debugger:", err)
+	}
+	defer closeDebugger()
+
+	// open the sinks before scraping so a bad database config fails fast
+	sinks, closeSinks, err := newSinks(*sinkFlag, csvSink{Columns: columns, ASCII: *asciiFlag})
+	if err != nil {
+		log.Fatal("Error setting up sinks:", err)
+	}
+	defer closeSinks()
+
+	opts := scrapeOptions{
+		Selectors:          rowSelectors(*selectorsFlag, *replaceSelectors),
+		Debugger:           debugger,
+		DumpDir:            *dumpDir,
+		ConsoleFilter:      config.SplitList(*consoleFilter),
+		Strict:             *strict,
+		ParseErrorPages:    *parseErrorPages,
+		Parallelism:        *parallelism,
+		Delay:              *delay,
+		QueueDir:           *queueDir,
+		MaxIdleConns:       *maxIdleConns,
+		IdleConnTimeout:    *idleConnTimeout,
+		DisableKeepAlives:  *disableKeepAlives,
+		DisableCompression: *disableCompression,
+	}
+
+	// we start scraping on the tcg player
+	targets := []scrapeTarget{defaultTarget}
+	if *targetsFile != "" {
+		if *inputFile != "" {
+			log.Fatal("-input-file and -targets can't be used together")
+		}
+		if targets, err = loadTargets(*targetsFile); err != nil {
+			log.Fatal("Invalid -targets:", err)
+		}
+	}
+	if *inputFile != "" {
+		path, err := filepath.Abs(*inputFile)
+		if err != nil {
+			log.Fatal("Invalid -input-file:", err)
+		}
+		targets[0].URL = (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String()
+	}
+
+	// Ctrl-C stops the scrape like -timeout does: no new pages are visited
+	// and the products collected so far are saved. Signals stay caught
+	// until the end, so a second Ctrl-C can't cut the CSV write short.
+	ctx, interrupt := context.WithCancel(context.Background())
+	defer interrupt()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		fmt.Println("\nInterrupted, finishing the requests in flight and saving what was collected...")
+		interrupt()
+	}()
+
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	// Targets run one after the other, each with its own collector. A
+	// target that fails doesn't stop the others.
+	var products []Product
+	failedTargets := 0
+	for _, target := range targets {
+		if ctx.Err() != nil {
+			break
+		}
+		fmt.Printf("Starting to scrape %s: %s\n", target.Source, target.URL)
+
+		targetOpts := opts
+		targetOpts.Source = target.Source
+		if len(target.Selectors) > 0 {
+			targetOpts.Selectors = rowSelectors(strings.Join(target.Selectors, ","), target.ReplaceSelectors)
+		}
+
+		found, err := scrape(ctx, target.URL, targetOpts)
+		var parseErr *rowParseError
+		if errors.As(err, &parseErr) {
+			log.Fatalf("Aborting, -strict is set and %v", err)
+		}
+		if err != nil {
+			failedTargets++
+			if failedTargets == len(targets) {
+				log.Fatal("Error visiting URL:", err)
+			}
+			log.Printf("Error visiting %s (%s): %v\n", target.URL, target.Source, err)
+			continue
+		}
+		products = append(products, found...)
+	}
+
+	timedOut := errors.Is(ctx.Err(), context.DeadlineExceeded)
+	interrupted := errors.Is(ctx.Err(), context.Canceled)
+	if timedOut {
+		fmt.Printf("\nScrape timed out after %s! Saving the %d products collected so far\n", *timeout, len(products))
+	} else if interrupted {
+		fmt.Printf("\nScrape interrupted! Saving the %d products collected so far\n", len(products))
+	} else {
+		fmt.Printf("\nScraping completed! Found %d products\n", len(products))
+	}
+
+	// the scrape order changes from run to run, a stable one makes
+	// consecutive CSVs diff cleanly
+	sortProducts(products, *sortFlag)
+
+	// this we want to add it to the csv files and/or the database
+	saveFailed := false
+	if len(products) > 0 {
+		for _, sink := range sinks {
+			if err := sink.Write(products); err != nil {
+				log.Printf("Error writing products: %v\n", err)
+				saveFailed = true
+			}
+		}
+	}
+
+	// Print summary
+	printSummary(products, *pretty)
+
+	if saveFailed {
+		fmt.Println("\nSaving the results failed, see the errors above")
+	}
+	if failedTargets > 0 {
+		fmt.Printf("\n%d of %d targets failed, see the errors above\n", failedTargets, len(targets))
+	}
+	if timedOut || interrupted || saveFailed || failedTargets > 0 {
+		closeSinks()
+		closeDebugger()
+		if interrupted && !saveFailed && failedTargets == 0 {
+			os.Exit(130) // the shell's code for a command stopped by Ctrl-C
+		}
+		os.Exit(1)
+	}
+}
+
+// scrape sets up a collector with all the callbacks, visits targetURL and
+// returns the products it found. It does not depend on the live site, so it
+// can be pointed at saved pages served from a local server.
+//
+// Once ctx is done no new requests are made, the ones in flight finish and
+// whatever was collected up to then is returned.
+func scrape(ctx context.Context, targetURL string, opts scrapeOptions) ([]Product, error) {
+	// Create a new collector object
+	c := colly.NewCollector(
+		colly.UserAgent("Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"),
+	)
+	if opts.Debugger != nil {
+		c.SetDebugger(opts.Debugger)
+	}
+	// colly also reads this from COLLY_PARSE_HTTP_ERROR_RESPONSE, the flag
+	// decides
+	c.ParseHTTPErrorResponse = opts.ParseErrorPages
+
+	// found out of rate limiting and how to implmenet it since, tcg does not like mutiple requests
+	c.Limit(&colly.LimitRule{
+		DomainGlob:  "*" + targetHost(targetURL) + "*",
+		Parallelism: opts.Parallelism,
+		Delay:       opts.Delay,
+	})
+	// pages are only fetched at once when requests don't block each other.
+	// The persistent queue fetches them on its own threads instead, it
+	// needs each request to block until the page is done.
+	c.Async = opts.Parallelism > 1 && opts.QueueDir == ""
+
+	var pages *queue.Queue
+	var pending *fileQueue
+	if opts.QueueDir != "" {
+		pending = &fileQueue{path: queuePath(opts.QueueDir, targetURL)}
+		var err error
+		if pages, err = queue.New(opts.Parallelism, pending); err != nil {
+			return nil, err
+		}
+	}
+
+	// visit requests a page, through the persistent queue when there is one
+	visit := func(pageURL string, pageCtx *colly.Context) error {
+		if pages == nil {
+			return c.Request("GET", pageURL, nil, pageCtx, nil)
+		}
+		u, err := url.Parse(pageURL)
+		if err != nil {
+			return err
+		}
+		pageCtx.Put(queueEntryKey, pageURL)
+		return pages.AddRequest(&colly.Request{URL: u, Method: "GET", Ctx: pageCtx})
+	}
+
+	// all pages come from the same host, so keeping connections alive saves a
+	// handshake per page. Starting from the default transport keeps its dial
+	// and TLS handshake timeouts and HTTP/2.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = opts.MaxIdleConns
+	transport.MaxIdleConnsPerHost = opts.MaxIdleConns
+	transport.IdleConnTimeout = opts.IdleConnTimeout
+	transport.DisableKeepAlives = opts.DisableKeepAlives
+	transport.DisableCompression = opts.DisableCompression
+	// file:// URLs read local HTML, so selectors can be developed offline.
+	// Only a local target gets the protocol, a page from the web must not
+	// be able to link to the files of the machine scraping it.
+	localTarget := isFileURL(targetURL)
+	if localTarget {
+		transport.RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+	}
+	c.WithTransport(transport)
+
+	// mu guards products, pageProducts, pageRows and parseErr, the
+	// callbacks of pages fetched in parallel run at the same time
+	var mu sync.Mutex
+	var products []Product
+	if pending != nil {
+		// a resumed scrape returns the pages the earlier runs finished too
+		products = pending.finishedProducts()
+	}
+
+	// parseErr is the first row that couldn't be parsed in strict mode, no
+	// new pages are visited once it is set
+	var parseErr error
+	strictFail := func(r *colly.Request, product Product, err error) bool {
+		if !opts.Strict {
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if parseErr == nil {
+			parseErr = &rowParseError{URL: r.URL.String(), Name: product.Name, Err: err}
+		}
+		return true
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return parseErr != nil
+	}
+
+	// pageProducts are the products found on each page by request ID, so
+	// pages that yield nothing can be dumped and the persistent queue keeps
+	// the products of the pages done. Pagination visits run inside the
+	// previous page's callbacks, so a running total wouldn't do.
+	pageProducts := make(map[uint32][]Product)
+	addProduct := func(r *colly.Request, product Product) bool {
+		if !matchesConsoleFilter(product.Console, opts.ConsoleFilter) {
+			fmt.Printf("Skipping %s: console %q doesn't match -console-filter\n", product.Name, product.Console)
+			return false
+		}
+		product.Source = opts.Source
+		product.Page = requestPage(r)
+		mu.Lock()
+		defer mu.Unlock()
+		products = append(products, product)
+		pageProducts[r.ID] = append(pageProducts[r.ID], product)
+		return true
+	}
+
+	// use the colly html object
+	c.OnHTML("html", func(e *colly.HTMLElement) {
+		if isErrorPage(e.Request) {
+			return
+		}
+		fmt.Println("=== PAGE TITLE ===")
+		fmt.Println(e.DOM.Find("title").Text())
+
+		fmt.Println("\n=== TABLES FOUND ===")
+		e.DOM.Find("table").Each(func(i int, s *goquery.Selection) {
+			id, _ := s.Attr("id")
+			class, _ := s.Attr("class")
+			fmt.Printf("Table %d: id='%s', class='%s'\n", i, id, class)
+		})
+		fmt.Println("\n=== CHECKING COMMON SELECTORS ===")
+		selectors := []string{
+			"table#games_table tbody tr",
+			"table tbody tr",
+			".product-row",
+			".search-result",
+			"[data-product]",
+			"tr[data-game-id]",
+		}
+
+		for _, selector := range selectors {
+			count := e.DOM.Find(selector).Length()
+			fmt.Printf("Selector '%s': %d elements\n", selector, count)
+		}
+
+		fmt.Println("\n=== FIRST FEW TABLE ROWS ===")
+		e.DOM.Find("table tr").Each(func(i int, s *goquery.Selection) {
+			if i < 5 { // Only first 5 rows
+				text := strings.TrimSpace(s.Text())
+				if text != "" {
+					fmt.Printf("Row %d: %s\n", i, text[:min(100, len(text))])
+				}
+			}
+		})
+	})
+
+	// A query with a single match lands on the product page itself, which has
+	// a price block instead of a results table
+	c.OnHTML("html", func(e *colly.HTMLElement) {
+		if failed() || isErrorPage(e.Request) || !isProductPage(e.Request.URL, e.DOM) {
+			return
+		}
+
+		product := normalizeProduct(parseProductPage(e))
+		if product.Name != "" && !hasOnlyPlaceholderPrices(product) {
+			if err := checkPriceCells(product); err != nil && strictFail(e.Request, product, err) {
+				return
+			}
+		}
+		if product.Name != "" && hasOnlyPlaceholderPrices(product) {
+			log.Printf("Skipping %s: no prices, only placeholders. %s appears to be JS-rendered\n",
+				product.Name, e.Request.URL)
+			return
+		}
+		if product.Name != "" && addProduct(e.Request, product) {
+			fmt.Printf("✓ Added product from product page: %s (%s)\n", product.Name, product.Console)
+		}
+	})
+
+	// pageRows are the rows of each page already parsed, by request ID. A
+	// row matched by several selectors is parsed by the first one only.
+	pageRows := make(map[uint32]map[*html.Node]bool)
+	firstMatch := func(e *colly.HTMLElement) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		rows := pageRows[e.Request.ID]
+		if rows == nil {
+			rows = make(map[*html.Node]bool)
+			pageRows[e.Request.ID] = rows
+		}
+		row := e.DOM.Get(0)
+		if rows[row] {
+			return false
+		}
+		rows[row] = true
+		return true
+	}
+
+	for _, selector := range opts.Selectors {
+		c.OnHTML(selector, func(e *colly.HTMLElement) {
+			// The price block on a product page is a table too, skip it here
+			if failed() || isErrorPage(e.Request) || isProductPage(e.Request.URL, e.DOM.Closest("html")) || !firstMatch(e) {
+				return
+			}
+
+			fmt.Printf("Found element with selector: %s\n", selector)
+
+			product := Product{SourceURL: e.Request.URL.String()}
+
+			nameSelectors := []string{
+				"td:first-child a",
+				"td:nth-child(1) a",
+				"a[href*='/game/']",
+				".product-name a",
+				"td a",
+			}
+
+			for _, nameSelector := range nameSelectors {
+				nameElement := e.DOM.Find(nameSelector)
+				if nameElement.Length() > 0 {
+					product.Name = strings.TrimSpace(nameElement.Text())
+					href, exists := nameElement.Attr("href")
+					if exists {
+						product.URL = e.Request.AbsoluteURL(href)
+					}
+					fmt.Printf("Found name with selector '%s': %s\n", nameSelector, product.Name)
+					break
+				}
+			}
+
+			cells := e.DOM.Find("td")
+			fmt.Printf("Number of cells in row: %d\n", cells.Length())
+
+			if cells.Length() > 0 {
+				cells.Each(func(i int, s *goquery.Selection) {
+					text := strings.TrimSpace(s.Text())
+					if text != "" && i < 8 { // Only show first 8 cells
+						fmt.Printf("  Cell %d: %s\n", i, text)
+					}
+				})
+
+				if cells.Length() >= 2 {
+					// Usually: Name, Console, then prices
+					if product.Name == "" {
+						product.Name = strings.TrimSpace(cells.Eq(0).Find("a").Text())
+						if product.Name == "" {
+							product.Name = strings.TrimSpace(cells.Eq(0).Text())
+						}
+					}
+
+					product.Console = strings.TrimSpace(cells.Eq(1).Text())
+
+					if cells.Length() >= 6 {
+						product.LoosePrice = strings.TrimSpace(cells.Eq(2).Text())
+						product.CompletePrice = strings.TrimSpace(cells.Eq(3).Text())
+						product.NewPrice = strings.TrimSpace(cells.Eq(4).Text())
+						product.GradedPrice = strings.TrimSpace(cells.Eq(5).Text())
+					}
+				}
+			}
+
+			product = normalizeProduct(product)
+
+			// Only add products with valid names
+			if product.Name != "" && product.Name != "Product" && product.Name != "Game" {
+				if cells.Length() < 6 {
+					err := fmt.Errorf("row has %d cells, the prices need at least 6", cells.Length())
+					if strictFail(e.Request, product, err) {
+						return
+					}
+				}
+
+				if hasOnlyPlaceholderPrices(product) {
+					log.Printf("Skipping %s: no prices, only placeholders. %s appears to be JS-rendered\n",
+						product.Name, e.Request.URL)
+					return
+				}
+
+				if err := checkPriceCells(product); err != nil && strictFail(e.Request, product, err) {
+					return
+				}
+
+				if addProduct(e.Request, product) {
+					fmt.Printf("✓ Added product: %s (%s)\n", product.Name, product.Console)
+				}
+			}
+		})
+	}
+
+	// Handle pagination if it exists. e.Request.Visit would share this
+	// page's context with the next one, so it gets a context of its own
+	// stamped with its page number.
+	c.OnHTML("a.next_page", func(e *colly.HTMLElement) {
+		nextURL := e.Attr("href")
+		if nextURL != "" && !isErrorPage(e.Request) {
+			fullURL := e.Request.AbsoluteURL(nextURL)
+			page := requestPage(e.Request) + 1
+			fmt.Printf("Following pagination to page %d: %s\n", page, fullURL)
+			pageCtx := colly.NewContext()
+			pageCtx.Put(pageKey, page)
+			if err := visit(fullURL, pageCtx); err != nil {
+				log.Printf("Error queuing page %d %s: %v\n", page, fullURL, err)
+			}
+		}
+	})
+
+	// Error handling
+	c.OnError(func(r *colly.Response, err error) {
+		fmt.Printf("Error scraping %s: %v\n", r.Request.URL, err)
+		if pending != nil {
+			pending.done(r.Request.Ctx.Get(queueEntryKey), nil)
+		}
+	})
+
+	// Log when starting and finishing requests
+	c.OnRequest(func(r *colly.Request) {
+		if ctx.Err() != nil {
+			fmt.Printf("Stopping, not visiting: %s\n", r.URL.String())
+			r.Abort()
+			return
+		}
+		if failed() {
+			r.Abort()
+			return
+		}
+		if r.URL.Scheme == "file" && !localTarget {
+			fmt.Printf("Not visiting %s, only a local target may link to local files\n", r.URL)
+			r.Abort()
+			return
+		}
+		if r.Ctx.GetAny(pageKey) == nil {
+			r.Ctx.Put(pageKey, 1)
+		}
+		fmt.Printf("Visiting page %d: %s\n", requestPage(r), r.URL.String())
+	})
+
+	// Error pages, like a 403 from bot protection or a 404, have tables and
+	// links of their own that mustn't end up as products. OnResponse runs
+	// before OnHTML, so the page is flagged here for the callbacks to skip.
+	c.OnResponse(func(r *colly.Response) {
+		if r.StatusCode >= 200 && r.StatusCode < 300 {
+			return
+		}
+		if opts.ParseErrorPages {
+			fmt.Printf("Parsing %d response anyway: %s\n", r.StatusCode, r.Request.URL)
+			return
+		}
+		fmt.Printf("Skipping %d response: %s\n", r.StatusCode, r.Request.URL)
+		r.Ctx.Put(errorPageKey, true)
+	})
+
+	// transcode non-UTF-8 pages before anything reads the body
+	c.OnResponse(collect.TranscodeResponse)
+
+	c.OnResponse(func(r *colly.Response) {
+		fmt.Printf("Response received: %d bytes from %s\n", len(r.Body), r.Request.URL)
+	})
+
+	// OnScraped runs after every OnHTML callback of the page
+	c.OnScraped(func(r *colly.Response) {
+		mu.Lock()
+		found := pageProducts[r.Request.ID]
+		delete(pageProducts, r.Request.ID)
+		delete(pageRows, r.Request.ID)
+		mu.Unlock()
+		if pending != nil {
+			pending.done(r.Request.Ctx.Get(queueEntryKey), found)
+		}
+		fmt.Printf("Page %d yielded %d products: %s\n", requestPage(r.Request), len(found), r.Request.URL)
+		if opts.DumpDir == "" || len(found) > 0 {
+			return
+		}
+		path, err := dumpPage(opts.DumpDir, r)
+		if err != nil {
+			log.Printf("Error dumping %s: %v\n", r.Request.URL, err)
+			return
+		}
+		fmt.Printf("No products found on %s, saved the HTML to %s\n", r.Request.URL, path)
+	})
+
+	if pages != nil {
+		if n, _ := pages.Size(); n > 0 {
+			fmt.Printf("Resuming the %d pages left in %s, %d products were found before\n", n, pending.path, len(products))
+		} else if err := visit(targetURL, colly.NewContext()); err != nil {
+			return nil, err
+		}
+
+		// once ctx is done OnRequest aborts the pages left, they stay in
+		// the file for the next run
+		if err := pages.Run(c); err != nil {
+			return nil, err
+		}
+		if ctx.Err() == nil && parseErr == nil {
+			pending.clear()
+		}
+	} else if err := c.Visit(targetURL); err != nil {
+		return nil, err
+	}
+
+	// Wait for all requests to complete
+	c.Wait()
+
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return products, nil
+}
+
+// normalizeProduct collapses the runs of spaces and newlines cell text
+// often holds into single spaces, so "Pokemon\n   151" becomes
+// "Pokemon 151"
+func normalizeProduct(product Product) Product {
+	for _, field := range []*string{&product.Name, &product.Console, &product.LoosePrice,
+		&product.CompletePrice, &product.NewPrice, &product.GradedPrice} {
+		*field = strings.Join(strings.Fields(*field), " ")
+	}
+	return product
+}
+
+// pageKey is the request context key of a page's number
+const pageKey = "page"
+
+// requestPage returns the page number stamped on the request, 0 if it has
+// none
+func requestPage(r *colly.Request) int {
+	switch page := r.Ctx.GetAny(pageKey).(type) {
+	case int:
+		return page
+	case float64:
+		// contexts read back from the persistent queue are JSON
+		return int(page)
+	}
+	return 0
+}
+
+// errorPageKey is the request context key flagging a non-2xx response
+const errorPageKey = "errorPage"
+
+// isErrorPage reports whether the request's response had a non-2xx status
+// and must not be parsed
+func isErrorPage(r *colly.Request) bool {
+	skip, _ := r.Ctx.GetAny(errorPageKey).(bool)
+	return skip
+}
+
+// isFileURL reports whether rawURL is a file:// URL, like the one
+// -input-file scrapes
+func isFileURL(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "file"
+}
+
+// targetHost is the host the rate limit applies to. Local files have none
+// and keep the PriceCharting limit, which never matches them.
+func targetHost(targetURL string) string {
+	if u, err := url.Parse(targetURL); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return "pricecharting.com"
+}
+
+// loadTargets reads the -targets file: a JSON array of scrapeTarget
+func loadTargets(path string) ([]scrapeTarget, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets []scrapeTarget
+	if err := json.Unmarshal(data, &targets); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s has no targets", path)
+	}
+
+	for i, target := range targets {
+		if strings.TrimSpace(target.Source) == "" {
+			return nil, fmt.Errorf("target %d has no source", i+1)
+		}
+		u, err := url.Parse(target.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file") {
+			return nil, fmt.Errorf("target %d (%s): %q is not an http, https or file URL", i+1, target.Source, target.URL)
+		}
+		targets[i].Source = strings.TrimSpace(target.Source)
+	}
+	return targets, nil
+}
+
+// rowParseError is a row -strict refused to skip
+type rowParseError struct {
+	URL  string
+	Name string
+	Err  error
+}
+
+func (e *rowParseError) Error() string {
+	return fmt.Sprintf("row %q on %s can't be parsed: %v", e.Name, e.URL, e.Err)
+}
+
+func (e *rowParseError) Unwrap() error { return e.Err }
+
+// priceCellPattern matches a price cell: a number with optional thousands
+// separators and decimals, surrounded by currency symbols but no letters
+var priceCellPattern = regexp.MustCompile(`^[^\p{L}\d]*\d[\d,]*(\.\d+)?[^\p{L}\d]*$`)
+
+// missingPriceMarkers are what PriceCharting shows for a price it doesn't
+// have, they aren't parse failures
+var missingPriceMarkers = map[string]bool{"-": true, "—": true, "n/a": true}
+
+// checkPriceCells returns an error for the first price cell that holds
+// neither a price, a placeholder nor a missing price marker
+func checkPriceCells(product Product) error {
+	cells := []struct{ name, text string }{
+		{"loose", product.LoosePrice},
+		{"complete", product.CompletePrice},
+		{"new", product.NewPrice},
+		{"graded", product.GradedPrice},
+	}
+	for _, cell := range cells {
+		text := strings.TrimSpace(cell.text)
+		if normalize.IsPricePlaceholder(text) || missingPriceMarkers[strings.ToLower(text)] {
+			continue
+		}
+		if !priceCellPattern.MatchString(text) {
+			return fmt.Errorf("%s price %q is not a number", cell.name, text)
+		}
+	}
+	return nil
+}
+
+// dumpPage writes the response body to dir, named by the SHA-256 of the
+// page URL so repeated runs overwrite the same file
+func dumpPage(dir string, r *colly.Response) (string, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256([]byte(r.Request.URL.String()))
+	path := filepath.Join(dir, hex.EncodeToString(sum[:])+".html")
+	if err := os.WriteFile(path, r.Body, 0o644); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// matchesConsoleFilter reports whether console contains one of the filter
+// substrings, ignoring case. An empty filter matches everything.
+func matchesConsoleFilter(console string, filter []string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	console = strings.ToLower(console)
+	for _, substring := range filter {
+		if strings.Contains(console, strings.ToLower(substring)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasOnlyPlaceholderPrices reports whether none of the product's price
+// cells hold an actual price, e.g. they all still read "Loading..."
+func hasOnlyPlaceholderPrices(product Product) bool {
+	for _, price := range []string{product.LoosePrice, product.CompletePrice, product.NewPrice, product.GradedPrice} {
+		if !normalize.IsPricePlaceholder(price) {
+			return false
+		}
+	}
+	return true
+}
+
+// rowSelectors builds the selector list from the -selectors flag. Custom
+// selectors are tried first, then the defaults unless replace is set.
+func rowSelectors(custom string, replace bool) []string {
+	var selectors []string
+	seen := make(map[string]bool)
+	add := func(selector string) {
+		selector = strings.TrimSpace(selector)
+		if selector == "" || seen[selector] {
+			return
+		}
+		seen[selector] = true
+		selectors = append(selectors, selector)
+	}
+
+	for _, selector := range strings.Split(custom, ",") {
+		add(selector)
+	}
+
+	if replace && len(selectors) > 0 {
+		return selectors
+	}
+	if replace {
+		log.Println("-replace-selectors set without -selectors, using the defaults")
+	}
+
+	for _, selector := range defaultSelectors {
+		add(selector)
+	}
+	return selectors
+}
+
+// isProductPage tells a single product page apart from a search results page,
+// first by the /game/ URL pattern and then by the product page elements
+func isProductPage(u *url.URL, doc *goquery.Selection) bool {
+	if strings.HasPrefix(u.Path, "/game/") {
+		return true
+	}
+	return doc.Find("#product_name").Length() > 0 && doc.Find("#price_data").Length() > 0 &&
+		doc.Find("table#games_table").Length() == 0
+}
+
+// parseProductPage reads the title and the price block of a product page
+func parseProductPage(e *colly.HTMLElement) Product {
+	name, console := collect.ProductTitle(e.DOM)
+
+	priceText := func(id string) string {
+		return strings.TrimSpace(e.DOM.Find("#price_data #" + id + " .price").First().Text())
+	}
+
+	return Product{
+		Name:          name,
+		Console:       console,
+		LoosePrice:    priceText("used_price"),
+		CompletePrice: priceText("complete_price"),
+		NewPrice:      priceText("new_price"),
+		GradedPrice:   priceText("graded_price"),
+		URL:           e.Request.URL.String(),
+		SourceURL:     e.Request.URL.String(),
+	}
+}
+
+// productOrders are the -sort orders, each a list of keys compared in turn.
+// none keeps the scrape order.
+var productOrders = map[string][]func(Product) string{
+	"console": {productConsole, productName},
+	"name":    {productName, productConsole},
+	"none":    nil,
+}
+
+func productConsole(p Product) string { return p.Console }
+func productName(p Product) string    { return p.Name }
+
+// sortProducts sorts the products in the -sort order. Ties are broken by
+// source and URL, then the scrape order, so the output is the same for the
+// same products.
+func sortProducts(products []Product, order string) {
+	keys := productOrders[order]
+	if len(keys) == 0 {
+		return
+	}
+	keys = append(keys[:len(keys):len(keys)],
+		func(p Product) string { return p.Source },
+		func(p Product) string { return p.URL })
+
+	sort.SliceStable(products, func(i, j int) bool {
+		for _, key := range keys {
+			a, b := key(products[i]), key(products[j])
+			if la, lb := strings.ToLower(a), strings.ToLower(b); la != lb {
+				return la < lb
+			}
+			if a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+}
+
+// queueEntryKey is the request context key of the URL a page was queued
+// with, which tells fileQueue the page is done
+const queueEntryKey = "queueEntry"
+
+// queuePath is the -queue-dir file of a target, named after its URL like
+// the -dump-dir pages
+func queuePath(dir, targetURL string) string {
+	sum := sha256.Sum256([]byte(targetURL))
+	return filepath.Join(dir, hex.EncodeToString(sum[:])+".queue.json")
+}
+
+// fileQueue is a colly queue storage that keeps the requests in a JSON
+// file, so the pages still to visit survive an interruption or a crash. A
+// request stays in the file until done is called for its page, so a page
+// cut short is visited again on the next run. done moves the page's
+// products to the file in the same write, so the run that resumes returns
+// each page's products once. The file is removed once every page is done.
+type fileQueue struct {
+	path string
+
+	mu       sync.Mutex
+	pending  []json.RawMessage
+	inFlight []json.RawMessage
+	finished []Product
+}
+
+// queueFileContent is what a fileQueue saves: the requests not done yet and
+// the products of the pages done
+type queueFileContent struct {
+	Requests []json.RawMessage `json:"requests"`
+	Products []Product         `json:"products,omitempty"`
+}
+
+// Init loads the requests and products a previous run left in the file
+func (q *fileQueue) Init() error {
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o755); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(q.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var content queueFileContent
+	if err := json.Unmarshal(data, &content); err != nil {
+		return fmt.Errorf("invalid queue file %s: %v", q.path, err)
+	}
+	q.pending, q.finished = content.Requests, content.Products
+	return nil
+}
+
+func (q *fileQueue) AddRequest(r []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending = append(q.pending, append(json.RawMessage(nil), r...))
+	return q.save()
+}
+
+func (q *fileQueue) GetRequest() ([]byte, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return nil, errors.New("the queue is empty")
+	}
+	r := q.pending[0]
+	q.pending = q.pending[1:]
+	q.inFlight = append(q.inFlight, r)
+	// the request is still run, an error would drop it
+	if err := q.save(); err != nil {
+		log.Printf("Error saving the queue: %v\n", err)
+	}
+	return r, nil
+}
+
+func (q *fileQueue) QueueSize() (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending), nil
+}
+
+// finishedProducts returns the products of the pages done, including the
+// ones of earlier runs
+func (q *fileQueue) finishedProducts() []Product {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]Product(nil), q.finished...)
+}
+
+// done removes the request queued with entry, see queueEntryKey, and keeps
+// the products found on its page
+func (q *fileQueue) done(entry string, found []Product) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, r := range q.inFlight {
+		var request struct {
+			Ctx map[string]interface{}
+		}
+		if json.Unmarshal(r, &request) == nil && request.Ctx[queueEntryKey] == entry {
+			q.inFlight = append(q.inFlight[:i], q.inFlight[i+1:]...)
+			q.finished = append(q.finished, found...)
+			if err := q.save(); err != nil {
+				log.Printf("Error saving the queue: %v\n", err)
+			}
+			return
+		}
+	}
+}
+
+// clear removes the file after a scrape that visited every page, requests
+// that never reached a callback, like a page visited twice, included
+func (q *fileQueue) clear() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending, q.inFlight, q.finished = nil, nil, nil
+	if err := q.save(); err != nil {
+		log.Printf("Error removing the queue: %v\n", err)
+	}
+}
+
+// save writes the requests not done yet, in flight first, with the
+// products of the pages done, replacing the file at once so a crash can't
+// leave half of it
+func (q *fileQueue) save() error {
+	requests := append(append([]json.RawMessage{}, q.inFlight...), q.pending...)
+	if len(requests) == 0 {
+		if err := os.Remove(q.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(queueFileContent{Requests: requests, Products: q.finished})
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// parseCSVColumns parses the -csv-columns flag. Each entry is a Product
+// field, optionally followed by =header; without a header the field name is
+// used. An empty spec returns the default columns.
+func parseCSVColumns(spec string) ([]csvColumn, error) {
+	if strings.TrimSpace(spec) == "" {
+		return defaultCSVColumns, nil
+	}
+
+	productType := reflect.TypeOf(Product{})
+	var columns []csvColumn
+	for _, entry := range strings.Split(spec, ",") {
+		fieldName, header, _ := strings.Cut(entry, "=")
+		fieldName = strings.TrimSpace(fieldName)
+		if fieldName == "" {
+			continue
+		}
+
+		field, ok := productType.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, fieldName)
+		})
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", fieldName)
+		}
+
+		header = strings.TrimSpace(header)
+		if header == "" {
+			header = field.Name
+		}
+		columns = append(columns, csvColumn{Field: field.Name, Header: header})
+	}
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("no columns in %q", spec)
+	}
+	return columns, nil
+}
+
+// saveToCSV writes the products to pokemon_151_prices.csv. If the file
+// can't be written the CSV is printed to stdout instead so the data isn't
+// lost, and the error is still returned.
+func saveToCSV(products []Product, columns []csvColumn) error {
+	file, err := os.Create("pokemon_151_prices.csv")
+	if err != nil {
+		fmt.Println("Could not create pokemon_151_prices.csv, printing the CSV to stdout instead:")
+		if writeErr := writeCSV(os.Stdout, products, columns); writeErr != nil {
+			log.Printf("Error printing CSV: %v\n", writeErr)
+		}
+		return fmt.Errorf("error creating CSV file: %w", err)
+	}
+	defer file.Close()
+
+	if err := writeCSV(file, products, columns); err != nil {
+		return fmt.Errorf("error writing CSV file: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error closing CSV file: %v", err)
+	}
+
+	fmt.Printf("Data saved to pokemon_151_prices.csv\n")
+	return nil
+}
+
+func writeCSV(out io.Writer, products []Product, columns []csvColumn) error {
+	writer := csv.NewWriter(out)
+
+	// Write header
+	header := make([]string, len(columns))
+	for i, column := range columns {
+		header[i] = column.Header
+	}
+	writer.Write(header)
+
+	// Write data
+	for _, product := range products {
+		value := reflect.ValueOf(product)
+		record := make([]string, len(columns))
+		for i, column := range columns {
+			record[i] = fmt.Sprint(value.FieldByName(column.Field).Interface())
+		}
+		writer.Write(record)
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// Sink is a destination for scraped products
+type Sink interface {
+	Write(products []Product) error
+}
+
+// csvSink writes products to pokemon_151_prices.csv
+type csvSink struct {
+	Columns []csvColumn
+	// ASCII transliterates the names, see toASCII
+	ASCII bool
+}
+
+func (s csvSink) Write(products []Product) error {
+	if s.ASCII {
+		products = asciiProducts(products)
+	}
+	return saveToCSV(products, s.Columns)
+}
+
+// asciiProducts returns a copy of the products with their names
+// transliterated to ASCII, the other sinks keep the originals
+func asciiProducts(products []Product) []Product {
+	converted := make([]Product, len(products))
+	for i, product := range products {
+		product.Name = toASCII(product.Name)
+		product.Console = toASCII(product.Console)
+		product.Source = toASCII(product.Source)
+		converted[i] = product
+	}
+	return converted
+}
+
+// asciiReplacements spell out the characters that don't decompose into a
+// letter and accents
+var asciiReplacements = map[rune]string{
+	'♀': " F", '♂': " M",
+	'ß': "ss", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE",
+	'ø': "o", 'Ø': "O", 'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D",
+	'‘': "'", '’': "'", '“': `"`, '”': `"`, '–': "-", '—': "-",
+	'…': "...", '×': "x", '•': "-",
+}
+
+// stripAccents splits letters from their accents and drops the accents.
+// NFKD also turns compatibility forms such as full-width letters into
+// plain ones.
+var stripAccents = transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+
+// toASCII transliterates text to ASCII, é becomes e and ♀ " F". Characters
+// it has no spelling for become "?".
+func toASCII(text string) string {
+	if isASCII(text) {
+		return text
+	}
+	stripped, _, err := transform.String(stripAccents, text)
+	if err != nil {
+		stripped = text
+	}
+
+	var b strings.Builder
+	for _, r := range stripped {
+		switch replacement, ok := asciiReplacements[r]; {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case ok:
+			b.WriteString(replacement)
+		case unicode.IsSpace(r):
+			b.WriteByte(' ')
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+func isASCII(text string) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// dbSink stores products as cards and prices in the same Postgres database
+// the API server reads from
+type dbSink struct {
+	db *store.Database
+}
+
+func (s dbSink) Write(products []Product) error {
+	inserted := 0
+	for _, product := range products {
+		// only the loose (ungraded) price is stored, it is what the
+		// dashboard compares against the other sources
+		price := normalize.ExtractPrice(product.LoosePrice)
+		if price <= 0 {
+			continue
+		}
+
+		cardID, err := s.db.InsertCard(store.Card{
+			Name:      product.Name,
+			SetName:   normalize.SetNameFromConsole(product.Console),
+			Condition: normalize.DefaultCondition,
+		})
+		if err != nil {
+			return err
+		}
+
+		source := product.Source
+		if source == "" {
+			source = defaultTarget.Source
+		}
+		// like the server's sources, a price without a symbol gets its
+		// source's SOURCE_CURRENCIES currency
+		currency := normalize.CurrencyFromText(product.LoosePrice)
+		if currency == "" {
+			currency = normalize.SourceCurrency(source)
+		}
+		if err := s.db.InsertPrice(store.Price{
+			CardID:   cardID,
+			Source:   source,
+			Price:    price,
+			Currency: currency,
+			URL:      product.URL,
+		}); err != nil {
+			return err
+		}
+		inserted++
+	}
+
+	fmt.Printf("Data saved to the database: %d prices\n", inserted)
+	return nil
+}
+
+// newSinks builds the sinks selected by the -sink flag, CSV output goes
+// through csvOut. The returned func closes anything the sinks opened.
+func newSinks(kind string, csvOut csvSink) ([]Sink, func(), error) {
+	noop := func() {}
+
+	switch kind {
+	case "csv":
+		return []Sink{csvOut}, noop, nil
+	case "db", "both":
+		dbConfig, err := store.LoadDatabaseConfig()
+		if err != nil {
+			return nil, noop, fmt.Errorf("invalid database configuration: %v", err)
+		}
+		db, err := store.NewDatabase(dbConfig)
+		if err != nil {
+			return nil, noop, err
+		}
+		closeDB := func() { db.Close() }
+
+		if kind == "db" {
+			return []Sink{dbSink{db: db}}, closeDB, nil
+		}
+		return []Sink{csvOut, dbSink{db: db}}, closeDB, nil
+	default:
+		return nil, noop, fmt.Errorf("unknown sink %q, expected csv, db or both", kind)
+	}
+}
+
+// printSummary prints the totals and a few example products. With pretty
+// the console breakdown and the examples are aligned tables, otherwise
+// they're plain lines that are easy to grep.
+func printSummary(products []Product, pretty bool) {
+	if len(products) == 0 {
+		fmt.Println("No products were scraped. The website structure might have changed.")
+		return
+	}
+
+	fmt.Println("\n=== SCRAPING SUMMARY ===")
+	fmt.Printf("Total products found: %d\n", len(products))
+
+	// Count by console
+	consoleCount := make(map[string]int)
+	for _, product := range products {
+		consoleCount[product.Console]++
+	}
+
+	fmt.Println("\nBreakdown by console:")
+	if pretty {
+		consoles := make([]string, 0, len(consoleCount))
+		for console := range consoleCount {
+			consoles = append(consoles, console)
+		}
+		sort.Slice(consoles, func(i, j int) bool {
+			if consoleCount[consoles[i]] != consoleCount[consoles[j]] {
+				return consoleCount[consoles[i]] > consoleCount[consoles[j]]
+			}
+			return consoles[i] < consoles[j]
+		})
+
+		rows := make([][]string, len(consoles))
+		for i, console := range consoles {
+			rows[i] = []string{console, fmt.Sprint(consoleCount[console])}
+		}
+		printTable([]string{"Console", "Products"}, rows)
+	} else {
+		for console, count := range consoleCount {
+			fmt.Printf("- %s: %d products\n", console, count)
+		}
+	}
+
+	// and by page, pages without products are logged as they're scraped
+	type sourcePage struct {
+		source string
+		page   int
+	}
+	var pages []sourcePage
+	pageCount := make(map[sourcePage]int)
+	for _, product := range products {
+		key := sourcePage{product.Source, product.Page}
+		if pageCount[key] == 0 {
+			pages = append(pages, key)
+		}
+		pageCount[key]++
+	}
+	fmt.Println("\nBreakdown by page:")
+	for _, page := range pages {
+		fmt.Printf("- %s page %d yielded %d products\n", page.source, page.page, pageCount[page])
+	}
+
+	// and by source when several targets were scraped
+	var sources []string
+	sourceCount := make(map[string]int)
+	for _, product := range products {
+		if sourceCount[product.Source] == 0 {
+			sources = append(sources, product.Source)
+		}
+		sourceCount[product.Source]++
+	}
+	if len(sources) > 1 {
+		fmt.Println("\nBreakdown by source:")
+		for _, source := range sources {
+			fmt.Printf("- %s: %d products\n", source, sourceCount[source])
+		}
+	}
+
+	// Show first few products as examples
+	fmt.Println("\nFirst few products:")
+	examples := products[:min(5, len(products))]
+	if pretty {
+		rows := make([][]string, len(examples))
+		for i, product := range examples {
+			rows[i] = []string{fmt.Sprint(i + 1), product.Name, product.Console, product.LoosePrice,
+				product.CompletePrice, product.NewPrice, product.GradedPrice}
+		}
+		printTable([]string{"#", "Name", "Console", "Loose", "Complete", "New", "Graded"}, rows)
+		return
+	}
+	for i, product := range examples {
+		fmt.Printf("%d. %s (%s) - Loose: %s\n",
+			i+1, product.Name, product.Console, product.LoosePrice)
+	}
+}
+
+// printTable prints rows as a table with columns aligned by tabwriter,
+// separated by | and with a rule under the header
+func printTable(header []string, rows [][]string) {
+	widths := make([]int, len(header))
+	for _, row := range append([][]string{header}, rows...) {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(cell))
+		}
+	}
+	rule := make([]string, len(header))
+	for i, width := range widths {
+		rule[i] = strings.Repeat("-", width)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', tabwriter.Debug)
+	for _, row := range append([][]string{header, rule}, rows...) {
+		fmt.Fprintln(w, " "+strings.Join(row, "\t ")+"\t")
+	}
+	w.Flush()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// queuedRequest is a request as colly's queue stores it, queued with entry
+func queuedRequest(t *testing.T, entry string) []byte {
+	t.Helper()
+	r, err := json.Marshal(map[string]interface{}{
+		"URL":    entry,
+		"Method": "GET",
+		"Ctx":    map[string]interface{}{queueEntryKey: entry},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// queueFile returns what is saved in the file, nothing if there is none
+func queueFile(t *testing.T, path string) queueFileContent {
+	t.Helper()
+	var content queueFileContent
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return content
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		t.Fatalf("invalid queue file: %v", err)
+	}
+	return content
+}
+
+func TestFileQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue", "target.queue.json")
+	q := &fileQueue{path: path}
+	if err := q.Init(); err != nil {
+		t.Fatalf("Init without a file: %v", err)
+	}
+	if _, err := q.GetRequest(); err == nil {
+		t.Error("GetRequest on an empty queue succeeded")
+	}
+
+	page1, page2 := queuedRequest(t, "https://example.com/1"), queuedRequest(t, "https://example.com/2")
+	for _, r := range [][]byte{page1, page2} {
+		if err := q.AddRequest(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := q.QueueSize(); n != 2 || len(queueFile(t, path).Requests) != 2 {
+		t.Fatalf("queued %d requests and saved %d, want 2", n, len(queueFile(t, path).Requests))
+	}
+
+	r, err := q.GetRequest()
+	if err != nil || string(r) != string(page1) {
+		t.Fatalf("GetRequest = %s, %v, want the first page", r, err)
+	}
+	// the page is in flight, it stays in the file until it is done
+	if n, _ := q.QueueSize(); n != 1 || len(queueFile(t, path).Requests) != 2 {
+		t.Errorf("after GetRequest %d requests are queued and %d saved, want 1 and 2", n, len(queueFile(t, path).Requests))
+	}
+	pikachu := Product{Name: "Pikachu", LoosePrice: "$4.50", Page: 1}
+	q.done("https://example.com/unknown", []Product{pikachu})
+	if len(queueFile(t, path).Requests) != 2 {
+		t.Error("done for a page that isn't in flight changed the file")
+	}
+	q.done("https://example.com/1", []Product{pikachu})
+	if saved := queueFile(t, path).Requests; len(saved) != 1 || string(saved[0]) != string(page2) {
+		t.Errorf("after done the file holds %s, want only the second page", saved)
+	}
+	if saved := queueFile(t, path).Products; len(saved) != 1 || saved[0] != pikachu {
+		t.Errorf("after done the file holds the products %+v, want the first page's", saved)
+	}
+
+	// a second run resumes what the first one left, in flight pages first
+	if _, err := q.GetRequest(); err != nil {
+		t.Fatal(err)
+	}
+	resumed := &fileQueue{path: path}
+	if err := resumed.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := resumed.GetRequest(); err != nil || string(r) != string(page2) {
+		t.Errorf("resumed GetRequest = %s, %v, want the second page", r, err)
+	}
+	if found := resumed.finishedProducts(); len(found) != 1 || found[0] != pikachu {
+		t.Errorf("resumed products = %+v, want the first page's", found)
+	}
+
+	resumed.clear()
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("clear left the file: %v", err)
+	}
+}
+
+func TestFileQueueInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "target.queue.json")
+	if err := os.WriteFile(path, []byte("not json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&fileQueue{path: path}).Init(); err == nil {
+		t.Error("Init accepted an invalid file")
+	}
+}
+
+func TestScrapeResumesQueue(t *testing.T) {
+	results, err := os.ReadFile(filepath.Join("testdata", "results.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, interrupt := context.WithCancel(context.Background())
+	defer interrupt()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := string(results)
+		if r.URL.Path == "/1" {
+			// the first run is interrupted while the first page loads
+			interrupt()
+			page = strings.Replace(page, "</body>", `<a class="next_page" href="/2">Next</a></body>`, 1)
+		}
+		fmt.Fprint(w, page)
+	}))
+	t.Cleanup(server.Close)
+
+	opts := scrapeOptions{
+		Selectors:   rowSelectors("", false),
+		Parallelism: 1,
+		Delay:       time.Millisecond,
+		QueueDir:    t.TempDir(),
+	}
+	first, err := scrape(ctx, server.URL+"/1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 {
+		t.Fatalf("the interrupted run found %d products, want the first page's 2", len(first))
+	}
+	path := queuePath(opts.QueueDir, server.URL+"/1")
+	if saved := queueFile(t, path); len(saved.Requests) != 1 || len(saved.Products) != 2 {
+		t.Fatalf("the interrupted run saved %d requests and %d products, want the second page and the first page's products", len(saved.Requests), len(saved.Products))
+	}
+
+	resumed, err := scrape(context.Background(), server.URL+"/1", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pages := make(map[int]int)
+	for _, product := range resumed {
+		pages[product.Page]++
+	}
+	if len(resumed) != 4 || pages[1] != 2 || pages[2] != 2 {
+		t.Errorf("the resumed run found %d products on pages %v, want both pages' 2", len(resumed), pages)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the queue file is left after the resumed run finished: %v", err)
+	}
+}
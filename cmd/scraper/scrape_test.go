@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// scrapeFixture serves testdata and scrapes one of its pages with the
+// default selectors
+func scrapeFixture(t *testing.T, page string, strict bool) ([]Product, error) {
+	t.Helper()
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	t.Cleanup(server.Close)
+
+	return scrape(context.Background(), server.URL+"/"+page, scrapeOptions{
+		Selectors:   rowSelectors("", false),
+		Strict:      strict,
+		Parallelism: 1,
+		Delay:       time.Millisecond,
+	})
+}
+
+// assertProducts compares the scraped products' names and prices, ignoring
+// the URLs, which hold the test server's port
+func assertProducts(t *testing.T, got, want []Product) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d products, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		got, want := got[i], want[i]
+		got.URL, got.SourceURL = "", ""
+		if got != want {
+			t.Errorf("product %d = %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestScrapeResults(t *testing.T) {
+	products, err := scrapeFixture(t, "results.html", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each row once, though it matches several of the default selectors
+	assertProducts(t, products, []Product{
+		{Name: "Charizard ex #199", Console: "Pokemon Scarlet & Violet 151", LoosePrice: "$389.99",
+			CompletePrice: "$512.00", NewPrice: "$1,024.50", GradedPrice: "$2,100.00", Page: 1},
+		{Name: "Mew ex #205", Console: "Pokemon Scarlet & Violet 151", LoosePrice: "$98.12",
+			CompletePrice: "-", NewPrice: "$240.00", GradedPrice: "N/A", Page: 1},
+	})
+	if len(products) > 0 && !strings.HasSuffix(products[0].URL, "/game/pokemon-scarlet-&-violet-151/charizard-ex-199") {
+		t.Errorf("URL = %q, want the row's product link", products[0].URL)
+	}
+}
+
+func TestScrapeEmptyResults(t *testing.T) {
+	products, err := scrapeFixture(t, "empty.html", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) != 0 {
+		t.Errorf("got %d products from an empty result, want none: %+v", len(products), products)
+	}
+}
+
+func TestScrapeMalformedPage(t *testing.T) {
+	products, err := scrapeFixture(t, "malformed.html", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the unclosed cells still parse, the row without prices and the one
+	// still loading are skipped
+	assertProducts(t, products, []Product{
+		{Name: "Pikachu #25", Console: "Pokemon Scarlet & Violet 151", LoosePrice: "$4.50",
+			CompletePrice: "$6.00", NewPrice: "$9.99", GradedPrice: "$40.00", Page: 1},
+	})
+}
+
+func TestScrapeMalformedPageStrict(t *testing.T) {
+	_, err := scrapeFixture(t, "malformed.html", true)
+
+	var rowErr *rowParseError
+	if !errors.As(err, &rowErr) {
+		t.Fatalf("error = %v, want a rowParseError", err)
+	}
+	if rowErr.Name != "Bulbasaur #1" {
+		t.Errorf("row %q failed, want the one without prices", rowErr.Name)
+	}
+}
+
+func TestScrapeProductPage(t *testing.T) {
+	products, err := scrapeFixture(t, "product.html", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the price block's table isn't read as a results row
+	assertProducts(t, products, []Product{
+		{Name: "Charizard ex #199", Console: "Pokemon Scarlet & Violet 151", LoosePrice: "$389.99",
+			CompletePrice: "$512.00", NewPrice: "$1,024.50", GradedPrice: "$2,100.00", Page: 1},
+	})
+}
+
+func TestIsProductPage(t *testing.T) {
+	tests := []struct {
+		page string
+		path string
+		want bool
+	}{
+		{"results.html", "/search-products", false},
+		{"empty.html", "/search-products", false},
+		{"malformed.html", "/search-products", false},
+		{"product.html", "/search-products", true},
+		// the URL alone tells a product page
+		{"results.html", "/game/pokemon-scarlet-&-violet-151/charizard-ex-199", true},
+	}
+	for _, test := range tests {
+		file, err := os.Open(filepath.Join("testdata", test.page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc, err := goquery.NewDocumentFromReader(file)
+		file.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		u := &url.URL{Scheme: "https", Host: "www.pricecharting.com", Path: test.path}
+		if got := isProductPage(u, doc.Selection); got != test.want {
+			t.Errorf("isProductPage(%s, %s) = %t, want %t", test.path, test.page, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeProductMultilineCells(t *testing.T) {
+	product := normalizeProduct(Product{
+		Name:          "\n\t\tCharizard\n\t\t  #4\n\t",
+		Console:       "Pokemon\n  151",
+		LoosePrice:    "\n  $389.99\n",
+		CompletePrice: "$1,024.50",
+		NewPrice:      " \t ",
+		GradedPrice:   "$2,100\r\n(PSA 10)",
+		URL:           "https://example.com/game/pokemon-151/charizard-4",
+	})
+	want := Product{
+		Name:          "Charizard #4",
+		Console:       "Pokemon 151",
+		LoosePrice:    "$389.99",
+		CompletePrice: "$1,024.50",
+		GradedPrice:   "$2,100 (PSA 10)",
+		URL:           "https://example.com/game/pokemon-151/charizard-4",
+	}
+	if product != want {
+		t.Errorf("normalizeProduct = %+v, want %+v", product, want)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"Pokemonscraper/internal/logctx"
+)
+
+// parseIPNet parses an IP or a CIDR, a single IP covers only itself
+func parseIPNet(entry string) (*net.IPNet, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP or CIDR", entry)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP or CIDR", entry)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// isTrustedProxy reports whether ip is in one of the trusted networks
+func isTrustedProxy(trusted []*net.IPNet, ip net.IP) bool {
+	for _, network := range trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// withClientIP stores the client's IP in the request context for
+// logctx.Printf. It is the direct peer, unless the peer is a trusted
+// proxy: then it is the last X-Forwarded-For entry that isn't a trusted
+// proxy, as each proxy appends the address it got the request from, or
+// X-Real-IP. The headers of untrusted peers are ignored, anyone can send
+// them.
+func withClientIP(trusted []*net.IPNet, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		client := net.ParseIP(host)
+		if client != nil && isTrustedProxy(trusted, client) {
+			client = forwardedClient(trusted, r.Header, client)
+		}
+
+		if client != nil {
+			r = r.WithContext(logctx.WithClientIP(r.Context(), client.String()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClient returns the client a trusted proxy forwarded the request
+// for, or the proxy itself when its headers don't name one
+func forwardedClient(trusted []*net.IPNet, header http.Header, proxy net.IP) net.IP {
+	var hops []string
+	for _, value := range header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	var leftmost net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			// a proxy we trust wouldn't write garbage, what is left of it
+			// came from the client
+			break
+		}
+		if !isTrustedProxy(trusted, ip) {
+			return ip
+		}
+		leftmost = ip
+	}
+	if leftmost != nil {
+		return leftmost
+	}
+	if ip := net.ParseIP(strings.TrimSpace(header.Get("X-Real-IP"))); ip != nil {
+		return ip
+	}
+	return proxy
+}
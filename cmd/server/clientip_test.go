@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"Pokemonscraper/internal/logctx"
+)
+
+func TestWithClientIP(t *testing.T) {
+	var trusted []*net.IPNet
+	for _, entry := range []string{"10.0.0.0/8", "127.0.0.1"} {
+		network, err := parseIPNet(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		trusted = append(trusted, network)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string // X-Forwarded-For headers
+		realIP     string
+		want       string
+	}{
+		{"untrusted peer", "203.0.113.5:4000", nil, "", "203.0.113.5"},
+		{"untrusted peer's headers are ignored", "203.0.113.5:4000", []string{"198.51.100.7"}, "198.51.100.8", "203.0.113.5"},
+		{"trusted peer", "10.0.0.1:4000", []string{"198.51.100.7"}, "", "198.51.100.7"},
+		{"trusted peer without headers", "127.0.0.1:4000", nil, "", "127.0.0.1"},
+		{"multi-hop", "10.0.0.1:4000", []string{"198.51.100.7, 10.0.0.2"}, "", "198.51.100.7"},
+		{"multi-hop over several headers", "10.0.0.1:4000", []string{"198.51.100.7", "10.0.0.3, 10.0.0.2"}, "", "198.51.100.7"},
+		// the client can write anything left of what the first proxy appended
+		{"spoofed leftmost entry", "10.0.0.1:4000", []string{"6.6.6.6, 198.51.100.7, 10.0.0.2"}, "", "198.51.100.7"},
+		{"spoofed trusted entry", "10.0.0.1:4000", []string{"10.9.9.9, 198.51.100.7"}, "", "198.51.100.7"},
+		{"only trusted hops", "10.0.0.1:4000", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"garbage stops at the last trusted hop", "10.0.0.1:4000", []string{"198.51.100.7, garbage, 10.0.0.2"}, "", "10.0.0.2"},
+		{"garbage only falls back to X-Real-IP", "10.0.0.1:4000", []string{"unknown"}, "198.51.100.9", "198.51.100.9"},
+		{"X-Real-IP fallback", "10.0.0.1:4000", nil, " 198.51.100.9 ", "198.51.100.9"},
+		{"garbage X-Real-IP", "10.0.0.1:4000", nil, "nope", "10.0.0.1"},
+		{"IPv6 peer", "[2001:db8::1]:4000", []string{"198.51.100.7"}, "", "2001:db8::1"},
+		{"peer without a port", "10.0.0.1", []string{"198.51.100.7"}, "", "198.51.100.7"},
+	}
+	for _, test := range tests {
+		var got string
+		handler := withClientIP(trusted, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = logctx.ClientIP(r.Context())
+		}))
+
+		r := httptest.NewRequest("GET", "/api/cards", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, value := range test.forwarded {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+
+		if got != test.want {
+			t.Errorf("%s: client IP = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseIPNet(t *testing.T) {
+	single, err := parseIPNet(" 127.0.0.1 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !single.Contains(net.ParseIP("127.0.0.1")) || single.Contains(net.ParseIP("127.0.0.2")) {
+		t.Errorf("127.0.0.1 parsed as %s, want only itself", single)
+	}
+	if _, err := parseIPNet("10.0.0.0/33"); err == nil {
+		t.Error("parseIPNet accepted 10.0.0.0/33")
+	}
+	if _, err := parseIPNet("proxy.local"); err == nil {
+		t.Error("parseIPNet accepted a host name")
+	}
+}
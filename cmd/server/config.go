@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"Pokemonscraper/internal/config"
+	"Pokemonscraper/internal/normalize"
+	"Pokemonscraper/internal/store"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Config holds every tunable of the API server. LoadConfig reads it once at
+// startup, the comments name the environment variable behind each field.
+type Config struct {
+	Database store.DatabaseConfig
+
+	// HTTP server
+	ListenAddr     string // LISTEN_ADDR and PORT joined by listenAddress
+	APIKey         string // API_KEY, protected endpoints are disabled without it
+	ImportMaxItems int    // IMPORT_MAX_ITEMS
+	MinSources     int    // MIN_SOURCES, the default of /api/cards?min_sources=
+
+	// TRUSTED_PROXIES, comma-separated IPs or CIDRs of the reverse proxies
+	// whose X-Forwarded-For and X-Real-IP headers are believed
+	TrustedProxies []*net.IPNet
+
+	CardsCacheMaxAge time.Duration // CARDS_CACHE_MAX_AGE, Cache-Control max-age of /api/cards and its in-memory cache
+	WarmCache        bool          // WARM_CACHE, load the card list into the cache at startup
+	// DB_ACQUIRE_TIMEOUT is how long an API request waits for a connection
+	// of an exhausted pool before it gets a 503, 0 waits as long as it takes
+	DBAcquireTimeout time.Duration
+
+	IdempotencyKeyTTL  time.Duration // IDEMPOTENCY_KEY_TTL, how long Idempotency-Key responses are replayed
+	IdempotencyMaxKeys int           // IDEMPOTENCY_MAX_KEYS, most Idempotency-Key responses kept
+	WSCompression      bool          // WS_COMPRESSION, permessage-deflate on /ws
+	LongPollTimeout    time.Duration // LONG_POLL_TIMEOUT, longest wait of /api/cards/updates
+
+	// Scheduling
+	ScrapeCron      string        // SCRAPE_CRON, replaces ScrapeInterval when set
+	ScrapeSchedule  cron.Schedule // ScrapeCron parsed, nil without it
+	ScrapeInterval  time.Duration // SCRAPE_INTERVAL
+	ScrapeTick      time.Duration // SCRAPE_TICK, how often due cards are checked
+	PruneStaleCards bool          // PRUNE_STALE_CARDS
+	// DISABLE_SCHEDULER skips the initial and scheduled scrapes, for
+	// instances that only serve the API while another process scrapes.
+	// DISABLE_MANUAL_SCRAPE turns off POST /api/scrape as well.
+	DisableScheduler    bool
+	DisableManualScrape bool
+	StaleCardAge        time.Duration // STALE_CARD_AGE
+	PruneInterval       time.Duration // PRUNE_INTERVAL
+	PruneRemove         bool          // PRUNE_MODE=delete, mark otherwise
+
+	// Sources
+	JSONSourceURL            string            // JSON_SOURCE_URL
+	JSONSourceName           string            // JSON_SOURCE_NAME
+	JSONSourceRegion         string            // JSON_SOURCE_REGION
+	PriceChartingProductURLs []string          // PRICECHARTING_PRODUCT_URLS
+	ScrapeTCGPlayer          bool              // SCRAPE_TCGPLAYER
+	ScrapePriceCharting      bool              // SCRAPE_PRICECHARTING
+	ScrapeSealed             bool              // SCRAPE_SEALED
+	SealedQueries            []string          // SEALED_QUERIES
+	SourceFetchers           map[string]string // SOURCE_FETCHERS, source name to fetcher
+	HeadlessTimeout          time.Duration     // HEADLESS_TIMEOUT, per page load of the chromedp fetcher
+	HeadlessWaitSelector     string            // HEADLESS_WAIT_SELECTOR, read the HTML once it is visible
+	AcceptLanguage           string            // ACCEPT_LANGUAGE
+	SourceFailureThreshold   int               // SOURCE_FAILURE_THRESHOLD
+	SourceCooldown           time.Duration     // SOURCE_COOLDOWN
+	SourceTimeout            time.Duration     // SOURCE_TIMEOUT, longest a source may take in a scrape
+	PageHashMaxAge           time.Duration     // PAGE_HASH_MAX_AGE
+	StoreRawHTML             bool              // STORE_RAW_HTML, keep a gzipped copy of every scraped page
+	SnapshotRetention        time.Duration     // SNAPSHOT_RETENTION, how long the copies are kept
+	NotableMovePercent       float64           // NOTABLE_MOVE_PERCENT, price moves reported in a scrape's diff
+	MinCardsPercent          float64           // MIN_CARDS_PERCENT, of a source's last good card count
+	SourcePriority           []string          // SOURCE_PRIORITY
+	// PRICE_COLUMN_HEADERS adds header words to priceColumnHeaders as
+	// "Header=type;Header=type". PriceColumnHeaders holds both.
+	PriceColumnHeaders map[string]string
+
+	// SOURCE_TIMEOUTS overrides SOURCE_TIMEOUT for some sources, as
+	// comma-separated source=duration pairs
+	SourceTimeouts map[string]time.Duration
+
+	// PRICE_PRECISION, SET_NAME_ALIASES and DEFAULT_CONDITION
+	Normalize normalize.Config
+
+	// GENERIC_SOURCES is a JSON file of specs of table-based sites
+	GenericSources []GenericSourceSpec
+
+	// CARD_IMAGES is a JSON file mapping Pokémon names to an emoji or an
+	// image URL, on top of the built-in emojis. CardImages is its content.
+	CardImagesFile string
+	CardImages     map[string]string
+
+	// Notifications
+	WebhookURL    string // WEBHOOK_URL
+	WebhookSecret string // WEBHOOK_SECRET
+
+	// Exchange rates
+	ExchangeRatesURL string        // EXCHANGE_RATES_URL
+	ExchangeRatesTTL time.Duration // EXCHANGE_RATES_TTL
+}
+
+// LoadConfig reads and validates the configuration from the environment.
+// Every invalid setting is reported in the returned error, not just the
+// first.
+func LoadConfig() (*Config, error) {
+	env := &config.Reader{}
+	cfg := &Config{
+		Database:  store.ReadDatabaseConfig(env),
+		Normalize: normalize.ReadConfig(env),
+
+		APIKey:         os.Getenv("API_KEY"),
+		ImportMaxItems: env.Int("IMPORT_MAX_ITEMS", 1000, 1),
+		MinSources:     env.Int("MIN_SOURCES", 1, 1),
+
+		CardsCacheMaxAge: env.Duration("CARDS_CACHE_MAX_AGE", "60s", 0),
+		WarmCache:        env.Bool("WARM_CACHE", true),
+		DBAcquireTimeout: env.Duration("DB_ACQUIRE_TIMEOUT", "2s", 0),
+
+		IdempotencyKeyTTL:  env.Duration("IDEMPOTENCY_KEY_TTL", "24h", time.Minute),
+		IdempotencyMaxKeys: env.Int("IDEMPOTENCY_MAX_KEYS", 10000, 1),
+		WSCompression:      env.Bool("WS_COMPRESSION", true),
+		LongPollTimeout:    env.Duration("LONG_POLL_TIMEOUT", "30s", time.Second),
+
+		ScrapeCron:      os.Getenv("SCRAPE_CRON"),
+		ScrapeInterval:  env.Duration("SCRAPE_INTERVAL", "30m", time.Minute),
+		ScrapeTick:      env.Duration("SCRAPE_TICK", "1m", time.Second),
+		PruneStaleCards: env.Bool("PRUNE_STALE_CARDS", false),
+
+		DisableScheduler:    env.Bool("DISABLE_SCHEDULER", false),
+		DisableManualScrape: env.Bool("DISABLE_MANUAL_SCRAPE", false),
+		StaleCardAge:        env.Duration("STALE_CARD_AGE", "168h", time.Minute),
+		PruneInterval:       env.Duration("PRUNE_INTERVAL", "1h", time.Minute),
+
+		JSONSourceURL:            os.Getenv("JSON_SOURCE_URL"),
+		JSONSourceName:           config.Get("JSON_SOURCE_NAME", "PriceCharting"),
+		JSONSourceRegion:         os.Getenv("JSON_SOURCE_REGION"),
+		PriceChartingProductURLs: config.SplitList(os.Getenv("PRICECHARTING_PRODUCT_URLS")),
+		ScrapeTCGPlayer:          env.Bool("SCRAPE_TCGPLAYER", false),
+		ScrapePriceCharting:      env.Bool("SCRAPE_PRICECHARTING", false),
+		ScrapeSealed:             env.Bool("SCRAPE_SEALED", false),
+		SealedQueries:            config.SplitList(config.Get("SEALED_QUERIES", "booster box,elite trainer box,booster bundle,ultra premium collection")),
+		SourceFetchers:           make(map[string]string),
+		HeadlessTimeout:          env.Duration("HEADLESS_TIMEOUT", "30s", time.Second),
+		HeadlessWaitSelector:     config.Get("HEADLESS_WAIT_SELECTOR", "body"),
+		AcceptLanguage:           os.Getenv("ACCEPT_LANGUAGE"),
+		SourceFailureThreshold:   env.Int("SOURCE_FAILURE_THRESHOLD", 3, 1),
+		SourceCooldown:           env.Duration("SOURCE_COOLDOWN", "1h", time.Second),
+		SourceTimeout:            env.Duration("SOURCE_TIMEOUT", "10m", time.Second),
+		SourceTimeouts:           make(map[string]time.Duration),
+		PageHashMaxAge:           env.Duration("PAGE_HASH_MAX_AGE", "24h", 0),
+		StoreRawHTML:             env.Bool("STORE_RAW_HTML", false),
+		SnapshotRetention:        env.Duration("SNAPSHOT_RETENTION", "720h", time.Hour),
+		NotableMovePercent:       env.Float("NOTABLE_MOVE_PERCENT", 10, 0),
+		MinCardsPercent:          env.Float("MIN_CARDS_PERCENT", 50, 0),
+		SourcePriority:           config.SplitList(config.Get("SOURCE_PRIORITY", "TCGPlayer,PriceCharting,eBay")),
+		PriceColumnHeaders:       maps.Clone(priceColumnHeaders),
+
+		WebhookURL:    os.Getenv("WEBHOOK_URL"),
+		WebhookSecret: os.Getenv("WEBHOOK_SECRET"),
+
+		ExchangeRatesURL: config.Get("EXCHANGE_RATES_URL", "https://open.er-api.com/v6/latest/USD"),
+		ExchangeRatesTTL: env.Duration("EXCHANGE_RATES_TTL", "12h", time.Minute),
+	}
+
+	addr, err := listenAddress(os.Getenv("LISTEN_ADDR"), config.Get("PORT", "8080"))
+	if err != nil {
+		env.Fail("PORT/LISTEN_ADDR", err)
+	}
+	cfg.ListenAddr = addr
+
+	for _, entry := range config.SplitList(os.Getenv("TRUSTED_PROXIES")) {
+		network, err := parseIPNet(entry)
+		if err != nil {
+			env.Fail("TRUSTED_PROXIES", err)
+			continue
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, network)
+	}
+
+	if cfg.ScrapeCron != "" {
+		if cfg.ScrapeSchedule, err = cron.ParseStandard(cfg.ScrapeCron); err != nil {
+			env.Fail("SCRAPE_CRON", err)
+		}
+	}
+
+	switch mode := config.Get("PRUNE_MODE", "mark"); mode {
+	case "mark":
+	case "delete":
+		cfg.PruneRemove = true
+	default:
+		env.Fail("PRUNE_MODE", fmt.Errorf("%q is not mark or delete", mode))
+	}
+
+	if cfg.JSONSourceURL != "" {
+		if u, err := url.Parse(cfg.JSONSourceURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			env.Fail("JSON_SOURCE_URL", fmt.Errorf("%q is not an http(s) URL", cfg.JSONSourceURL))
+		}
+	}
+
+	if path := os.Getenv("GENERIC_SOURCES"); path != "" {
+		if cfg.GenericSources, err = loadGenericSources(path); err != nil {
+			env.Fail("GENERIC_SOURCES", err)
+		}
+	}
+
+	if cfg.CardImagesFile = os.Getenv("CARD_IMAGES"); cfg.CardImagesFile != "" {
+		if cfg.CardImages, err = store.LoadCardImages(cfg.CardImagesFile); err != nil {
+			env.Fail("CARD_IMAGES", err)
+		}
+	}
+
+	for _, entry := range config.SplitList(os.Getenv("SOURCE_FETCHERS")) {
+		name, fetcher, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			env.Fail("SOURCE_FETCHERS", fmt.Errorf("%q is not source=fetcher", entry))
+			continue
+		}
+		fetcher = strings.ToLower(strings.TrimSpace(fetcher))
+		if _, ok := fetchers[fetcher]; !ok {
+			env.Fail("SOURCE_FETCHERS", fmt.Errorf("fetcher %q is not available in this build", fetcher))
+			continue
+		}
+		cfg.SourceFetchers[strings.ToLower(strings.TrimSpace(name))] = fetcher
+	}
+
+	for _, entry := range strings.Split(os.Getenv("PRICE_COLUMN_HEADERS"), ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		header, priceType, ok := strings.Cut(entry, "=")
+		header = strings.ToLower(strings.Join(strings.Fields(header), " "))
+		priceType = strings.ToLower(strings.TrimSpace(priceType))
+		switch {
+		case !ok || header == "":
+			env.Fail("PRICE_COLUMN_HEADERS", fmt.Errorf("%q is not header=type", entry))
+		case priceType == store.PriceTypeLoose, priceType == store.PriceTypeComplete, priceType == store.PriceTypeNew, priceType == store.PriceTypeGraded:
+			cfg.PriceColumnHeaders[header] = priceType
+		default:
+			env.Fail("PRICE_COLUMN_HEADERS", fmt.Errorf("type %q of %q is not loose, complete, new or graded", priceType, entry))
+		}
+	}
+
+	for _, entry := range config.SplitList(os.Getenv("SOURCE_TIMEOUTS")) {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			env.Fail("SOURCE_TIMEOUTS", fmt.Errorf("%q is not source=duration", entry))
+			continue
+		}
+		timeout, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || timeout < time.Second {
+			env.Fail("SOURCE_TIMEOUTS", fmt.Errorf("%q is not a duration of at least 1s", value))
+			continue
+		}
+		cfg.SourceTimeouts[strings.ToLower(strings.TrimSpace(name))] = timeout
+	}
+
+	if err := env.Err(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// listenAddress joins the LISTEN_ADDR host and the port into the address to
+// bind. An empty host binds all interfaces.
+func listenAddress(host, port string) (string, error) {
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("port %q is not a number between 1 and 65535", port)
+	}
+
+	host = strings.Trim(host, "[]")
+	if host != "" && net.ParseIP(host) == nil {
+		if _, err := net.LookupHost(host); err != nil {
+			return "", fmt.Errorf("host %q is not an IP address or resolvable name: %v", host, err)
+		}
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
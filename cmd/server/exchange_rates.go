@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"Pokemonscraper/internal/logctx"
+	"Pokemonscraper/internal/normalize"
+	"Pokemonscraper/internal/store"
+)
+
+// ExchangeRates caches exchange rates fetched from EXCHANGE_RATES_URL. The
+// endpoint must return {"rates": {"EUR": 0.92, ...}} relative to USD.
+type ExchangeRates struct {
+	url       string
+	ttl       time.Duration
+	client    *http.Client
+	mutex     sync.Mutex
+	rates     map[string]float64
+	fetchedAt time.Time
+
+	// failedAt and lastErr are the last failed fetch, no other one is
+	// tried until exchangeRatesRetryAfter has passed
+	failedAt time.Time
+	lastErr  error
+	// fetching is closed once the fetch in progress is done, nil while
+	// there is none
+	fetching chan struct{}
+}
+
+// exchangeRatesRetryAfter is how long after a failed fetch the rates are
+// fetched again
+const exchangeRatesRetryAfter = time.Minute
+
+var errUnknownCurrency = errors.New("unknown currency")
+
+func NewExchangeRates(cfg *Config) *ExchangeRates {
+	return &ExchangeRates{
+		url:    cfg.ExchangeRatesURL,
+		ttl:    cfg.ExchangeRatesTTL,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Rates returns the cached rates, refreshing them once they are older than
+// the TTL. Stale rates are kept if the refresh fails, and while another
+// caller refreshes them. Callers without any rates wait for that refresh.
+func (er *ExchangeRates) Rates() (map[string]float64, time.Time, error) {
+	er.mutex.Lock()
+	for {
+		fresh := er.rates != nil && time.Since(er.fetchedAt) < er.ttl
+		backingOff := time.Since(er.failedAt) < exchangeRatesRetryAfter
+		if fresh || backingOff || (er.fetching != nil && er.rates != nil) {
+			defer er.mutex.Unlock()
+			return er.cached()
+		}
+		if er.fetching == nil {
+			break
+		}
+		fetching := er.fetching
+		er.mutex.Unlock()
+		<-fetching
+		er.mutex.Lock()
+	}
+	fetching := make(chan struct{})
+	er.fetching = fetching
+	er.mutex.Unlock()
+
+	// the fetch may take the client's whole timeout, the lock isn't held
+	// meanwhile
+	rates, err := er.fetch()
+
+	er.mutex.Lock()
+	defer er.mutex.Unlock()
+	er.fetching = nil
+	close(fetching)
+	if err != nil {
+		er.failedAt, er.lastErr = time.Now(), err
+		if er.rates != nil {
+			log.Printf("Error refreshing exchange rates, using rates from %s: %v", er.fetchedAt.Format(time.RFC3339), err)
+		}
+		return er.cached()
+	}
+
+	er.rates = rates
+	er.fetchedAt = time.Now()
+	er.failedAt, er.lastErr = time.Time{}, nil
+	log.Printf("Fetched %d exchange rates", len(rates))
+	return er.rates, er.fetchedAt, nil
+}
+
+// cached returns the rates there are, or the error of the last fetch when
+// there are none. The caller holds er.mutex.
+func (er *ExchangeRates) cached() (map[string]float64, time.Time, error) {
+	if er.rates != nil {
+		return er.rates, er.fetchedAt, nil
+	}
+	return nil, time.Time{}, er.lastErr
+}
+
+func (er *ExchangeRates) fetch() (map[string]float64, error) {
+	resp, err := er.client.Get(er.url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch exchange rates: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("exchange rates endpoint returned %s", resp.Status)
+	}
+
+	var body struct {
+		Rates map[string]float64 `json:"rates"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode exchange rates: %v", err)
+	}
+	if len(body.Rates) == 0 {
+		return nil, fmt.Errorf("exchange rates endpoint returned no rates")
+	}
+
+	body.Rates["USD"] = 1
+	return body.Rates, nil
+}
+
+// Convert converts amount between two currency codes, returning the
+// converted amount and the rate used
+func (er *ExchangeRates) Convert(amount float64, from, to string) (float64, float64, error) {
+	rates, _, err := er.Rates()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	fromRate, ok := rates[from]
+	if !ok || fromRate <= 0 {
+		return 0, 0, fmt.Errorf("%w: %s", errUnknownCurrency, from)
+	}
+	toRate, ok := rates[to]
+	if !ok || toRate <= 0 {
+		return 0, 0, fmt.Errorf("%w: %s", errUnknownCurrency, to)
+	}
+
+	rate := toRate / fromRate
+	return amount * rate, rate, nil
+}
+
+// applyCurrencies fills in each card's Prices in the currencies, converted
+// from USD with the cached rates. Currencies without a rate, or all of them
+// when the rates can't be fetched, keep the USD price and are listed in
+// EstimatedCurrencies.
+func applyCurrencies(ctx context.Context, cards []store.Card, currencies []string, rates *ExchangeRates) {
+	rateTable, _, err := rates.Rates()
+	if err != nil {
+		logctx.Printf(ctx, "Exchange rates unavailable, using USD prices for %v: %v", currencies, err)
+	}
+
+	converted := make(map[string]float64)
+	var estimated []string
+	for _, currency := range currencies {
+		if rate, ok := rateTable[currency]; ok && rate > 0 {
+			converted[currency] = rate
+		} else {
+			estimated = append(estimated, currency)
+		}
+	}
+
+	for i := range cards {
+		cards[i].Prices = make(map[string]float64, len(currencies))
+		for _, currency := range currencies {
+			if rate, ok := converted[currency]; ok {
+				cards[i].Prices[currency] = normalize.RoundPrice(cards[i].Price*rate, currency)
+			} else {
+				cards[i].Prices[currency] = normalize.RoundPrice(cards[i].Price, "USD")
+			}
+		}
+		cards[i].EstimatedCurrencies = estimated
+	}
+}
+
+// usdRates returns the cached exchange rates that GetCardsForFrontend and
+// GetSetValue convert prices to USD with. When there are none, only USD
+// prices are used.
+func usdRates(ctx context.Context, rates *ExchangeRates) map[string]float64 {
+	rateTable, _, err := rates.Rates()
+	if err != nil {
+		logctx.Printf(ctx, "Exchange rates unavailable, leaving prices in other currencies out: %v", err)
+	}
+	return rateTable
+}
+
+// applySourcePriority replaces each card's average price with the price of
+// the first source in priority it has. Cards with none of them keep the
+// average.
+func applySourcePriority(cards []store.Card, priority []string) {
+	for i := range cards {
+		if sourcePrice, ok := prioritizedPrice(cards[i].Sources, priority); ok {
+			cards[i].Price = sourcePrice.Price
+			cards[i].Source = sourcePrice.Source
+		}
+	}
+}
+
+func prioritizedPrice(prices []store.SourcePrice, priority []string) (store.SourcePrice, bool) {
+	for _, source := range priority {
+		for _, sourcePrice := range prices {
+			if strings.EqualFold(sourcePrice.Source, source) {
+				return sourcePrice, true
+			}
+		}
+	}
+	return store.SourcePrice{}, false
+}
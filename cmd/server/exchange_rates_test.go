@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestExchangeRates(t *testing.T, handler http.HandlerFunc) *ExchangeRates {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return NewExchangeRates(&Config{ExchangeRatesURL: server.URL, ExchangeRatesTTL: time.Hour})
+}
+
+func TestExchangeRatesBackOffAfterFailure(t *testing.T) {
+	var hits atomic.Int32
+	rates := newTestExchangeRates(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "down", http.StatusBadGateway)
+	})
+
+	for i := 0; i < 3; i++ {
+		if _, _, err := rates.Rates(); err == nil {
+			t.Fatalf("call %d: Rates succeeded against a failing endpoint", i)
+		}
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("endpoint was hit %d times, want 1 until the back-off passes", got)
+	}
+
+	rates.failedAt = time.Now().Add(-exchangeRatesRetryAfter)
+	rates.Rates()
+	if got := hits.Load(); got != 2 {
+		t.Errorf("endpoint was hit %d times after the back-off, want 2", got)
+	}
+}
+
+func TestExchangeRatesKeepStaleRatesOnFailure(t *testing.T) {
+	var fail atomic.Bool
+	rates := newTestExchangeRates(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, `{"rates": {"EUR": 0.5}}`)
+	})
+
+	if _, _, err := rates.Rates(); err != nil {
+		t.Fatal(err)
+	}
+	fail.Store(true)
+	rates.fetchedAt = time.Now().Add(-2 * time.Hour)
+
+	table, _, err := rates.Rates()
+	if err != nil {
+		t.Fatalf("Rates error = %v, want the stale rates", err)
+	}
+	if table["EUR"] != 0.5 {
+		t.Errorf("EUR = %v, want the stale 0.5", table["EUR"])
+	}
+}
+
+func TestExchangeRatesFetchOutsideLock(t *testing.T) {
+	release := make(chan struct{})
+	var hits atomic.Int32
+	rates := newTestExchangeRates(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		<-release
+		fmt.Fprint(w, `{"rates": {"EUR": 0.5}}`)
+	})
+	rates.rates = map[string]float64{"USD": 1, "EUR": 0.4}
+	rates.fetchedAt = time.Now().Add(-2 * time.Hour)
+
+	// the first caller refreshes, the others get the stale rates without
+	// waiting for it
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		rates.Rates()
+	}()
+	for hits.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan float64)
+	go func() {
+		table, _, _ := rates.Rates()
+		done <- table["EUR"]
+	}()
+	select {
+	case eur := <-done:
+		if eur != 0.4 {
+			t.Errorf("EUR during the refresh = %v, want the stale 0.4", eur)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Rates blocked on the refresh in progress")
+	}
+
+	close(release)
+	wg.Wait()
+	if table, _, _ := rates.Rates(); table["EUR"] != 0.5 {
+		t.Errorf("EUR after the refresh = %v, want 0.5", table["EUR"])
+	}
+	if got := hits.Load(); got != 1 {
+		t.Errorf("endpoint was hit %d times, want 1", got)
+	}
+}
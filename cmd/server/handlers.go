@@ -0,0 +1,948 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"Pokemonscraper/internal/config"
+	"Pokemonscraper/internal/logctx"
+	"Pokemonscraper/internal/normalize"
+	"Pokemonscraper/internal/store"
+
+	"github.com/gorilla/mux"
+)
+
+// maxResponseCurrencies caps the ?currencies= list of /api/cards
+const maxResponseCurrencies = 10
+
+// handleGetCards lists the cards, ?price=priority picks each card's price
+// from the first source in SOURCE_PRIORITY that has one and ?currencies=
+// adds it in other currencies
+func (db *Database) handleGetCards(cfg *Config, rates *ExchangeRates, cache *cardsCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := store.CardFilter{
+			Condition:   strings.TrimSpace(query.Get("condition")),
+			ProductType: strings.ToLower(strings.TrimSpace(query.Get("type"))),
+			MinSources:  cfg.MinSources,
+		}
+		if filter.ProductType != "" && filter.ProductType != store.ProductTypeSingle && filter.ProductType != store.ProductTypeSealed {
+			http.Error(w, "type must be single or sealed", http.StatusBadRequest)
+			return
+		}
+
+		if value := query.Get("include_stale"); value != "" {
+			includeStale, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "include_stale must be true or false", http.StatusBadRequest)
+				return
+			}
+			filter.IncludeStale = includeStale
+		}
+
+		if value := query.Get("include_unpriced"); value != "" {
+			includeUnpriced, err := strconv.ParseBool(value)
+			if err != nil {
+				http.Error(w, "include_unpriced must be true or false", http.StatusBadRequest)
+				return
+			}
+			filter.IncludeUnpriced = includeUnpriced
+		}
+
+		if value := query.Get("min_sources"); value != "" {
+			minSources, err := strconv.Atoi(value)
+			if err != nil || minSources < 1 {
+				http.Error(w, "min_sources must be a positive number", http.StatusBadRequest)
+				return
+			}
+			filter.MinSources = minSources
+		}
+
+		for _, bound := range []struct {
+			name  string
+			value *float64
+		}{{"price_min", &filter.PriceMin}, {"price_max", &filter.PriceMax}} {
+			value := query.Get(bound.name)
+			if value == "" {
+				continue
+			}
+			price, err := strconv.ParseFloat(value, 64)
+			if err != nil || price <= 0 || math.IsNaN(price) || math.IsInf(price, 0) {
+				http.Error(w, bound.name+" must be a positive number", http.StatusBadRequest)
+				return
+			}
+			*bound.value = price
+		}
+		if filter.PriceMin > 0 && filter.PriceMax > 0 && filter.PriceMin > filter.PriceMax {
+			http.Error(w, "price_min must not be greater than price_max", http.StatusBadRequest)
+			return
+		}
+
+		priceMode := query.Get("price")
+		if priceMode != "" && priceMode != "avg" && priceMode != "priority" {
+			http.Error(w, "price must be avg or priority", http.StatusBadRequest)
+			return
+		}
+
+		var currencies []string
+		for _, currency := range config.SplitList(query.Get("currencies")) {
+			currency = strings.ToUpper(currency)
+			if !normalize.CurrencyCodePattern.MatchString(currency) {
+				http.Error(w, fmt.Sprintf("currency %q is not a 3-letter code", currency), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(currencies, currency) {
+				currencies = append(currencies, currency)
+			}
+		}
+		if len(currencies) > maxResponseCurrencies {
+			http.Error(w, fmt.Sprintf("at most %d currencies can be requested", maxResponseCurrencies), http.StatusBadRequest)
+			return
+		}
+
+		// the unfiltered list is what scrapes broadcast, it may be cached
+		var cards []store.Card
+		cached := false
+		if reflect.DeepEqual(filter, store.CardFilter{MinSources: cfg.MinSources}) {
+			cards, cached = cache.Get()
+		}
+		if !cached {
+			var err error
+			filter.Rates = usdRates(r.Context(), rates)
+			cards, err = db.GetCardsForFrontend(r.Context(), filter)
+			if err != nil {
+				logctx.Printf(r.Context(), "Error getting cards: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		if priceMode == "priority" {
+			applySourcePriority(cards, cfg.SourcePriority)
+		}
+		if len(currencies) > 0 {
+			applyCurrencies(r.Context(), cards, currencies, rates)
+		}
+
+		body, err := json.Marshal(cards)
+		if err != nil {
+			logctx.Printf(r.Context(), "Error encoding cards response: %v", err)
+			http.Error(w, "Error encoding response", http.StatusInternalServerError)
+			return
+		}
+		body = append(body, '\n')
+
+		// The ETag is the hash of the body, so it changes with every scrape
+		// that changes a price and with the query
+		sum := sha256.Sum256(body)
+		etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(cfg.CardsCacheMaxAge.Seconds())))
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
+
+// etagMatches reports whether an If-None-Match header lists etag. Weak
+// validators match too, as If-None-Match compares weakly.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func handleRescrapeCard(scraper *Scraper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cardID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil || cardID < 1 {
+			http.Error(w, "invalid card id", http.StatusBadRequest)
+			return
+		}
+
+		card, err := scraper.RescrapeCard(r.Context(), cardID)
+		switch {
+		case errors.Is(err, store.ErrCardNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, errScrapeInProgress):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			logctx.Printf(r.Context(), "Error rescraping card %d: %v", cardID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(card)
+	}
+}
+
+// maxSourceLength is the length of the prices.source column
+const maxSourceLength = 255
+
+// parseDateBound parses a ?date= that is a day (2024-05-01), which includes
+// the whole day, or an RFC 3339 time. It returns the first time after it.
+func parseDateBound(value string) (time.Time, bool) {
+	if day, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return day.AddDate(0, 0, 1), true
+	}
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		// scraped_at has microsecond precision
+		return at.Add(time.Microsecond), true
+	}
+	return time.Time{}, false
+}
+
+// handleGetSnapshot serves the raw page ?url= as it was scraped on or
+// before ?date=, the latest one without it. The page keeps the content type
+// it was scraped with, sandboxed so its scripts don't run on the API's
+// origin.
+func (db *Database) handleGetSnapshot(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	pageURL := strings.TrimSpace(query.Get("url"))
+	if pageURL == "" {
+		http.Error(w, "url is required", http.StatusBadRequest)
+		return
+	}
+
+	before := time.Now().Add(time.Microsecond)
+	if dateValue := strings.TrimSpace(query.Get("date")); dateValue != "" {
+		var ok bool
+		if before, ok = parseDateBound(dateValue); !ok {
+			http.Error(w, "date must be a day like 2024-05-01 or an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	snapshot, err := db.Snapshot(r.Context(), pageURL, before)
+	switch {
+	case errors.Is(err, store.ErrSnapshotNotFound):
+		http.Error(w, fmt.Sprintf("no snapshot of %s", pageURL), http.StatusNotFound)
+		return
+	case err != nil:
+		logctx.Printf(r.Context(), "Error getting snapshot of %s: %v", pageURL, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := snapshot.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Last-Modified", snapshot.ScrapedAt.UTC().Format(http.TimeFormat))
+	w.Write(snapshot.Body)
+}
+
+// handleGetPriceAt returns a card's price from ?source= as it was on ?date=:
+// the last one scraped on or before it. The date is a day (2024-05-01),
+// which includes the whole day, or an RFC 3339 time.
+func (db *Database) handleGetPriceAt(w http.ResponseWriter, r *http.Request) {
+	cardID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || cardID < 1 {
+		http.Error(w, "invalid card id", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	source := strings.TrimSpace(query.Get("source"))
+	if source == "" || len(source) > maxSourceLength {
+		http.Error(w, "source is required and at most 255 characters", http.StatusBadRequest)
+		return
+	}
+
+	dateValue := strings.TrimSpace(query.Get("date"))
+	before, ok := parseDateBound(dateValue)
+	if !ok {
+		http.Error(w, "date must be a day like 2024-05-01 or an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+
+	price, err := db.PriceBefore(r.Context(), cardID, source, before)
+	switch {
+	case errors.Is(err, store.ErrCardNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, store.ErrPriceNotFound):
+		http.Error(w, fmt.Sprintf("no %s price on or before %s", source, dateValue), http.StatusNotFound)
+		return
+	case err != nil:
+		logctx.Printf(r.Context(), "Error getting price of card %d: %v", cardID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(price)
+}
+
+// handleGetSetValue returns what completing a set costs. Set name variants
+// in SET_NAME_ALIASES resolve to their set, ?top= sets how many of the
+// priciest cards are listed (10, at most 100). Prices in other currencies
+// are valued in USD.
+func (db *Database) handleGetSetValue(rates *ExchangeRates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setName := strings.Join(strings.Fields(mux.Vars(r)["name"]), " ")
+		if canonical, ok := normalize.CanonicalSetName(setName); ok {
+			setName = canonical
+		}
+
+		top := 10
+		if value := r.URL.Query().Get("top"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 100 {
+				http.Error(w, "top must be a number between 1 and 100", http.StatusBadRequest)
+				return
+			}
+			top = n
+		}
+
+		value, err := db.GetSetValue(r.Context(), setName, top, usdRates(r.Context(), rates))
+		if errors.Is(err, store.ErrSetNotFound) {
+			http.Error(w, fmt.Sprintf("no cards in set %q", setName), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logctx.Printf(r.Context(), "Error getting value of set %s: %v", setName, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(value)
+	}
+}
+
+// handleGetArbitrage lists the cards whose sources disagree on the price by
+// more than ?min_diff_pct= percent (10) of the cheapest one, ?limit= of
+// them (50, at most 100). Prices in other currencies are compared in USD.
+func (db *Database) handleGetArbitrage(rates *ExchangeRates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		minPercent := 10.0
+		if value := query.Get("min_diff_pct"); value != "" {
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil || math.IsNaN(n) || math.IsInf(n, 0) || n < 0 {
+				http.Error(w, "min_diff_pct must be a number of at least 0", http.StatusBadRequest)
+				return
+			}
+			minPercent = n
+		}
+
+		limit := 50
+		if value := query.Get("limit"); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 100 {
+				http.Error(w, "limit must be a number between 1 and 100", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+
+		skipped := make(map[string]bool)
+		toUSD := func(amount float64, currency string) (float64, bool) {
+			converted, _, err := rates.Convert(amount, currency, "USD")
+			if err != nil {
+				if !skipped[currency] {
+					logctx.Printf(r.Context(), "Leaving %s prices out of the arbitrage: %v", currency, err)
+					skipped[currency] = true
+				}
+				return 0, false
+			}
+			return converted, true
+		}
+
+		arbitrage, err := db.GetArbitrage(r.Context(), minPercent, limit, toUSD)
+		if err != nil {
+			logctx.Printf(r.Context(), "Error getting arbitrage: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(arbitrage)
+	}
+}
+
+// MetricsRefreshStatus reports the progress of the last change metrics
+// refresh
+type MetricsRefreshStatus struct {
+	State      string     `json:"state"` // idle, running, done or failed
+	Step       string     `json:"step,omitempty"`
+	Rebuild    bool       `json:"rebuild"`
+	Cards      int        `json:"cards"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// metricsRefresher runs one change metrics refresh at a time in the
+// background and keeps its status for polling
+type metricsRefresher struct {
+	db     *Database
+	mu     sync.Mutex
+	status MetricsRefreshStatus
+}
+
+func newMetricsRefresher(db *Database) *metricsRefresher {
+	return &metricsRefresher{db: db, status: MetricsRefreshStatus{State: "idle"}}
+}
+
+func (m *metricsRefresher) Status() MetricsRefreshStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status
+}
+
+// Start begins a refresh unless one is already running. It returns the
+// status and whether a refresh was started.
+func (m *metricsRefresher) Start(rebuild bool) (MetricsRefreshStatus, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status.State == "running" {
+		return m.status, false
+	}
+
+	now := time.Now()
+	m.status = MetricsRefreshStatus{State: "running", Rebuild: rebuild, StartedAt: &now}
+	go m.run(rebuild)
+	return m.status, true
+}
+
+func (m *metricsRefresher) run(rebuild bool) {
+	cards, err := m.db.RefreshChangeMetrics(context.Background(), rebuild, func(step string) {
+		m.mu.Lock()
+		m.status.Step = step
+		m.mu.Unlock()
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.status.FinishedAt = &now
+	m.status.Step = ""
+	if err != nil {
+		log.Printf("Change metrics refresh failed: %v", err)
+		m.status.State = "failed"
+		m.status.Error = err.Error()
+		return
+	}
+	log.Printf("Change metrics refreshed for %d cards in %s", cards, now.Sub(*m.status.StartedAt))
+	m.status.State = "done"
+	m.status.Cards = cards
+}
+
+// handleRefreshMetrics starts a change metrics refresh, ?rebuild=true
+// recreates the view first. Progress is polled with GET on the same path.
+func handleRefreshMetrics(refresher *metricsRefresher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rebuild := false
+		if value := r.URL.Query().Get("rebuild"); value != "" {
+			var err error
+			if rebuild, err = strconv.ParseBool(value); err != nil {
+				http.Error(w, "rebuild must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+
+		status, started := refresher.Start(rebuild)
+		w.Header().Set("Content-Type", "application/json")
+		if started {
+			logctx.Printf(r.Context(), "Change metrics refresh started (rebuild: %t)", rebuild)
+			w.WriteHeader(http.StatusAccepted)
+		} else {
+			w.WriteHeader(http.StatusConflict)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// handleRebuildImages reloads the CARD_IMAGES file and re-applies the
+// mapping to the cards already in the database
+func (db *Database) handleRebuildImages(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var overrides map[string]string
+		if path != "" {
+			var err error
+			if overrides, err = store.LoadCardImages(path); err != nil {
+				logctx.Printf(r.Context(), "Error reloading CARD_IMAGES: %v", err)
+				http.Error(w, "invalid CARD_IMAGES file: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		previous := store.SetCardImages(overrides)
+		result, err := db.ApplyCardImages(r.Context(), previous, store.CurrentCardImages())
+		if err != nil {
+			logctx.Printf(r.Context(), "Error applying card images: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logctx.Printf(r.Context(), "Card images rebuilt: %d of %d cards updated", result.Updated, result.Cards)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+func handleMetricsRefreshStatus(refresher *metricsRefresher) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(refresher.Status())
+	}
+}
+
+// handleSetScrapeInterval sets a card's own scrape interval from
+// {"scrape_interval": "1h"}, an empty interval resets it
+func (db *Database) handleSetScrapeInterval(w http.ResponseWriter, r *http.Request) {
+	cardID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || cardID < 1 {
+		http.Error(w, "invalid card id", http.StatusBadRequest)
+		return
+	}
+
+	var body struct {
+		ScrapeInterval string `json:"scrape_interval"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+
+	var interval time.Duration
+	if body.ScrapeInterval != "" {
+		interval, err = time.ParseDuration(body.ScrapeInterval)
+		if err != nil || interval < time.Minute {
+			http.Error(w, "scrape_interval must be a duration of at least 1m, e.g. 1h", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err = db.SetScrapeInterval(r.Context(), cardID, interval)
+	switch {
+	case errors.Is(err, store.ErrCardNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		logctx.Printf(r.Context(), "Error setting scrape interval of card %d: %v", cardID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":              cardID,
+		"scrape_interval": body.ScrapeInterval,
+	})
+}
+
+func handleSources(scraper *Scraper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(scraper.health.Statuses())
+	}
+}
+
+// handleStats reports the totals with a breakdown per source. Configured
+// sources without prices yet are listed too.
+func handleStats(scraper *Scraper) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group := r.URL.Query().Get("group")
+		if group != "" && group != "provider" {
+			http.Error(w, "group must be provider", http.StatusBadRequest)
+			return
+		}
+
+		stats, err := scraper.db.GetStats(r.Context())
+		if err != nil {
+			logctx.Printf(r.Context(), "Error getting stats: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, status := range scraper.health.Statuses() {
+			enabled := status.Enabled
+			found := false
+			for i := range stats.Sources {
+				if strings.EqualFold(stats.Sources[i].Name, status.Name) {
+					stats.Sources[i].Enabled = &enabled
+					stats.Sources[i].LastSuccess = status.LastSuccess
+					found = true
+				}
+			}
+			if !found {
+				stats.Sources = append(stats.Sources, store.SourceStats{
+					Name:        status.Name,
+					Enabled:     &enabled,
+					LastSuccess: status.LastSuccess,
+				})
+			}
+		}
+		if group == "provider" {
+			stats.Providers = store.GroupByProvider(stats.Sources)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	}
+}
+
+// maxCompareCards caps the ids /api/cards/compare takes
+const maxCompareCards = 20
+
+// handleCompareCards returns the cards in ?ids=1,2,3 in the requested order.
+// Ids without a priced card are left out.
+func (db *Database) handleCompareCards(rates *ExchangeRates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		idList := config.SplitList(r.URL.Query().Get("ids"))
+		if len(idList) == 0 {
+			http.Error(w, "ids is required", http.StatusBadRequest)
+			return
+		}
+		if len(idList) > maxCompareCards {
+			http.Error(w, fmt.Sprintf("at most %d ids can be compared", maxCompareCards), http.StatusBadRequest)
+			return
+		}
+
+		ids := make([]int, 0, len(idList))
+		seen := make(map[int]bool)
+		for _, value := range idList {
+			id, err := strconv.Atoi(value)
+			if err != nil || id <= 0 {
+				http.Error(w, fmt.Sprintf("invalid card id %q", value), http.StatusBadRequest)
+				return
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+
+		filter := store.CardFilter{IDs: ids, IncludeStale: true, Rates: usdRates(r.Context(), rates)}
+		cards, err := db.GetCardsForFrontend(r.Context(), filter)
+		if err != nil {
+			logctx.Printf(r.Context(), "Error getting cards to compare: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		byID := make(map[int]store.Card, len(cards))
+		for _, card := range cards {
+			byID[card.ID] = card
+		}
+		ordered := make([]store.Card, 0, len(ids))
+		for _, id := range ids {
+			if card, ok := byID[id]; ok {
+				ordered = append(ordered, card)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ordered); err != nil {
+			logctx.Printf(r.Context(), "Error encoding compare response: %v", err)
+		}
+	}
+}
+
+func (db *Database) handleMatchCard(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := strings.TrimSpace(query.Get("name"))
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	card, key, found, err := db.MatchCard(r.Context(), name, query.Get("set"), query.Get("number"))
+	if err != nil {
+		logctx.Printf(r.Context(), "Error matching card: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": "no matching card",
+			"key":   key,
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":   card.ID,
+		"name": card.Name,
+		"set":  card.SetName,
+		"key":  key,
+	})
+}
+
+func handleConvert(rates *ExchangeRates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		amount, err := strconv.ParseFloat(query.Get("amount"), 64)
+		if err != nil || math.IsNaN(amount) || math.IsInf(amount, 0) {
+			http.Error(w, "amount must be a number", http.StatusBadRequest)
+			return
+		}
+
+		from := strings.ToUpper(strings.TrimSpace(query.Get("from")))
+		to := strings.ToUpper(strings.TrimSpace(query.Get("to")))
+		if !normalize.CurrencyCodePattern.MatchString(from) || !normalize.CurrencyCodePattern.MatchString(to) {
+			http.Error(w, "from and to must be 3-letter currency codes", http.StatusBadRequest)
+			return
+		}
+
+		converted, rate, err := rates.Convert(amount, from, to)
+		if errors.Is(err, errUnknownCurrency) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logctx.Printf(r.Context(), "Error converting currency: %v", err)
+			http.Error(w, "exchange rates are unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"amount": amount,
+			"from":   from,
+			"to":     to,
+			"rate":   rate,
+			"result": math.Round(converted*100) / 100,
+		})
+	}
+}
+
+// handleImport imports up to maxItems cards from a JSON array
+func (db *Database) handleImport(maxItems int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// bound the body as well, the whole batch is decoded into memory
+		// before it is inserted
+		r.Body = http.MaxBytesReader(w, r.Body, 50<<20)
+
+		results, err := db.ImportCards(r.Context(), r.Body, maxItems)
+		var bodyTooLarge *http.MaxBytesError
+		if errors.Is(err, store.ErrImportTooLarge) || errors.As(err, &bodyTooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, store.ErrInvalidImport) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logctx.Printf(r.Context(), "Error importing cards: %v", err)
+			http.Error(w, "Failed to import cards", http.StatusInternalServerError)
+			return
+		}
+
+		imported := 0
+		for _, result := range results {
+			if result.Status == "ok" {
+				imported++
+			}
+		}
+		logctx.Printf(r.Context(), "Imported %d of %d cards", imported, len(results))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"imported": imported,
+			"failed":   len(results) - imported,
+			"results":  results,
+		})
+	}
+}
+
+// cardPatchValue validates a PATCH field and returns what is stored
+func cardPatchValue(name string, field store.CardPatchField, raw json.RawMessage) (interface{}, error) {
+	var value *string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("%s must be a string", name)
+	}
+	if value == nil || strings.TrimSpace(*value) == "" {
+		if field.Nullable {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("%s can't be empty", name)
+	}
+
+	text := strings.TrimSpace(*value)
+	if utf8.RuneCountInString(text) > field.MaxLength {
+		return nil, fmt.Errorf("%s is longer than %d characters", name, field.MaxLength)
+	}
+	switch name {
+	case "product_type":
+		text = strings.ToLower(text)
+		if text != store.ProductTypeSingle && text != store.ProductTypeSealed {
+			return nil, fmt.Errorf("product_type must be %s or %s", store.ProductTypeSingle, store.ProductTypeSealed)
+		}
+	case "condition":
+		// graded conditions such as "PSA 10" are kept as they are
+		if condition := normalize.Condition(text); condition != "" {
+			text = condition
+		}
+	case "image_url":
+		if u, err := url.Parse(text); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("image_url must be an http(s) URL")
+		}
+	}
+	return text, nil
+}
+
+// handlePatchCard changes only the fields present in the JSON body and
+// returns the updated card
+func (db *Database) handlePatchCard(rates *ExchangeRates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cardID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil || cardID < 1 {
+			http.Error(w, "invalid card id", http.StatusBadRequest)
+			return
+		}
+
+		var body map[string]json.RawMessage
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&body); err != nil || body == nil {
+			http.Error(w, "invalid JSON body, expected an object of the fields to change", http.StatusBadRequest)
+			return
+		}
+		if len(body) == 0 {
+			http.Error(w, "no fields to change", http.StatusBadRequest)
+			return
+		}
+
+		changes := make(map[string]interface{}, len(body))
+		for name, raw := range body {
+			field, ok := store.CardPatchFields[name]
+			if !ok {
+				http.Error(w, fmt.Sprintf("%s can't be changed, the fields are %s", name,
+					strings.Join(slices.Sorted(maps.Keys(store.CardPatchFields)), ", ")), http.StatusBadRequest)
+				return
+			}
+			value, err := cardPatchValue(name, field, raw)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			changes[name] = value
+		}
+
+		err = db.PatchCard(r.Context(), cardID, changes)
+		switch {
+		case errors.Is(err, store.ErrCardNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, store.ErrCardConflict):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			logctx.Printf(r.Context(), "Error patching card %d: %v", cardID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		ctx := store.WithPrimaryReads(r.Context())
+		card, err := db.GetCardWithPrices(ctx, cardID, usdRates(ctx, rates))
+		if err != nil {
+			logctx.Printf(r.Context(), "Error getting patched card %d: %v", cardID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(card)
+	}
+}
+
+// handleMergeCards merges the duplicate card merge_id into keep_id and
+// returns keep_id with all the prices
+func (db *Database) handleMergeCards(rates *ExchangeRates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			KeepID  int `json:"keep_id"`
+			MergeID int `json:"merge_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if body.KeepID < 1 || body.MergeID < 1 {
+			http.Error(w, "keep_id and merge_id must be card ids", http.StatusBadRequest)
+			return
+		}
+
+		moved, err := db.MergeCards(r.Context(), body.KeepID, body.MergeID)
+		switch {
+		case errors.Is(err, store.ErrMergeIntoItself):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, store.ErrCardNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			logctx.Printf(r.Context(), "Error merging card %d into %d: %v", body.MergeID, body.KeepID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logctx.Printf(r.Context(), "Merged card %d into %d, %d prices moved", body.MergeID, body.KeepID, moved)
+
+		ctx := store.WithPrimaryReads(r.Context())
+		card, err := db.GetCardWithPrices(ctx, body.KeepID, usdRates(ctx, rates))
+		if err != nil {
+			logctx.Printf(r.Context(), "Error getting merged card %d: %v", body.KeepID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(card)
+	}
+}
+
+// writeJSONError answers with {"error": message}, the shape of the JSON
+// errors, e.g. the one of /api/cards/match
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
+
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+	})
+}
@@ -0,0 +1,38 @@
+//go:build chromedp
+
+package main
+
+import (
+	"context"
+
+	"github.com/chromedp/chromedp"
+)
+
+// Build with -tags chromedp to render JS-heavy sources in headless Chrome,
+// e.g. SOURCE_FETCHERS="TCGPlayer=chromedp". Chrome must be installed.
+
+func init() {
+	fetchers["chromedp"] = chromedpFetch
+}
+
+// chromedpFetch loads pages in headless Chrome and returns the HTML once
+// cfg.HeadlessWaitSelector is visible
+func chromedpFetch(cfg *Config) FetchFunc {
+	return func(ctx context.Context, pageURL string) ([]byte, error) {
+		ctx, cancel := chromedp.NewContext(ctx)
+		defer cancel()
+		ctx, cancel = context.WithTimeout(ctx, cfg.HeadlessTimeout)
+		defer cancel()
+
+		var html string
+		err := chromedp.Run(ctx,
+			chromedp.Navigate(pageURL),
+			chromedp.WaitVisible(cfg.HeadlessWaitSelector, chromedp.ByQuery),
+			chromedp.OuterHTML("html", &html, chromedp.ByQuery),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(html), nil
+	}
+}
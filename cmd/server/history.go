@@ -0,0 +1,335 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"Pokemonscraper/internal/logctx"
+	"Pokemonscraper/internal/normalize"
+	"Pokemonscraper/internal/store"
+
+	"github.com/gorilla/mux"
+)
+
+// historyFilenamePattern matches what is replaced by "-" in the file name
+// of a card's history
+var historyFilenamePattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// maxSmoothWindow bounds ?smooth= on the history endpoints
+const maxSmoothWindow = 365 * 24 * time.Hour
+
+// parseSmoothWindow parses ?smooth=, a number of days such as 7d or a
+// duration such as 36h
+func parseSmoothWindow(value string) (time.Duration, bool) {
+	var window time.Duration
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 || n > 365 {
+			return 0, false
+		}
+		window = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if window, err = time.ParseDuration(value); err != nil {
+			return 0, false
+		}
+	}
+	return window, window >= time.Hour && window <= maxSmoothWindow
+}
+
+// movingAverage is the trailing moving average of one series of prices,
+// added oldest first: each price is averaged with the ones scraped within
+// the window before it. Sparse series average whatever prices the window
+// has, a lone price is its own average.
+type movingAverage struct {
+	window time.Duration
+	prices []store.Price
+	sum    float64
+}
+
+// add adds the next price and returns the average ending at it and how
+// many prices it is made of
+func (m *movingAverage) add(price store.Price) (float64, int) {
+	m.prices = append(m.prices, price)
+	m.sum += price.Price
+	start := price.ScrapedAt.Add(-m.window)
+	for !m.prices[0].ScrapedAt.After(start) {
+		m.sum -= m.prices[0].Price
+		m.prices = m.prices[1:]
+	}
+	return normalize.RoundPrice(m.sum/float64(len(m.prices)), price.Currency), len(m.prices)
+}
+
+// historySeriesKey identifies the series a price belongs to: prices are
+// only averaged with the same source's, in the same region and currency
+func historySeriesKey(price store.Price) string {
+	return price.Source + "\x00" + price.Region + "\x00" + price.Currency
+}
+
+// smoothParam reads ?smooth=, 0 when it is missing. It answers the request
+// itself when it returns false.
+func smoothParam(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	value := r.URL.Query().Get("smooth")
+	if value == "" {
+		return 0, true
+	}
+	smooth, ok := parseSmoothWindow(value)
+	if !ok {
+		http.Error(w, "smooth must be a number of days like 7d or a duration like 36h, from 1h to 365d", http.StatusBadRequest)
+	}
+	return smooth, ok
+}
+
+// historyRequest reads the card ID and ?smooth= of the history endpoints
+// and looks up the card's name. It answers the request itself when it
+// returns false.
+func (db *Database) historyRequest(w http.ResponseWriter, r *http.Request) (cardID int, name string, smooth time.Duration, ok bool) {
+	cardID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil || cardID < 1 {
+		http.Error(w, "invalid card id", http.StatusBadRequest)
+		return 0, "", 0, false
+	}
+	if smooth, ok = smoothParam(w, r); !ok {
+		return 0, "", 0, false
+	}
+
+	name, err = db.CardName(r.Context(), cardID)
+	switch {
+	case errors.Is(err, store.ErrCardNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return 0, "", 0, false
+	case err != nil:
+		logctx.Printf(r.Context(), "Error getting card %d: %v", cardID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, "", 0, false
+	}
+	return cardID, name, smooth, true
+}
+
+// PriceHistory is a card's prices over time, one series per source
+type PriceHistory struct {
+	CardID int    `json:"card_id"`
+	Name   string `json:"name"`
+	// Smooth is the ?smooth= window of the points' Smoothed prices
+	Smooth string               `json:"smooth,omitempty"`
+	Series []PriceHistorySeries `json:"series"`
+}
+
+// PriceHistorySeries is one source's prices of a card, oldest first
+type PriceHistorySeries struct {
+	Source   string         `json:"source"`
+	Region   string         `json:"region,omitempty"`
+	Currency string         `json:"currency"`
+	Points   []HistoryPoint `json:"points"`
+}
+
+// HistoryPoint is a price as scraped and, with ?smooth=, the moving average
+// of the series ending at it, made of WindowPoints prices
+type HistoryPoint struct {
+	ScrapedAt    time.Time `json:"scraped_at"`
+	Price        float64   `json:"price"`
+	Smoothed     *float64  `json:"smoothed,omitempty"`
+	WindowPoints int       `json:"window_points,omitempty"`
+}
+
+// CardDetail is a card with the latest price from each source and, with
+// ?smooth=, each source's moving average ending at its latest price
+type CardDetail struct {
+	*store.CardWithPrices
+	// Smooth is the ?smooth= window of the Smoothed prices
+	Smooth   string          `json:"smooth,omitempty"`
+	Smoothed []SmoothedPrice `json:"smoothed,omitempty"`
+}
+
+// SmoothedPrice is the last point of a source's smoothed history series
+type SmoothedPrice struct {
+	Source       string    `json:"source"`
+	Region       string    `json:"region,omitempty"`
+	Currency     string    `json:"currency"`
+	ScrapedAt    time.Time `json:"scraped_at"`
+	Smoothed     float64   `json:"smoothed"`
+	WindowPoints int       `json:"window_points"`
+}
+
+// handleGetCard returns a card with its latest prices. ?smooth=7d adds
+// each source's 7 day moving average, the same as the last point of
+// its series in the history.
+func (db *Database) handleGetCard(rates *ExchangeRates) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cardID, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil || cardID < 1 {
+			http.Error(w, "invalid card id", http.StatusBadRequest)
+			return
+		}
+		smooth, ok := smoothParam(w, r)
+		if !ok {
+			return
+		}
+
+		card, err := db.GetCardWithPrices(r.Context(), cardID, usdRates(r.Context(), rates))
+		switch {
+		case errors.Is(err, store.ErrCardNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case err != nil:
+			logctx.Printf(r.Context(), "Error getting card %d: %v", cardID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		detail := CardDetail{CardWithPrices: card}
+		if smooth > 0 {
+			detail.Smooth = r.URL.Query().Get("smooth")
+			if detail.Smoothed, err = db.smoothedPrices(r.Context(), cardID, smooth); err != nil {
+				logctx.Printf(r.Context(), "Error smoothing the prices of card %d: %v", cardID, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(detail)
+	}
+}
+
+// smoothedPrices returns the moving average over window of each of the
+// card's series, ending at the series' latest price
+func (db *Database) smoothedPrices(ctx context.Context, cardID int, window time.Duration) ([]SmoothedPrice, error) {
+	smoothed := []SmoothedPrice{}
+	index := make(map[string]int)
+	averages := make(map[string]*movingAverage)
+	err := db.PriceHistory(ctx, cardID, func(price store.Price) error {
+		key := historySeriesKey(price)
+		i, found := index[key]
+		if !found {
+			i = len(smoothed)
+			index[key] = i
+			averages[key] = &movingAverage{window: window}
+			smoothed = append(smoothed, SmoothedPrice{Source: price.Source, Region: price.Region, Currency: price.Currency})
+		}
+		smoothed[i].Smoothed, smoothed[i].WindowPoints = averages[key].add(price)
+		smoothed[i].ScrapedAt = price.ScrapedAt
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(smoothed, func(i, j int) bool {
+		if smoothed[i].Source != smoothed[j].Source {
+			return smoothed[i].Source < smoothed[j].Source
+		}
+		return smoothed[i].Region < smoothed[j].Region
+	})
+	return smoothed, nil
+}
+
+// handleGetHistory returns every price of a card, grouped by source, for
+// charts. ?smooth=7d adds the 7 day moving average to each point.
+func (db *Database) handleGetHistory(w http.ResponseWriter, r *http.Request) {
+	cardID, name, smooth, ok := db.historyRequest(w, r)
+	if !ok {
+		return
+	}
+
+	history := PriceHistory{CardID: cardID, Name: name, Series: []PriceHistorySeries{}}
+	if smooth > 0 {
+		history.Smooth = r.URL.Query().Get("smooth")
+	}
+	index := make(map[string]int)
+	averages := make(map[string]*movingAverage)
+	err := db.PriceHistory(r.Context(), cardID, func(price store.Price) error {
+		key := historySeriesKey(price)
+		i, found := index[key]
+		if !found {
+			i = len(history.Series)
+			index[key] = i
+			averages[key] = &movingAverage{window: smooth}
+			history.Series = append(history.Series, PriceHistorySeries{
+				Source: price.Source, Region: price.Region, Currency: price.Currency, Points: []HistoryPoint{},
+			})
+		}
+
+		point := HistoryPoint{ScrapedAt: price.ScrapedAt, Price: price.Price}
+		if smooth > 0 {
+			smoothed, points := averages[key].add(price)
+			point.Smoothed, point.WindowPoints = &smoothed, points
+		}
+		history.Series[i].Points = append(history.Series[i].Points, point)
+		return nil
+	})
+	if err != nil {
+		logctx.Printf(r.Context(), "Error getting history of card %d: %v", cardID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sort.SliceStable(history.Series, func(i, j int) bool {
+		a, b := history.Series[i], history.Series[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Region < b.Region
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// handleGetHistoryCSV streams every price of a card as a CSV download named
+// after the card. A card without prices gets just the header. ?smooth=
+// adds a smoothed_price column, the moving average of the source's prices.
+func (db *Database) handleGetHistoryCSV(w http.ResponseWriter, r *http.Request) {
+	cardID, name, smooth, ok := db.historyRequest(w, r)
+	if !ok {
+		return
+	}
+
+	slug := strings.Trim(historyFilenamePattern.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if slug == "" {
+		slug = "card-" + strconv.Itoa(cardID)
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment",
+		map[string]string{"filename": slug + "-history.csv"}))
+
+	out := csv.NewWriter(w)
+	header := []string{"scraped_at", "source", "price", "currency"}
+	if smooth > 0 {
+		header = append(header, "smoothed_price")
+	}
+	out.Write(header)
+
+	averages := make(map[string]*movingAverage)
+	err := db.PriceHistory(r.Context(), cardID, func(price store.Price) error {
+		record := []string{
+			price.ScrapedAt.Format(time.RFC3339),
+			price.Source,
+			normalize.FormatPrice(price.Price, price.Currency),
+			price.Currency,
+		}
+		if smooth > 0 {
+			key := historySeriesKey(price)
+			if averages[key] == nil {
+				averages[key] = &movingAverage{window: smooth}
+			}
+			smoothed, _ := averages[key].add(price)
+			record = append(record, normalize.FormatPrice(smoothed, price.Currency))
+		}
+		return out.Write(record)
+	})
+	out.Flush()
+	if err != nil {
+		// the status is sent already, the download ends short
+		logctx.Printf(r.Context(), "Error streaming history of card %d: %v", cardID, err)
+	}
+}
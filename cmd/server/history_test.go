@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"Pokemonscraper/internal/store"
+)
+
+func TestParseSmoothWindow(t *testing.T) {
+	tests := []struct {
+		value  string
+		window time.Duration
+		ok     bool
+	}{
+		{"7d", 7 * 24 * time.Hour, true},
+		{"36h", 36 * time.Hour, true},
+		{"90m", 90 * time.Minute, true},
+		{"1h", time.Hour, true},
+		{"365d", 365 * 24 * time.Hour, true},
+		{"8760h", 365 * 24 * time.Hour, true},
+		{"59m", 0, false},
+		{"366d", 0, false},
+		{"8761h", 0, false},
+		{"0d", 0, false},
+		{"-1d", 0, false},
+		{"1.5d", 0, false},
+		{"d", 0, false},
+		{"7", 0, false},
+		{"week", 0, false},
+	}
+	for _, test := range tests {
+		window, ok := parseSmoothWindow(test.value)
+		if ok != test.ok || (ok && window != test.window) {
+			t.Errorf("parseSmoothWindow(%q) = %s, %v, want %s, %v", test.value, window, ok, test.window, test.ok)
+		}
+	}
+}
+
+func TestMovingAverage(t *testing.T) {
+	type step struct {
+		after   time.Duration // since the first price
+		price   float64
+		average float64
+		count   int
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"lone price", []step{{0, 10, 10, 1}}},
+		{"within the window", []step{{0, 10, 10, 1}, {23 * time.Hour, 30, 20, 2}, {46 * time.Hour, 5, 17.5, 2}}},
+		// a price exactly a window old is left out
+		{"exclusive start", []step{{0, 10, 10, 1}, {24 * time.Hour, 20, 20, 1}}},
+		{"gap longer than the window", []step{{0, 10, 10, 1}, {time.Hour, 20, 15, 2}, {72 * time.Hour, 40, 40, 1}, {80 * time.Hour, 60, 50, 2}}},
+		{"rounded to cents", []step{{0, 1, 1, 1}, {time.Hour, 1, 1, 2}, {2 * time.Hour, 2, 1.33, 3}}},
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, test := range tests {
+		m := &movingAverage{window: 24 * time.Hour}
+		for i, step := range test.steps {
+			average, count := m.add(store.Price{Price: step.price, Currency: "USD", ScrapedAt: start.Add(step.after)})
+			if average != step.average || count != step.count {
+				t.Errorf("%s: price %d averages %v over %d prices, want %v over %d",
+					test.name, i, average, count, step.average, step.count)
+			}
+		}
+	}
+}
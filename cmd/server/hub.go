@@ -0,0 +1,504 @@
+package main
+
+import (
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"Pokemonscraper/internal/logctx"
+	"Pokemonscraper/internal/store"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocket connection manager
+type Hub struct {
+	clients    map[*Client]bool
+	broadcast  chan []byte
+	register   chan *Client
+	unregister chan *Client
+	mutex      sync.RWMutex
+
+	// pending holds the latest update until the debounce timer fires, so
+	// overlapping scrapes produce a single broadcast
+	pendingMutex sync.Mutex
+	pending      []byte
+	pendingCards []store.Card
+	debounce     *time.Timer
+
+	// Every broadcast gets the next cursor. Long-polling clients wait on a
+	// subscription until the cursor passes theirs, then get the cards that
+	// changed since the snapshot at their cursor.
+	updatesMutex sync.Mutex
+	cursor       uint64
+	snapshots    []cardSnapshot
+	subscribers  map[chan struct{}]bool
+	// latest is the last update sent, new WebSocket clients get it on
+	// connect instead of waiting for the next scrape
+	latest []byte
+
+	// cache keeps the broadcast cards for /api/cards
+	cache *cardsCache
+}
+
+// cardsCache holds the default card list, the one /api/cards returns
+// without filters and scrapes broadcast, for up to maxAge. It is filled by
+// broadcasts and the startup warm-up, a maxAge of 0 disables it.
+type cardsCache struct {
+	maxAge   time.Duration
+	mu       sync.Mutex
+	cards    []store.Card
+	storedAt time.Time
+}
+
+// Get returns a copy of the cached cards, or false when there are none or
+// they are older than maxAge
+func (c *cardsCache) Get() ([]store.Card, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cards == nil || time.Since(c.storedAt) > c.maxAge {
+		return nil, false
+	}
+	return slices.Clone(c.cards), true
+}
+
+// Set replaces the cached cards
+func (c *cardsCache) Set(cards []store.Card) {
+	if c.maxAge <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cards, c.storedAt = cards, time.Now()
+}
+
+// cardSnapshot is the card list a broadcast sent
+type cardSnapshot struct {
+	cursor uint64
+	cards  []store.Card
+}
+
+// maxCardSnapshots is how many broadcasts are kept for computing deltas,
+// clients further behind get the full list
+const maxCardSnapshots = 10
+
+// broadcastDebounce is how long the hub waits for further updates before
+// broadcasting the latest one
+const broadcastDebounce = 2 * time.Second
+
+type Client struct {
+	hub  *Hub
+	conn *websocket.Conn
+	send chan []byte
+}
+
+// newUpgrader returns the WebSocket upgrader. With compression, clients
+// that offer permessage-deflate get compressed updates, which browsers do
+// on their own.
+func newUpgrader(compression bool) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			// Allow connections from localhost:3000 (Next.js dev server)
+			return true
+		},
+		EnableCompression: compression,
+	}
+}
+
+func newHub(cache *cardsCache) *Hub {
+	return &Hub{
+		broadcast:  make(chan []byte),
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		clients:    make(map[*Client]bool),
+
+		subscribers: make(map[chan struct{}]bool),
+		cache:       cache,
+	}
+}
+
+func (h *Hub) run() {
+	for {
+		select {
+		case client := <-h.register:
+			h.mutex.Lock()
+			h.clients[client] = true
+			h.mutex.Unlock()
+			log.Printf("Client connected. Total clients: %d", len(h.clients))
+			if latest := h.latestUpdate(); latest != nil {
+				client.send <- latest
+			}
+
+		case client := <-h.unregister:
+			h.mutex.Lock()
+			if _, ok := h.clients[client]; ok {
+				delete(h.clients, client)
+				close(client.send)
+			}
+			h.mutex.Unlock()
+			log.Printf("Client disconnected. Total clients: %d", len(h.clients))
+
+		case message := <-h.broadcast:
+			h.mutex.RLock()
+			for client := range h.clients {
+				select {
+				case client.send <- message:
+				default:
+					close(client.send)
+					delete(h.clients, client)
+				}
+			}
+			h.mutex.RUnlock()
+		}
+	}
+}
+
+func (h *Hub) broadcastUpdate(cards []store.Card) {
+	cards, fixed := sanitizeCards(cards)
+	if fixed > 0 {
+		log.Printf("Replaced %d NaN/Inf prices or invalid images before broadcasting", fixed)
+	}
+
+	data, err := json.Marshal(cards)
+	if err != nil {
+		log.Printf("Error marshaling cards for broadcast: %v", err)
+		return
+	}
+
+	h.pendingMutex.Lock()
+	defer h.pendingMutex.Unlock()
+
+	h.cache.Set(cards)
+
+	h.pending = data
+	h.pendingCards = cards
+	if h.debounce != nil {
+		// an update is already waiting, replace it and restart the window
+		h.debounce.Stop()
+		log.Println("Coalescing broadcast with a pending update")
+	}
+	h.debounce = time.AfterFunc(broadcastDebounce, h.flushBroadcast)
+}
+
+// sanitizeCards returns a copy of cards with NaN and Inf prices replaced by
+// 0, which JSON can't represent, and images that aren't valid UTF-8 by
+// store.DefaultCardImage, and how many values it replaced. One bad price
+// would otherwise fail the marshal of the whole update, and a broken image
+// would reach the clients as U+FFFD.
+func sanitizeCards(cards []store.Card) ([]store.Card, int) {
+	fixed := 0
+	finite := func(value *float64) {
+		if math.IsNaN(*value) || math.IsInf(*value, 0) {
+			*value = 0
+			fixed++
+		}
+	}
+
+	sanitized := make([]store.Card, len(cards))
+	for i, card := range cards {
+		finite(&card.Price)
+		finite(&card.Change)
+		finite(&card.ChangePercent)
+		if !utf8.ValidString(card.Image) {
+			card.Image = store.DefaultCardImage
+			fixed++
+		}
+
+		if card.Sources != nil {
+			card.Sources = append([]store.SourcePrice(nil), card.Sources...)
+			for j := range card.Sources {
+				finite(&card.Sources[j].Price)
+			}
+		}
+		sanitized[i] = card
+	}
+	return sanitized, fixed
+}
+
+// flushBroadcast sends the pending update to the clients
+func (h *Hub) flushBroadcast() {
+	h.pendingMutex.Lock()
+	data, cards := h.pending, h.pendingCards
+	h.pending, h.pendingCards = nil, nil
+	h.debounce = nil
+	h.pendingMutex.Unlock()
+
+	if data == nil {
+		return
+	}
+	h.publish(cards, data)
+
+	select {
+	case h.broadcast <- data:
+		log.Printf("Broadcasting update to %d clients", len(h.clients))
+	default:
+		log.Println("No clients to broadcast to")
+	}
+}
+
+// publish stores the cards as the next snapshot and wakes the long-polling
+// subscribers
+func (h *Hub) publish(cards []store.Card, data []byte) {
+	h.updatesMutex.Lock()
+	defer h.updatesMutex.Unlock()
+
+	h.latest = data
+	h.cursor++
+	h.snapshots = append(h.snapshots, cardSnapshot{cursor: h.cursor, cards: cards})
+	if len(h.snapshots) > maxCardSnapshots {
+		h.snapshots = h.snapshots[1:]
+	}
+	for subscriber := range h.subscribers {
+		close(subscriber)
+	}
+	h.subscribers = make(map[chan struct{}]bool)
+}
+
+// latestUpdate returns the last update sent, nil before the first
+func (h *Hub) latestUpdate() []byte {
+	h.updatesMutex.Lock()
+	defer h.updatesMutex.Unlock()
+	return h.latest
+}
+
+// warm loads the default card list before the server starts, so the first
+// /api/cards requests, WebSocket clients and long-polls are served without
+// waiting for the query or a scrape
+func (h *Hub) warm(db *Database, rates *ExchangeRates, minSources int) {
+	start := time.Now()
+	ctx := context.Background()
+	cards, err := db.GetCardsForFrontend(ctx, store.CardFilter{MinSources: minSources, Rates: usdRates(ctx, rates)})
+	if err != nil {
+		log.Printf("Warming the card cache failed, it fills on the first scrape: %v", err)
+		return
+	}
+	cards, _ = sanitizeCards(cards)
+	data, err := json.Marshal(cards)
+	if err != nil {
+		log.Printf("Warming the card cache failed: %v", err)
+		return
+	}
+
+	h.cache.Set(cards)
+	h.publish(cards, data)
+	log.Printf("Warmed the card cache with %d cards in %s", len(cards), time.Since(start).Round(time.Millisecond))
+}
+
+// CardUpdates is what changed since a long-polling client's cursor
+type CardUpdates struct {
+	Cursor  uint64       `json:"cursor"`
+	Changed []store.Card `json:"changed"`
+	Removed []int        `json:"removed"`
+	// Full is set when Changed is the whole card list because the cursor
+	// is unknown, e.g. 0 or from before a restart, or too old
+	Full bool `json:"full"`
+}
+
+// updatesSince returns the changes after cursor, or nil and a channel that
+// is closed on the next broadcast when there are none yet
+func (h *Hub) updatesSince(cursor uint64) (*CardUpdates, chan struct{}) {
+	h.updatesMutex.Lock()
+	defer h.updatesMutex.Unlock()
+
+	if cursor == h.cursor || len(h.snapshots) == 0 {
+		wait := make(chan struct{})
+		h.subscribers[wait] = true
+		return nil, wait
+	}
+
+	latest := h.snapshots[len(h.snapshots)-1]
+	updates := &CardUpdates{Cursor: latest.cursor, Changed: []store.Card{}, Removed: []int{}}
+
+	var previous []store.Card
+	found := false
+	for _, snapshot := range h.snapshots {
+		if snapshot.cursor == cursor {
+			previous, found = snapshot.cards, true
+		}
+	}
+	if !found {
+		updates.Changed = append(updates.Changed, latest.cards...)
+		updates.Full = true
+		return updates, nil
+	}
+
+	before := make(map[int]store.Card, len(previous))
+	for _, card := range previous {
+		before[card.ID] = card
+	}
+	for _, card := range latest.cards {
+		if old, ok := before[card.ID]; !ok || !reflect.DeepEqual(old, card) {
+			updates.Changed = append(updates.Changed, card)
+		}
+		delete(before, card.ID)
+	}
+	for _, card := range previous {
+		if _, gone := before[card.ID]; gone {
+			updates.Removed = append(updates.Removed, card.ID)
+		}
+	}
+	return updates, nil
+}
+
+// unsubscribe drops a subscription that timed out
+func (h *Hub) unsubscribe(wait chan struct{}) {
+	h.updatesMutex.Lock()
+	defer h.updatesMutex.Unlock()
+	delete(h.subscribers, wait)
+}
+
+// handleCardUpdates is the long-polling fallback of /ws: it waits until a
+// broadcast passes ?since= or the timeout runs out, then answers with the
+// cards that changed. A timeout answers with the same cursor and nothing
+// changed. ?timeout= shortens the wait below LONG_POLL_TIMEOUT.
+func handleCardUpdates(hub *Hub, maxWait time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+
+		var since uint64
+		if value := query.Get("since"); value != "" {
+			cursor, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				http.Error(w, "since must be a cursor from an earlier response", http.StatusBadRequest)
+				return
+			}
+			since = cursor
+		}
+
+		wait := maxWait
+		if value := query.Get("timeout"); value != "" {
+			timeout, err := time.ParseDuration(value)
+			if err != nil || timeout < 0 {
+				http.Error(w, "timeout must be a duration like 30s", http.StatusBadRequest)
+				return
+			}
+			wait = min(timeout, maxWait)
+		}
+
+		updates, subscription := hub.updatesSince(since)
+		if updates == nil {
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+
+			select {
+			case <-subscription:
+				updates, _ = hub.updatesSince(since)
+			case <-timer.C:
+			case <-r.Context().Done():
+			}
+			if updates == nil {
+				hub.unsubscribe(subscription)
+				updates = &CardUpdates{Cursor: since, Changed: []store.Card{}, Removed: []int{}}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(updates)
+	}
+}
+
+func (c *Client) writePump() {
+	ticker := time.NewTicker(54 * time.Second)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			// Every update is the full card list, so when a slow client
+			// has fallen behind only the newest one is worth sending
+		drain:
+			for ok {
+				select {
+				case newer, more := <-c.send:
+					if !more {
+						ok = false
+						break drain
+					}
+					message = newer
+				default:
+					break drain
+				}
+			}
+
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			w, err := c.conn.NextWriter(websocket.TextMessage)
+			if err != nil {
+				return
+			}
+			w.Write(message)
+
+			if err := w.Close(); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) readPump() {
+	defer func() {
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(512)
+	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		return nil
+	})
+
+	for {
+		_, _, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("error: %v", err)
+			}
+			break
+		}
+	}
+}
+
+func handleWebSocket(hub *Hub, upgrader *websocket.Upgrader, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logctx.Printf(r.Context(), "WebSocket upgrade error: %v", err)
+		return
+	}
+	if upgrader.EnableCompression {
+		// Only takes effect when the client negotiated compression. The
+		// updates are mostly repeated JSON keys, the fastest level
+		// already shrinks them several times.
+		conn.EnableWriteCompression(true)
+		conn.SetCompressionLevel(flate.BestSpeed)
+	}
+
+	client := &Client{hub: hub, conn: conn, send: make(chan []byte, 256)}
+	client.hub.register <- client
+
+	go client.writePump()
+	go client.readPump()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+
+	"Pokemonscraper/internal/store"
+)
+
+func TestBroadcastUpdateSanitizesNaN(t *testing.T) {
+	hub := newHub(&cardsCache{})
+	hub.broadcastUpdate([]store.Card{
+		{ID: 1, Name: "Pikachu", Price: math.NaN(), Change: math.Inf(1)},
+		{ID: 2, Name: "Eevee", Price: 12.5},
+	})
+
+	// read the pending update rather than waiting for the debounce
+	hub.pendingMutex.Lock()
+	if hub.debounce != nil {
+		hub.debounce.Stop()
+	}
+	data := hub.pending
+	hub.pendingMutex.Unlock()
+
+	if data == nil {
+		t.Fatal("broadcastUpdate dropped the update")
+	}
+	var cards []store.Card
+	if err := json.Unmarshal(data, &cards); err != nil {
+		t.Fatalf("broadcast isn't valid JSON: %v", err)
+	}
+	if len(cards) != 2 {
+		t.Fatalf("broadcast %d cards, want 2", len(cards))
+	}
+	if cards[0].Price != 0 || cards[0].Change != 0 {
+		t.Errorf("NaN card broadcast with price %v and change %v, want 0", cards[0].Price, cards[0].Change)
+	}
+	if cards[1].Price != 12.5 {
+		t.Errorf("Eevee broadcast with price %v, want 12.5", cards[1].Price)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"Pokemonscraper/internal/logctx"
+)
+
+// idempotentResponse is a response stored for its Idempotency-Key
+type idempotentResponse struct {
+	key       string
+	done      bool // false while the first request is still running
+	status    int
+	header    http.Header
+	body      []byte
+	expiresAt time.Time
+}
+
+// idempotencySweepInterval is how often expired Idempotency-Key responses
+// are dropped
+const idempotencySweepInterval = time.Minute
+
+// idempotencyStore keeps the responses of requests sent with an
+// Idempotency-Key header for ttl, so a client retrying a POST gets the
+// first response back instead of running it again. It holds at most
+// maxKeys responses, the least recently used go first.
+type idempotencyStore struct {
+	ttl     time.Duration
+	maxKeys int
+	mu      sync.Mutex
+	// responses holds the elements of lru, whose values are
+	// *idempotentResponse, most recently used first
+	responses map[string]*list.Element
+	lru       *list.List
+}
+
+func newIdempotencyStore(ttl time.Duration, maxKeys int) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:       ttl,
+		maxKeys:   maxKeys,
+		responses: make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// run drops the expired responses every idempotencySweepInterval
+func (s *idempotencyStore) run() {
+	ticker := time.NewTicker(idempotencySweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.expire(time.Now())
+	}
+}
+
+// expire drops the responses that expired before now
+func (s *idempotencyStore) expire(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for element := s.lru.Front(); element != nil; {
+		next := element.Next()
+		if response := element.Value.(*idempotentResponse); response.done && now.After(response.expiresAt) {
+			s.remove(element)
+		}
+		element = next
+	}
+}
+
+// begin returns the stored response for key, or claims key for a new
+// request when there is none
+func (s *idempotencyStore) begin(key string) (*idempotentResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.responses[key]; ok {
+		response := element.Value.(*idempotentResponse)
+		if !response.done || time.Now().Before(response.expiresAt) {
+			s.lru.MoveToFront(element)
+			copied := *response
+			return &copied, true
+		}
+		s.remove(element)
+	}
+	s.responses[key] = s.lru.PushFront(&idempotentResponse{key: key})
+	s.evict()
+	return nil, false
+}
+
+// evict drops the least recently used responses over maxKeys. Keys of
+// requests still running are kept, they are bounded by the requests in
+// flight.
+func (s *idempotencyStore) evict() {
+	for element := s.lru.Back(); element != nil && len(s.responses) > s.maxKeys; {
+		prev := element.Prev()
+		if element.Value.(*idempotentResponse).done {
+			s.remove(element)
+		}
+		element = prev
+	}
+}
+
+func (s *idempotencyStore) remove(element *list.Element) {
+	s.lru.Remove(element)
+	delete(s.responses, element.Value.(*idempotentResponse).key)
+}
+
+// release drops the claim on key of a request that never finished, so a
+// retry runs it again
+func (s *idempotencyStore) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.responses[key]; ok {
+		s.remove(element)
+	}
+}
+
+// finish stores the response for key. Only successful responses are
+// stored, after an error such as 409 or 500 a retry runs the request again.
+// X-Request-ID is left out, a replay answers a request of its own.
+func (s *idempotencyStore) finish(key string, rec *responseRecorder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.responses[key]
+	if !ok {
+		return
+	}
+	if rec.status < 200 || rec.status >= 300 {
+		s.remove(element)
+		return
+	}
+	header := rec.Header().Clone()
+	header.Del("X-Request-ID")
+	element.Value = &idempotentResponse{
+		key:       key,
+		done:      true,
+		status:    rec.status,
+		header:    header,
+		body:      rec.body.Bytes(),
+		expiresAt: time.Now().Add(s.ttl),
+	}
+}
+
+// responseRecorder writes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// maxIdempotencyKeyLength bounds the Idempotency-Key header
+const maxIdempotencyKeyLength = 255
+
+// idempotent replays the stored response for a repeated Idempotency-Key
+// instead of running next again. A repeat that arrives while the first
+// request is still running gets 409. Requests without the header run as
+// usual.
+func idempotent(store *idempotencyStore, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		// keys are per endpoint, the same key may be reused on another one
+		storeKey := r.Method + " " + r.URL.Path + " " + key
+		if stored, ok := store.begin(storeKey); ok {
+			if !stored.done {
+				http.Error(w, "a request with this Idempotency-Key is still in progress", http.StatusConflict)
+				return
+			}
+			logctx.Printf(r.Context(), "Replaying the response for Idempotency-Key %q", key)
+			for name, values := range stored.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.status)
+			w.Write(stored.body)
+			return
+		}
+
+		// a handler that panics didn't finish, whatever it wrote is not
+		// its response
+		rec := &responseRecorder{ResponseWriter: w}
+		returned := false
+		defer func() {
+			if !returned {
+				store.release(storeKey)
+				return
+			}
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+			store.finish(storeKey, rec)
+		}()
+		next(rec, r)
+		returned = true
+	}
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestIdempotentReplayKeepsRequestID(t *testing.T) {
+	calls := 0
+	handler := withRequestID(idempotent(newIdempotencyStore(time.Hour, 10), func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Write([]byte("done"))
+	}))
+
+	send := func(requestID string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/scrape", nil)
+		req.Header.Set("Idempotency-Key", "key-1")
+		req.Header.Set("X-Request-ID", requestID)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := send("first")
+	replay := send("second")
+
+	if calls != 1 {
+		t.Fatalf("handler ran %d times, want 1", calls)
+	}
+	if got := first.Header().Get("X-Request-ID"); got != "first" {
+		t.Errorf("first response X-Request-ID = %q, want %q", got, "first")
+	}
+	if got := replay.Header().Get("X-Request-ID"); got != "second" {
+		t.Errorf("replayed response X-Request-ID = %q, want %q", got, "second")
+	}
+	if got := replay.Header().Get("Idempotent-Replayed"); got != "true" {
+		t.Errorf("Idempotent-Replayed = %q, want true", got)
+	}
+	if got := replay.Body.String(); got != "done" {
+		t.Errorf("replayed body = %q, want %q", got, "done")
+	}
+}
+
+func TestIdempotentPanicIsNotStored(t *testing.T) {
+	calls := 0
+	handler := idempotent(newIdempotencyStore(time.Hour, 10), func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		w.Write([]byte("done"))
+	})
+
+	send := func() (rec *httptest.ResponseRecorder, panicked bool) {
+		req := httptest.NewRequest("POST", "/api/cards/merge", nil)
+		req.Header.Set("Idempotency-Key", "key-1")
+		rec = httptest.NewRecorder()
+		defer func() {
+			panicked = recover() != nil
+		}()
+		handler(rec, req)
+		return rec, false
+	}
+
+	if _, panicked := send(); !panicked {
+		t.Fatal("the panic didn't reach the caller")
+	}
+	retry, _ := send()
+	if calls != 2 {
+		t.Errorf("handler ran %d times, want the retry to run it again", calls)
+	}
+	if got := retry.Header().Get("Idempotent-Replayed"); got != "" {
+		t.Errorf("retry was replayed: Idempotent-Replayed = %q", got)
+	}
+	if got := retry.Body.String(); got != "done" {
+		t.Errorf("retry body = %q, want %q", got, "done")
+	}
+}
+
+func finishOK(s *idempotencyStore, key string) {
+	rec := &responseRecorder{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+	s.finish(key, rec)
+}
+
+func TestIdempotencyStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	s := newIdempotencyStore(time.Hour, 2)
+	for _, key := range []string{"a", "b"} {
+		s.begin(key)
+		finishOK(s, key)
+	}
+	// a is used again, so b is the least recently used one
+	if _, ok := s.begin("a"); !ok {
+		t.Fatal("a wasn't stored")
+	}
+	s.begin("c")
+	finishOK(s, "c")
+
+	if len(s.responses) != 2 {
+		t.Errorf("store holds %d responses, want 2", len(s.responses))
+	}
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok := s.responses[key]; ok != want {
+			t.Errorf("%s stored = %t, want %t", key, ok, want)
+		}
+	}
+}
+
+func TestIdempotencyStoreKeepsRunningRequests(t *testing.T) {
+	s := newIdempotencyStore(time.Hour, 1)
+	s.begin("running")
+	s.begin("other")
+
+	if stored, ok := s.begin("running"); !ok || stored.done {
+		t.Errorf("begin(running) = %+v, %t, want the running request", stored, ok)
+	}
+}
+
+func TestIdempotencyStoreExpire(t *testing.T) {
+	s := newIdempotencyStore(time.Minute, 10)
+	s.begin("old")
+	finishOK(s, "old")
+	s.begin("running")
+
+	s.expire(time.Now().Add(2 * time.Minute))
+
+	if _, ok := s.responses["old"]; ok {
+		t.Error("expired response is still stored")
+	}
+	if _, ok := s.responses["running"]; !ok {
+		t.Error("running request was expired")
+	}
+	if s.lru.Len() != len(s.responses) {
+		t.Errorf("lru holds %d elements, responses %d", s.lru.Len(), len(s.responses))
+	}
+}
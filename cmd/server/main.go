@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"Pokemonscraper/internal/collect"
+	"Pokemonscraper/internal/normalize"
+	"Pokemonscraper/internal/store"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/cors"
+)
+
+// Build information, set at link time with
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=..."
+var (
+	version   = "dev"
+	commit    = "dev"
+	buildTime = "dev"
+)
+
+// scrapePanics counts the panics recovered from background scrapes
+var scrapePanics = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pokemon_scrape_panics_total",
+	Help: "Panics recovered from background scrapes by task.",
+}, []string{"task"})
+
+// sourceScrapeDuration tracks how long each source takes to scrape. Pages
+// are rate limited to one every 2s, so the buckets run from 1s to ~17m.
+var sourceScrapeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "pokemon_source_scrape_duration_seconds",
+	Help:    "Duration of a scrape of one source by source name.",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 11),
+}, []string{"source"})
+
+// sourceCardsFound counts the cards each source returned
+var sourceCardsFound = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pokemon_source_cards_found_total",
+	Help: "Cards returned by scrapes of a source by source name.",
+}, []string{"source"})
+
+var sourcePricesInserted = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pokemon_source_prices_inserted_total",
+	Help: "Prices stored from scrapes of a source by source name.",
+}, []string{"source"})
+
+var dbPoolExhausted = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "pokemon_db_pool_exhausted_total",
+	Help: "API requests answered with 503 because no database connection freed up in time.",
+})
+
+func init() {
+	prometheus.MustRegister(scrapePanics, sourceScrapeDuration, sourceCardsFound, sourcePricesInserted,
+		dbPoolExhausted)
+}
+
+// Database is the store with the API's handlers on top of it
+type Database struct {
+	*store.Database
+}
+
+func main() {
+	debugFlag := flag.Bool("debug", false, "log every colly request and response event while scraping")
+	debugFile := flag.String("debug-file", "", "write the -debug output to this file instead of stderr")
+	flag.Parse()
+
+	debugger, closeDebugger, err := collect.NewDebugger(*debugFlag, *debugFile)
+	if err != nil {
+		log.Fatal("Failed to set up debugger:", err)
+	}
+	defer closeDebugger()
+	collectorDebugger = debugger
+
+	log.Printf("Starting Pokemon Card Price Tracker (version %s, commit %s, built %s)...", version, commit, buildTime)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	store.SetCardImages(cfg.CardImages)
+	normalize.Configure(cfg.Normalize)
+
+	storeDB, err := store.NewDatabase(cfg.Database)
+	if err != nil {
+		log.Fatal("Failed to initialize database:", err)
+	}
+	db := &Database{storeDB}
+	defer db.Close()
+
+	store.RegisterPoolMetrics(db.Database)
+
+	// Exchange rates are fetched on first use and cached
+	rates := NewExchangeRates(cfg)
+
+	// Initialize WebSocket hub
+	hub := newHub(&cardsCache{maxAge: cfg.CardsCacheMaxAge})
+	go hub.run()
+	if cfg.WarmCache {
+		hub.warm(db, rates, cfg.MinSources)
+	}
+
+	// One scraper is shared so only one scrape runs at a time
+	scraper := NewScraper(db, hub, rates, cfg)
+
+	if cfg.DisableScheduler {
+		log.Println("Scheduler disabled by DISABLE_SCHEDULER, this instance only serves the API")
+	} else {
+		// Start periodic scraping
+		go runScheduler(scraper, cfg)
+
+		// Cards with their own scrape_interval are scraped as they come due
+		go runDueCardScrapes(scraper, cfg.ScrapeTick)
+	}
+	if cfg.DisableManualScrape {
+		log.Println("Manual scrapes disabled by DISABLE_MANUAL_SCRAPE")
+	}
+
+	// Mark or remove cards that stopped getting prices
+	go runStalePruning(db, cfg)
+
+	// Retried POSTs with the same Idempotency-Key get the first response
+	idempotency := newIdempotencyStore(cfg.IdempotencyKeyTTL, cfg.IdempotencyMaxKeys)
+	go idempotency.run()
+
+	// Setup API routes
+	r := newRouter(cfg, db, hub, rates, scraper, idempotency)
+	if err := checkOpenAPISpec(r); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	// CORS middleware
+	c := cors.New(cors.Options{
+		AllowedOrigins:   []string{"http://localhost:3000", "http://localhost:3001"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders:   []string{"*"},
+		AllowCredentials: true,
+		ExposedHeaders:   []string{"X-Request-ID", "Idempotent-Replayed", "ETag", "Content-Disposition"},
+	})
+
+	handler := withRequestID(withClientIP(cfg.TrustedProxies, c.Handler(r)))
+
+	addr := cfg.ListenAddr
+	fmt.Printf("Server starting on %s\n", addr)
+	fmt.Println("API endpoints:")
+	fmt.Println("  GET  /api/cards   - Get all cards with prices")
+	fmt.Println("  GET  /api/cards/match?name=&set=&number= - Find an existing card")
+	fmt.Println("  GET  /api/cards/compare?ids=1,2,3 - Compare up to 20 cards")
+	fmt.Println("  POST /api/cards/merge  - Merge a duplicate card into another (API key)")
+	fmt.Println("  GET  /api/cards/updates?since= - Long-poll for card changes")
+	fmt.Println("  GET  /api/cards/{id}?smooth=7d - A card with its latest prices, with a moving average")
+	fmt.Println("  PATCH /api/cards/{id} - Change some fields of a card (API key)")
+	fmt.Println("  GET  /api/cards/{id}/price?source=&date= - A card's price from a source on a date")
+	fmt.Println("  GET  /api/cards/{id}/history?smooth=7d - A card's price history per source, with a moving average")
+	fmt.Println("  GET  /api/cards/{id}/history.csv - Download a card's price history")
+	fmt.Println("  GET  /api/sets/{name}/value - What completing a set costs")
+	fmt.Println("  GET  /api/arbitrage?min_diff_pct=&limit= - Cards priced far apart by their sources")
+	fmt.Println("  POST /api/scrape  - Trigger manual scrape")
+	fmt.Println("  GET  /api/scrape/{id} - Manual scrape status and what it changed")
+	fmt.Println("  GET  /api/sources - Sources and their cooldown state")
+	fmt.Println("  GET  /api/stats?group=provider - Totals and coverage per source")
+	fmt.Println("  GET  /api/snapshots?url=&date= - A page as it was scraped (STORE_RAW_HTML)")
+	fmt.Println("  POST /api/cards/{id}/rescrape - Rescrape a single card (API key)")
+	fmt.Println("  PUT  /api/cards/{id}/scrape-interval - Set a card's own scrape interval (API key)")
+	fmt.Println("  GET  /api/convert?amount=&from=&to= - Convert between currencies")
+	fmt.Println("  POST /api/import  - Bulk import cards and prices (API key)")
+	fmt.Println("  POST /api/admin/metrics/refresh?rebuild= - Recompute change metrics (API key, GET for progress)")
+	fmt.Println("  POST /api/admin/images/rebuild - Re-apply the card image mapping (API key)")
+	fmt.Println("  GET  /api/health  - Health check")
+	fmt.Println("  GET  /api/version - Build version")
+	fmt.Println("  GET  /api/openapi.json - OpenAPI spec")
+	fmt.Println("  GET  /metrics     - Prometheus metrics")
+	fmt.Println("  WS   /ws          - WebSocket for real-time updates")
+	fmt.Println("\nDatabase configuration:")
+	fmt.Printf("  Host: %s\n", cfg.Database.Host)
+	fmt.Printf("  Port: %s\n", cfg.Database.Port)
+	fmt.Printf("  Database: %s\n", cfg.Database.Name)
+	fmt.Printf("  User: %s\n", cfg.Database.User)
+
+	log.Fatal(http.ListenAndServe(addr, handler))
+}
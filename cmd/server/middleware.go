@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"Pokemonscraper/internal/logctx"
+	"Pokemonscraper/internal/store"
+
+	"github.com/gorilla/mux"
+)
+
+// poolGuard answers API requests with 503 and Retry-After when one of their
+// queries waited timeout for a connection of an exhausted pool, instead of
+// letting them queue up behind the busy connections
+func poolGuard(timeout time.Duration) mux.MiddlewareFunc {
+	retryAfter := strconv.Itoa(max(1, int(math.Ceil(timeout.Seconds()))))
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			guard := &store.AcquireGuard{Timeout: timeout}
+			gw := &poolGuardWriter{ResponseWriter: w, guard: guard, retryAfter: retryAfter, r: r}
+			next.ServeHTTP(gw, r.WithContext(store.WithAcquireGuard(r.Context(), guard)))
+		})
+	}
+}
+
+// poolGuardWriter replaces the error response of a handler whose query
+// couldn't get a connection with a 503
+type poolGuardWriter struct {
+	http.ResponseWriter
+	guard      *store.AcquireGuard
+	retryAfter string
+	r          *http.Request
+	wrote      bool
+	replaced   bool
+}
+
+func (w *poolGuardWriter) WriteHeader(status int) {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	if status < http.StatusInternalServerError || !w.guard.Exhausted() {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	logctx.Printf(w.r.Context(), "Database pool exhausted, answering 503 instead of %d", status)
+	dbPoolExhausted.Inc()
+	w.replaced = true
+	header := w.ResponseWriter.Header()
+	header.Set("Retry-After", w.retryAfter)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Del("Content-Length")
+	w.ResponseWriter.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(w.ResponseWriter, "the database is busy, try again shortly")
+}
+
+func (w *poolGuardWriter) Write(b []byte) (int, error) {
+	if !w.wrote {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		// the handler's error message is dropped for the 503's
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *poolGuardWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// validRequestID limits the X-Request-ID values we accept from clients, so a
+// header can't inject anything into the logs
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// withRequestID tags every request with a correlation ID, taken from the
+// X-Request-ID header or generated, stores it in the request context for
+// logctx.Printf and echoes it back in the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = newUUID()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(logctx.WithRequestID(r.Context(), id)))
+	})
+}
+
+// requireAPIKey only lets requests through that carry apiKey in the
+// X-API-Key header. Without API_KEY set the protected endpoints are disabled.
+func requireAPIKey(apiKey string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiKey == "" {
+			http.Error(w, "this endpoint is disabled, set API_KEY to enable it", http.StatusServiceUnavailable)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(apiKey)) != 1 {
+			http.Error(w, "invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// handleNotFound replaces mux's plain text 404 and 405. mux only reports a
+// wrong method when the route with the path comes last among the ones it
+// tried, so the methods the path allows are looked up here either way.
+func handleNotFound(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := allowedMethods(router, r.URL.Path)
+		if len(allowed) == 0 {
+			writeJSONError(w, http.StatusNotFound, "no route for "+r.URL.Path)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeJSONError(w, http.StatusMethodNotAllowed, r.Method+" is not allowed on "+r.URL.Path)
+	}
+}
+
+// allowedMethods returns the methods of the router's routes matching path
+func allowedMethods(router *mux.Router, path string) []string {
+	var allowed []string
+	router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		pattern, err := route.GetPathRegexp()
+		if err != nil {
+			return nil
+		}
+		if matched, _ := regexp.MatchString(pattern, path); matched {
+			for _, method := range methods {
+				if !slices.Contains(allowed, method) {
+					allowed = append(allowed, method)
+				}
+			}
+		}
+		return nil
+	})
+	return allowed
+}
+
+// openAPISpec is the hand-written OpenAPI 3 document for the /api routes.
+// checkOpenAPISpec warns at startup about routes it doesn't describe.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func handleOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
+
+// routeVariable matches a mux path variable such as {id:[0-9]+}
+var routeVariable = regexp.MustCompile(`\{(\w+)(:[^}]*)?\}`)
+
+// checkOpenAPISpec logs every /api route and method registered on the router
+// that openapi.json doesn't document, so the spec doesn't silently drift
+func checkOpenAPISpec(router *mux.Router) error {
+	undocumented, err := undocumentedRoutes(router)
+	for _, route := range undocumented {
+		log.Printf("Warning: %s is not documented in openapi.json", route)
+	}
+	return err
+}
+
+// undocumentedRoutes returns the /api routes registered on the router that
+// openapi.json doesn't document, as "METHOD /path"
+func undocumentedRoutes(router *mux.Router) ([]string, error) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		return nil, fmt.Errorf("invalid openapi.json: %v", err)
+	}
+
+	var undocumented []string
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil || !strings.HasPrefix(template, "/api/") {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		path := routeVariable.ReplaceAllString(template, "{$1}")
+		for _, method := range methods {
+			if _, ok := spec.Paths[path][strings.ToLower(method)]; !ok {
+				undocumented = append(undocumented, method+" "+path)
+			}
+		}
+		return nil
+	})
+	return undocumented, err
+}
+
+// newRouter registers the WebSocket, metrics and /api routes
+func newRouter(cfg *Config, db *Database, hub *Hub, rates *ExchangeRates, scraper *Scraper,
+	idempotency *idempotencyStore) *mux.Router {
+	r := mux.NewRouter()
+
+	// Prometheus metrics
+	r.Handle("/metrics", promhttp.Handler())
+
+	// WebSocket endpoint
+	upgrader := newUpgrader(cfg.WSCompression)
+	r.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		handleWebSocket(hub, upgrader, w, r)
+	})
+
+	// API routes
+	api := r.PathPrefix("/api").Subrouter()
+
+	// Unknown routes and wrong methods answer in JSON like the API does
+	for _, router := range []*mux.Router{r, api} {
+		router.NotFoundHandler = handleNotFound(r)
+		router.MethodNotAllowedHandler = handleNotFound(r)
+	}
+
+	// Requests get a 503 instead of hanging while the pool is exhausted
+	if cfg.DBAcquireTimeout > 0 {
+		api.Use(poolGuard(cfg.DBAcquireTimeout))
+	}
+
+	api.HandleFunc("/cards", db.handleGetCards(cfg, rates, hub.cache)).Methods("GET")
+	api.HandleFunc("/cards/match", db.handleMatchCard).Methods("GET")
+	api.HandleFunc("/cards/compare", db.handleCompareCards(rates)).Methods("GET")
+	api.HandleFunc("/cards/merge", requireAPIKey(cfg.APIKey, idempotent(idempotency, db.handleMergeCards(rates)))).Methods("POST")
+	api.HandleFunc("/cards/updates", handleCardUpdates(hub, cfg.LongPollTimeout)).Methods("GET")
+	api.HandleFunc("/cards/{id:[0-9]+}", db.handleGetCard(rates)).Methods("GET")
+	api.HandleFunc("/cards/{id:[0-9]+}", requireAPIKey(cfg.APIKey, db.handlePatchCard(rates))).Methods("PATCH")
+	api.HandleFunc("/cards/{id:[0-9]+}/price", db.handleGetPriceAt).Methods("GET")
+	api.HandleFunc("/cards/{id:[0-9]+}/history", db.handleGetHistory).Methods("GET")
+	api.HandleFunc("/cards/{id:[0-9]+}/history.csv", db.handleGetHistoryCSV).Methods("GET")
+	api.HandleFunc("/sets/{name}/value", db.handleGetSetValue(rates)).Methods("GET")
+	api.HandleFunc("/arbitrage", db.handleGetArbitrage(rates)).Methods("GET")
+	api.HandleFunc("/convert", handleConvert(rates)).Methods("GET")
+	api.HandleFunc("/import", requireAPIKey(cfg.APIKey, idempotent(idempotency, db.handleImport(cfg.ImportMaxItems)))).Methods("POST")
+	jobs := newScrapeJobs(scraper)
+	api.HandleFunc("/scrape", idempotent(idempotency, handleScrapeNow(jobs, cfg.DisableManualScrape))).Methods("POST")
+	api.HandleFunc("/scrape/{id}", handleScrapeJob(jobs)).Methods("GET")
+	api.HandleFunc("/sources", handleSources(scraper)).Methods("GET")
+	api.HandleFunc("/stats", handleStats(scraper)).Methods("GET")
+	api.HandleFunc("/snapshots", db.handleGetSnapshot).Methods("GET")
+	api.HandleFunc("/cards/{id:[0-9]+}/rescrape", requireAPIKey(cfg.APIKey, idempotent(idempotency, handleRescrapeCard(scraper)))).Methods("POST")
+	api.HandleFunc("/cards/{id:[0-9]+}/scrape-interval", requireAPIKey(cfg.APIKey, db.handleSetScrapeInterval)).Methods("PUT")
+
+	// Change metrics backfill
+	refresher := newMetricsRefresher(db)
+	api.HandleFunc("/admin/metrics/refresh", requireAPIKey(cfg.APIKey, handleRefreshMetrics(refresher))).Methods("POST")
+	api.HandleFunc("/admin/metrics/refresh", requireAPIKey(cfg.APIKey, handleMetricsRefreshStatus(refresher))).Methods("GET")
+	api.HandleFunc("/admin/images/rebuild", requireAPIKey(cfg.APIKey, db.handleRebuildImages(cfg.CardImagesFile))).Methods("POST")
+
+	// Health check endpoint
+	api.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "healthy",
+			"time":   time.Now().Format(time.RFC3339),
+		})
+	}).Methods("GET")
+
+	// Version endpoint
+	api.HandleFunc("/version", handleVersion).Methods("GET")
+
+	// API contract
+	api.HandleFunc("/openapi.json", handleOpenAPISpec).Methods("GET")
+	return r
+}
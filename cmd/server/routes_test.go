@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testRouter builds the server's router without a database behind it,
+// for tests that only look at the routes
+func testRouter(t *testing.T) *mux.Router {
+	t.Helper()
+	cfg := &Config{}
+	db := &Database{}
+	hub := newHub(&cardsCache{})
+	rates := NewExchangeRates(cfg)
+	return newRouter(cfg, db, hub, rates, NewScraper(db, hub, rates, cfg), newIdempotencyStore(time.Hour, 10))
+}
+
+func TestEveryRouteIsDocumented(t *testing.T) {
+	undocumented, err := undocumentedRoutes(testRouter(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range undocumented {
+		t.Errorf("%s is not documented in openapi.json", route)
+	}
+}
+
+func TestUnknownRoutesAnswerJSON(t *testing.T) {
+	router := testRouter(t)
+
+	tests := []struct {
+		method, path string
+		status       int
+		allow        string
+	}{
+		{"GET", "/api/nope", http.StatusNotFound, ""},
+		{"GET", "/nope", http.StatusNotFound, ""},
+		{"GET", "/api/cards/abc", http.StatusNotFound, ""},
+		{"DELETE", "/api/cards/1/rescrape", http.StatusMethodNotAllowed, "POST"},
+		{"POST", "/api/health", http.StatusMethodNotAllowed, "GET"},
+		{"PUT", "/api/admin/metrics/refresh", http.StatusMethodNotAllowed, "POST, GET"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+
+		if w.Code != test.status {
+			t.Errorf("%s %s answered %d, want %d", test.method, test.path, w.Code, test.status)
+		}
+		if got := w.Header().Get("Allow"); got != test.allow {
+			t.Errorf("%s %s has Allow %q, want %q", test.method, test.path, got, test.allow)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("%s %s has Content-Type %q, want application/json", test.method, test.path, got)
+		}
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == "" {
+			t.Errorf("%s %s body %q isn't a JSON error", test.method, test.path, w.Body.String())
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"Pokemonscraper/internal/logctx"
+
+	"github.com/gorilla/mux"
+)
+
+// ScrapeJob is the status of a scrape started with POST /api/scrape
+type ScrapeJob struct {
+	ID    string      `json:"id"`
+	State string      `json:"state"` // running, done or failed
+	Error string      `json:"error,omitempty"`
+	Diff  *ScrapeDiff `json:"diff,omitempty"`
+	// Result is set once the job finished, failed scrapes included
+	Result     *ScrapeResult `json:"result,omitempty"`
+	StartedAt  time.Time     `json:"started_at"`
+	FinishedAt *time.Time    `json:"finished_at,omitempty"`
+}
+
+// maxScrapeJobs is how many finished jobs are kept for polling
+const maxScrapeJobs = 20
+
+// scrapeJobs keeps the status of the most recent manual scrapes
+type scrapeJobs struct {
+	scraper *Scraper
+	mu      sync.Mutex
+	jobs    map[string]*ScrapeJob
+	order   []string
+}
+
+func newScrapeJobs(scraper *Scraper) *scrapeJobs {
+	return &scrapeJobs{scraper: scraper, jobs: make(map[string]*ScrapeJob)}
+}
+
+// Start runs a scrape in the background and returns its job. It returns
+// false without starting one while another scrape is running.
+func (j *scrapeJobs) Start(ctx context.Context) (ScrapeJob, bool) {
+	// taken here rather than in the goroutine, so the caller learns that
+	// the scrape couldn't start
+	if !j.scraper.running.TryLock() {
+		return ScrapeJob{}, false
+	}
+	job := &ScrapeJob{ID: newUUID(), State: "running", StartedAt: time.Now()}
+
+	j.mu.Lock()
+	j.jobs[job.ID] = job
+	j.order = append(j.order, job.ID)
+	if len(j.order) > maxScrapeJobs {
+		delete(j.jobs, j.order[0])
+		j.order = j.order[1:]
+	}
+	status := *job
+	j.mu.Unlock()
+
+	go func() {
+		defer j.scraper.running.Unlock()
+
+		var result ScrapeResult
+		err := recoverScrape("manual", func() (err error) {
+			result, err = j.scraper.scrapeHeld(false)
+			return err
+		})
+
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		now := time.Now()
+		job.FinishedAt = &now
+		job.Result = &result
+		if err != nil {
+			logctx.Printf(ctx, "Manual scrape failed: %v", err)
+			job.State = "failed"
+			job.Error = err.Error()
+			return
+		}
+		logctx.Printf(ctx, "Manual scrape done: %s, %d notable moves", result, len(result.Diff.NotableMoves))
+		job.State = "done"
+		job.Diff = &result.Diff
+	}()
+	return status, true
+}
+
+// Get returns the job's current status
+func (j *scrapeJobs) Get(id string) (ScrapeJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job, ok := j.jobs[id]
+	if !ok {
+		return ScrapeJob{}, false
+	}
+	return *job, true
+}
+
+func handleScrapeNow(jobs *scrapeJobs, disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if disabled {
+			http.Error(w, "manual scrapes are disabled on this instance", http.StatusServiceUnavailable)
+			return
+		}
+		// the request's context ends with the response, only its ID is kept
+		job, started := jobs.Start(logctx.WithRequestID(context.Background(), logctx.RequestID(r.Context())))
+		if !started {
+			http.Error(w, errScrapeInProgress.Error(), http.StatusConflict)
+			return
+		}
+		logctx.Printf(r.Context(), "Manual scrape triggered via API")
+
+		w.Header().Set("Content-Type", "application/json")
+		response := map[string]interface{}{
+			"status":    "scraping started",
+			"timestamp": time.Now().Format(time.RFC3339),
+			"job_id":    job.ID,
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// handleScrapeJob returns a manual scrape's status, with what it changed
+// once it is done
+func handleScrapeJob(jobs *scrapeJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		job, ok := jobs.Get(mux.Vars(r)["id"])
+		if !ok {
+			http.Error(w, "scrape job not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScrapeNowConflictsWithRunningScrape(t *testing.T) {
+	scraper := &Scraper{}
+	scraper.running.Lock()
+	defer scraper.running.Unlock()
+	jobs := newScrapeJobs(scraper)
+
+	rec := httptest.NewRecorder()
+	handleScrapeNow(jobs, false)(rec, httptest.NewRequest("POST", "/api/scrape", nil))
+
+	if rec.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusConflict)
+	}
+	if len(jobs.jobs) != 0 {
+		t.Errorf("%d jobs recorded, want none", len(jobs.jobs))
+	}
+}
@@ -0,0 +1,1289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	runtimedebug "runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"Pokemonscraper/internal/collect"
+	"Pokemonscraper/internal/logctx"
+	"Pokemonscraper/internal/normalize"
+	"Pokemonscraper/internal/store"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly/v2"
+	"github.com/gocolly/colly/v2/debug"
+)
+
+// runStalePruning runs PruneStaleCards every PruneInterval when
+// PRUNE_STALE_CARDS=true. STALE_CARD_AGE sets the age, PRUNE_MODE=delete
+// removes the cards instead of marking them.
+func runStalePruning(db *Database, cfg *Config) {
+	if !cfg.PruneStaleCards {
+		return
+	}
+	maxAge, interval, remove := cfg.StaleCardAge, cfg.PruneInterval, cfg.PruneRemove
+
+	log.Printf("Pruning cards without prices newer than %s every %s (remove: %t)", maxAge, interval, remove)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pruned, err := db.PruneStaleCards(maxAge, remove)
+		if err != nil {
+			log.Printf("Stale card pruning failed: %v", err)
+		}
+
+		action := "Marked stale"
+		if remove {
+			action = "Removed"
+		}
+		for _, card := range pruned {
+			log.Printf("%s card: %s (%s, ID: %d)", action, card.Name, card.SetName, card.ID)
+		}
+		if len(pruned) > 0 {
+			log.Printf("%s %d cards", action, len(pruned))
+		}
+
+		<-ticker.C
+	}
+}
+
+// WebhookPayload is POSTed to WEBHOOK_URL after every scrape
+type WebhookPayload struct {
+	Event          string                  `json:"event"`
+	CardsUpdated   int                     `json:"cards_updated"`
+	CardsFound     int                     `json:"cards_found"`
+	PricesInserted int                     `json:"prices_inserted"`
+	Sources        map[string]SourceResult `json:"sources"`
+	DurationMS     int64                   `json:"duration_ms"`
+	Errors         []string                `json:"errors"`
+	FinishedAt     time.Time               `json:"finished_at"`
+}
+
+// Webhook posts scrape summaries to an HTTP endpoint. With a secret set the
+// body is signed with HMAC-SHA256 in the X-Webhook-Signature header as
+// "sha256=<hex>".
+type Webhook struct {
+	url     string
+	secret  string
+	client  *http.Client
+	retries int
+}
+
+// newWebhook returns nil when url is empty, Notify on a nil Webhook is a no-op
+func newWebhook(url, secret string) *Webhook {
+	if url == "" {
+		return nil
+	}
+	if secret == "" {
+		log.Println("Warning: WEBHOOK_SECRET is not set, webhook requests won't be signed")
+	}
+	return &Webhook{
+		url:     url,
+		secret:  secret,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		retries: 3,
+	}
+}
+
+// Notify sends the payload in the background so a slow endpoint doesn't
+// hold up the scraper
+func (wh *Webhook) Notify(payload WebhookPayload) {
+	if wh == nil {
+		return
+	}
+	if payload.Errors == nil {
+		payload.Errors = []string{}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshaling webhook payload: %v", err)
+		return
+	}
+
+	go func() {
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err := wh.send(body)
+			if err == nil {
+				log.Printf("Webhook delivered (%s)", payload.Event)
+				return
+			}
+			if attempt > wh.retries {
+				log.Printf("Webhook failed after %d attempts: %v", attempt, err)
+				return
+			}
+
+			log.Printf("Webhook attempt %d failed, retrying in %s: %v", attempt, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}()
+}
+
+func (wh *Webhook) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.secret))
+		mac.Write(body)
+		req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// collectorDebugger is attached to the scrape collectors when -debug is set
+var collectorDebugger debug.Debugger
+
+type Scraper struct {
+	db      *Database
+	hub     *Hub
+	rates   *ExchangeRates
+	sources []Source
+	webhook *Webhook
+	health  *sourceHealth
+	cfg     *Config
+
+	// pageHashes keeps the hashes of watchPageChanges, the database outside
+	// of tests
+	pageHashes pageHashStore
+
+	// running makes sure only one scrape runs at a time
+	running sync.Mutex
+	// lastCardCounts are the cards each source found in its last good
+	// full scrape, guarded by running
+	lastCardCounts map[string]int
+}
+
+var errScrapeInProgress = errors.New("a scrape is already in progress")
+
+var errPossibleBreakage = errors.New("possible breakage, the results were not stored")
+
+// checkCardCount compares the cards a source found with its last good full
+// scrape. Fewer than MIN_CARDS_PERCENT of them most likely means the site
+// changed and the parsing broke, so the caller keeps the last good data
+// instead of storing them. Otherwise the count is the new baseline. The
+// caller holds s.running.
+func (s *Scraper) checkCardCount(name string, found int) error {
+	last, ok := s.lastCardCounts[name]
+	if ok && s.cfg.MinCardsPercent > 0 && float64(found) < float64(last)*s.cfg.MinCardsPercent/100 {
+		return fmt.Errorf("%w: %d cards found, %d in the last good scrape", errPossibleBreakage, found, last)
+	}
+	s.lastCardCounts[name] = found
+	return nil
+}
+
+func NewScraper(db *Database, hub *Hub, rates *ExchangeRates, cfg *Config) *Scraper {
+	sources := configuredSources(cfg)
+	return &Scraper{
+		db:      db,
+		hub:     hub,
+		rates:   rates,
+		sources: sources,
+		webhook: newWebhook(cfg.WebhookURL, cfg.WebhookSecret),
+		health:  newSourceHealth(sources, cfg.SourceFailureThreshold, cfg.SourceCooldown),
+		cfg:     cfg,
+
+		pageHashes:     db,
+		lastCardCounts: make(map[string]int),
+	}
+}
+
+// SourceStatus is a source's cooldown state as reported by /api/sources
+type SourceStatus struct {
+	Name                string     `json:"name"`
+	Enabled             bool       `json:"enabled"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	DisabledUntil       *time.Time `json:"disabled_until,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+}
+
+// sourceHealth tracks consecutive failures per source. A source that fails
+// SOURCE_FAILURE_THRESHOLD runs in a row (default 3) is skipped for
+// SOURCE_COOLDOWN (default 1h), so a source that blocks us isn't hit again
+// every cycle.
+type sourceHealth struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	names     []string
+	statuses  map[string]*SourceStatus
+}
+
+func newSourceHealth(sources []Source, threshold int, cooldown time.Duration) *sourceHealth {
+	h := &sourceHealth{threshold: threshold, cooldown: cooldown, statuses: make(map[string]*SourceStatus)}
+	for _, source := range sources {
+		h.names = append(h.names, source.Name())
+		h.statuses[source.Name()] = &SourceStatus{Name: source.Name(), Enabled: true}
+	}
+	return h
+}
+
+// available reports whether the source may be scraped, re-enabling it once
+// its cooldown is over
+func (h *sourceHealth) available(name string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status, ok := h.statuses[name]
+	if !ok || status.DisabledUntil == nil {
+		return true
+	}
+	if time.Now().Before(*status.DisabledUntil) {
+		return false
+	}
+
+	log.Printf("Cooldown of %s is over, enabling it again", name)
+	status.DisabledUntil = nil
+	status.Enabled = true
+	status.ConsecutiveFailures = 0
+	return true
+}
+
+// record notes the outcome of a source run, err nil being a success
+func (h *sourceHealth) record(name string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status, ok := h.statuses[name]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+	if err == nil {
+		status.ConsecutiveFailures = 0
+		status.LastSuccess = &now
+		return
+	}
+
+	status.ConsecutiveFailures++
+	status.LastError = err.Error()
+	if status.ConsecutiveFailures >= h.threshold {
+		until := now.Add(h.cooldown)
+		status.DisabledUntil = &until
+		status.Enabled = false
+		log.Printf("Disabling %s until %s after %d consecutive failures, last: %v",
+			name, until.Format(time.RFC3339), status.ConsecutiveFailures, err)
+	}
+}
+
+// Statuses returns a snapshot of every source's state, in source order
+func (h *sourceHealth) Statuses() []SourceStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	statuses := make([]SourceStatus, 0, len(h.names))
+	for _, name := range h.names {
+		status := *h.statuses[name]
+		status.Enabled = status.DisabledUntil == nil || !time.Now().Before(*status.DisabledUntil)
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+var errSourceTimeout = errors.New("source timed out")
+
+// sourceTimeout is the source's SOURCE_TIMEOUTS entry, or SOURCE_TIMEOUT
+func (s *Scraper) sourceTimeout(name string) time.Duration {
+	if timeout, ok := s.cfg.SourceTimeouts[strings.ToLower(name)]; ok {
+		return timeout
+	}
+	return s.cfg.SourceTimeout
+}
+
+// sourceOutcome is what a source's scrape returned
+type sourceOutcome struct {
+	results []ScrapedCard
+	err     error
+}
+
+// runSource scrapes one source with scrape and records the outcome in the
+// source's health. A run that got 403 or 429 responses counts as failed
+// even when the source returned no error, as that is how a block starts.
+// With skipUnchanged, pages that didn't change since the last run aren't
+// parsed, and pages holds what watchPageChanges found. The run's duration
+// and card count go to the per-source metrics.
+//
+// A source that takes longer than its timeout is abandoned with
+// errSourceTimeout and its results are dropped, so a hung site can't stall
+// the other sources. Its pending requests are canceled.
+func (s *Scraper) runSource(c *colly.Collector, source Source, skipUnchanged bool, scrape func(*colly.Collector) ([]ScrapedCard, error)) (results []ScrapedCard, pages *pageChanges, err error) {
+	start := time.Now()
+	timeout := s.sourceTimeout(source.Name())
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	sc := s.sourceCollector(c, source)
+	sc.Context = ctx
+	pages = newPageChanges()
+	if skipUnchanged {
+		s.watchPageChanges(sc, pages)
+	}
+	blockedStatus := 0
+	sc.OnError(func(r *colly.Response, err error) {
+		if r.StatusCode == http.StatusForbidden || r.StatusCode == http.StatusTooManyRequests {
+			blockedStatus = r.StatusCode
+		}
+	})
+
+	// the scrape runs on its own goroutine so it can be abandoned, which
+	// also puts it outside the caller's recoverScrape
+	done := make(chan sourceOutcome, 1)
+	go func() {
+		var outcome sourceOutcome
+		outcome.err = recoverScrape(source.Name(), func() (err error) {
+			outcome.results, err = scrape(sc)
+			return err
+		})
+		done <- outcome
+	}()
+
+	select {
+	case outcome := <-done:
+		results, err = outcome.results, outcome.err
+	case <-ctx.Done():
+	}
+	if ctx.Err() != nil {
+		// requests canceled by the deadline may have let the scrape finish
+		// early with whatever it had, that doesn't count either
+		log.Printf("Abandoning %s, it didn't finish within %s", source.Name(), timeout)
+		sourceScrapeDuration.WithLabelValues(source.Name()).Observe(time.Since(start).Seconds())
+		err = fmt.Errorf("%w after %s", errSourceTimeout, timeout)
+		s.health.record(source.Name(), err)
+		return nil, pages, err
+	}
+	sourceScrapeDuration.WithLabelValues(source.Name()).Observe(time.Since(start).Seconds())
+	sourceCardsFound.WithLabelValues(source.Name()).Add(float64(len(results)))
+
+	// sources leave the currency empty when the price had no symbol
+	currency := normalize.SourceCurrency(source.Name())
+	for i := range results {
+		if results[i].Price.Currency == "" {
+			results[i].Price.Currency = currency
+		}
+	}
+
+	if err == nil && blockedStatus != 0 {
+		log.Printf("%s answered with HTTP %d, it may be blocking us", source.Name(), blockedStatus)
+		s.health.record(source.Name(), fmt.Errorf("blocked with HTTP %d", blockedStatus))
+		return results, pages, nil
+	}
+	s.health.record(source.Name(), err)
+	return results, pages, err
+}
+
+// pageContentHash hashes the part of a page the sources parse: the tables
+// of an HTML page, or the whole body when it has none or isn't HTML
+func pageContentHash(r *colly.Response) string {
+	content := r.Body
+	if strings.Contains(strings.ToLower(r.Headers.Get("Content-Type")), "html") {
+		if doc, err := goquery.NewDocumentFromReader(bytes.NewReader(r.Body)); err == nil {
+			var tables bytes.Buffer
+			doc.Find("table").Each(func(_ int, table *goquery.Selection) {
+				if html, err := goquery.OuterHtml(table); err == nil {
+					tables.WriteString(html)
+				}
+			})
+			if tables.Len() > 0 {
+				content = tables.Bytes()
+			}
+		}
+	}
+
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// pageUnchangedKey is the request context key watchPageChanges marks an
+// unchanged page with. Requests from e.Request.Visit share their parent's
+// context, hence the URL in the key.
+func pageUnchangedKey(pageURL string) string { return "page_unchanged:" + pageURL }
+
+// pageUnchanged reports whether watchPageChanges found the page unchanged.
+// The sources' handlers that parse prices skip such pages, the ones that
+// follow pagination still run so the pages after it are checked too.
+func pageUnchanged(r *colly.Response) bool {
+	return r.Ctx.Get(pageUnchangedKey(r.Request.URL.String())) != ""
+}
+
+// pageHashStore keeps the content hash of each page and when it was last
+// parsed
+type pageHashStore interface {
+	PageHash(ctx context.Context, pageURL string) (string, time.Time, bool, error)
+	SavePageHash(ctx context.Context, pageURL, hash string) error
+}
+
+// pageChanges is what watchPageChanges found on a source's run: how many
+// pages were skipped as unchanged, and the new hashes of the pages parsed
+type pageChanges struct {
+	unchanged atomic.Int64
+
+	// mu guards fetched and parsed, pages are fetched in parallel
+	mu      sync.Mutex
+	fetched map[string]string
+	parsed  map[string]string
+}
+
+func newPageChanges() *pageChanges {
+	return &pageChanges{
+		fetched: make(map[string]string),
+		parsed:  make(map[string]string),
+	}
+}
+
+// watchPageChanges makes sc skip parsing pages whose content hash matches
+// the one stored on the last run: they are marked for pageUnchanged before
+// the sources' callbacks see them, and counted in pages. The new hashes of
+// the pages parsed are kept in pages too, savePageHashes stores them once
+// the run's results are.
+// Unchanged pages are still parsed once their hash is older than
+// PAGE_HASH_MAX_AGE, so their cards keep getting fresh prices and don't go
+// stale.
+func (s *Scraper) watchPageChanges(sc *colly.Collector, pages *pageChanges) {
+	maxAge := s.cfg.PageHashMaxAge
+
+	sc.OnResponse(func(r *colly.Response) {
+		pageURL := r.Request.URL.String()
+		hash := pageContentHash(r)
+
+		stored, parsedAt, found, err := s.pageHashes.PageHash(context.Background(), pageURL)
+		if err != nil {
+			log.Printf("Error loading page hash of %s: %v", pageURL, err)
+			return
+		}
+		if found && stored == hash && time.Since(parsedAt) < maxAge {
+			log.Printf("No change on %s since %s, skipping it", pageURL, parsedAt.Format(time.RFC3339))
+			r.Ctx.Put(pageUnchangedKey(pageURL), "true")
+			pages.unchanged.Add(1)
+			return
+		}
+		pages.mu.Lock()
+		pages.fetched[pageURL] = hash
+		pages.mu.Unlock()
+	})
+
+	sc.OnScraped(func(r *colly.Response) {
+		pageURL := r.Request.URL.String()
+		pages.mu.Lock()
+		defer pages.mu.Unlock()
+		if hash, ok := pages.fetched[pageURL]; ok {
+			delete(pages.fetched, pageURL)
+			pages.parsed[pageURL] = hash
+		}
+	})
+}
+
+// savePageHashes stores the hashes of the pages a run parsed. Results that
+// weren't stored must not be skipped next time, so the caller only saves
+// them once the run's results are stored.
+func (s *Scraper) savePageHashes(pages *pageChanges) {
+	pages.mu.Lock()
+	defer pages.mu.Unlock()
+	for pageURL, hash := range pages.parsed {
+		if err := s.pageHashes.SavePageHash(context.Background(), pageURL, hash); err != nil {
+			log.Printf("Error saving page hash of %s: %v", pageURL, err)
+		}
+	}
+}
+
+// ScrapedCard is a card and its price as found on a source, before it is
+// stored. Price.CardID is filled in on insert.
+type ScrapedCard struct {
+	Card  store.Card
+	Price store.Price
+}
+
+// Source is a site the scraper collects prices from. Scrape gets its own
+// clone of the shared collector, so rate limits and the user agent apply.
+type Source interface {
+	Name() string
+	Scrape(c *colly.Collector) ([]ScrapedCard, error)
+}
+
+// QuerySource is a Source that can also search for a single card, used to
+// rescrape one card without scraping the whole set
+type QuerySource interface {
+	Source
+	ScrapeQuery(c *colly.Collector, query string) ([]ScrapedCard, error)
+}
+
+// configuredSources returns the sources to scrape. A JSON source replaces
+// the TCGPlayer and PriceCharting search pages when JSON_SOURCE_URL is set.
+func configuredSources(cfg *Config) []Source {
+	var sources []Source
+	if cfg.JSONSourceURL != "" {
+		sources = append(sources, &JSONSource{
+			SourceName: cfg.JSONSourceName,
+			URL:        cfg.JSONSourceURL,
+			Region:     cfg.JSONSourceRegion,
+		})
+	} else {
+		// off by default, their selectors break whenever the sites change
+		// their layout
+		if cfg.ScrapeTCGPlayer {
+			sources = append(sources, tcgPlayerSource{})
+		}
+		if cfg.ScrapePriceCharting {
+			sources = append(sources, priceChartingSource{Headers: cfg.PriceColumnHeaders})
+		}
+	}
+
+	// Grade tables come from individual product pages
+	if len(cfg.PriceChartingProductURLs) > 0 {
+		sources = append(sources, priceChartingGradesSource{URLs: cfg.PriceChartingProductURLs})
+	}
+
+	if cfg.ScrapeSealed {
+		sources = append(sources, priceChartingSealedSource{Queries: cfg.SealedQueries, Headers: cfg.PriceColumnHeaders})
+	}
+
+	for _, spec := range cfg.GenericSources {
+		sources = append(sources, GenericSource{Spec: spec})
+	}
+	return sources
+}
+
+// FetchFunc fetches a page and returns its HTML
+type FetchFunc func(ctx context.Context, pageURL string) ([]byte, error)
+
+// fetchers are the ways a source's pages can be fetched, picked per source
+// with SOURCE_FETCHERS="TCGPlayer=chromedp,...", each building its FetchFunc
+// from the config. "colly" is the collector's own HTTP client and the
+// default; "chromedp" renders the page in a headless browser and is only
+// available in builds with -tags chromedp.
+var fetchers = map[string]func(cfg *Config) FetchFunc{
+	"colly": nil,
+}
+
+// sourceFetcher returns the FetchFunc configured for the source, or nil to
+// fetch with colly. LoadConfig already rejected fetchers missing from this
+// build.
+func (s *Scraper) sourceFetcher(sourceName string) FetchFunc {
+	newFetch := fetchers[s.cfg.SourceFetchers[strings.ToLower(sourceName)]]
+	if newFetch == nil {
+		return nil
+	}
+	return newFetch(s.cfg)
+}
+
+// fetchTransport answers colly's GET requests with a FetchFunc, so rendered
+// HTML goes through the sources' usual OnHTML handlers
+type fetchTransport struct {
+	fetch FetchFunc
+}
+
+func (t fetchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+
+	body, err := t.fetch(req.Context(), req.URL.String())
+	if err != nil {
+		return nil, err
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/html; charset=utf-8"}},
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// newCollector returns the collector every scrape starts from, with the rate
+// limits and user agent the sources expect
+func (s *Scraper) newCollector() *colly.Collector {
+	c := colly.NewCollector()
+	if collectorDebugger != nil {
+		c.SetDebugger(collectorDebugger)
+	}
+
+	c.Limit(&colly.LimitRule{
+		DomainGlob:  "*",
+		Parallelism: 2,
+		Delay:       2 * time.Second,
+	})
+
+	c.UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"
+	return c
+}
+
+// sourceCollector clones c for one source. Callbacks aren't cloned, so the
+// shared ones are registered here.
+func (s *Scraper) sourceCollector(c *colly.Collector, source Source) *colly.Collector {
+	sc := c.Clone()
+	if fetch := s.sourceFetcher(source.Name()); fetch != nil {
+		// clones share c's HTTP client, so the transport goes on a collector
+		// of its own
+		sc = s.newCollector()
+		sc.WithTransport(fetchTransport{fetch: fetch})
+	}
+
+	// the snapshot is taken before transcoding, and before
+	// watchPageChanges empties unchanged pages
+	if s.cfg.StoreRawHTML {
+		sc.OnResponse(s.saveSnapshot)
+	}
+
+	// Sources like Cardmarket price by region based on Accept-Language
+	if acceptLanguage := s.cfg.AcceptLanguage; acceptLanguage != "" {
+		sc.OnRequest(func(r *colly.Request) {
+			r.Headers.Set("Accept-Language", acceptLanguage)
+		})
+	}
+
+	sc.OnResponse(collect.TranscodeResponse)
+	return sc
+}
+
+// saveSnapshot stores the raw body of a scraped page for STORE_RAW_HTML
+func (s *Scraper) saveSnapshot(r *colly.Response) {
+	pageURL := r.Request.URL.String()
+	if err := s.db.SaveSnapshot(context.Background(), pageURL, r.Headers.Get("Content-Type"), r.Body); err != nil {
+		log.Printf("Error saving snapshot of %s: %v", pageURL, err)
+	}
+}
+
+// ScrapePrices scrapes every source and stores all the prices found. A
+// source failing doesn't fail the scrape, it is reported in the result's
+// PerSource and Errors. The error is for scrapes that couldn't run or
+// finish at all.
+func (s *Scraper) ScrapePrices() (ScrapeResult, error) {
+	return s.scrapeAll(false)
+}
+
+// ScrapeResult sums up a scrape of every source
+type ScrapeResult struct {
+	CardsFound     int
+	PricesInserted int
+	Duration       time.Duration
+	PerSource      map[string]SourceResult
+	Errors         []error
+	// Diff is what the scrape changed
+	Diff ScrapeDiff
+}
+
+// SourceResult is one source's part of a ScrapeResult
+type SourceResult struct {
+	CardsFound     int
+	PricesInserted int
+	Duration       time.Duration
+	// Skipped is set when the source was cooling down and not scraped
+	Skipped bool
+	// TimedOut is set when the source was abandoned after SOURCE_TIMEOUT
+	TimedOut bool
+	// Suspect is set when the source found too few cards compared to its
+	// last good scrape, and they weren't stored
+	Suspect bool
+	Err     error
+}
+
+// String sums the result up for the log
+func (r ScrapeResult) String() string {
+	return fmt.Sprintf("%d cards found, %d prices inserted, %d new cards in %s with %d errors",
+		r.CardsFound, r.PricesInserted, r.Diff.NewCards, r.Duration.Round(time.Millisecond), len(r.Errors))
+}
+
+// errorStrings returns the errors' messages, never nil so they encode as []
+func errorStrings(errs []error) []string {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return messages
+}
+
+func (r ScrapeResult) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		CardsFound     int                     `json:"cards_found"`
+		PricesInserted int                     `json:"prices_inserted"`
+		DurationMS     int64                   `json:"duration_ms"`
+		PerSource      map[string]SourceResult `json:"per_source"`
+		Errors         []string                `json:"errors"`
+	}{r.CardsFound, r.PricesInserted, r.Duration.Milliseconds(), r.PerSource, errorStrings(r.Errors)})
+}
+
+func (r SourceResult) MarshalJSON() ([]byte, error) {
+	var message string
+	if r.Err != nil {
+		message = r.Err.Error()
+	}
+	return json.Marshal(struct {
+		CardsFound     int    `json:"cards_found"`
+		PricesInserted int    `json:"prices_inserted"`
+		DurationMS     int64  `json:"duration_ms"`
+		Skipped        bool   `json:"skipped,omitempty"`
+		TimedOut       bool   `json:"timed_out,omitempty"`
+		Suspect        bool   `json:"suspect,omitempty"`
+		Error          string `json:"error,omitempty"`
+	}{r.CardsFound, r.PricesInserted, r.Duration.Milliseconds(), r.Skipped, r.TimedOut, r.Suspect, message})
+}
+
+// recoverScrape runs fn, turning a panic into an error so a scrape that
+// trips over an unexpected page doesn't take the server down with it. The
+// panic is logged with its stack and counted in pokemon_scrape_panics_total.
+func recoverScrape(task string, fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			scrapePanics.WithLabelValues(task).Inc()
+			log.Printf("Recovered from panic in %s scrape: %v\n%s", task, p, runtimedebug.Stack())
+			err = fmt.Errorf("%s scrape panicked: %v", task, p)
+		}
+	}()
+	return fn()
+}
+
+// ScrapeScheduled is ScrapePrices for the scheduler: cards with their own
+// scrape_interval only get a new price once it has elapsed, cards without
+// one follow the global schedule
+func (s *Scraper) ScrapeScheduled() (ScrapeResult, error) {
+	return s.scrapeAll(true)
+}
+
+// ScrapeDiff sums up what a scrape changed
+type ScrapeDiff struct {
+	NewCards      int `json:"new_cards"`
+	UpdatedPrices int `json:"updated_prices"`
+	// NotableMoves are the prices that moved by at least
+	// NOTABLE_MOVE_PERCENT, largest move first
+	NotableMoves []PriceMove `json:"notable_moves"`
+}
+
+// PriceMove is a price that changed notably since the last scrape
+type PriceMove struct {
+	CardID        int     `json:"card_id"`
+	Name          string  `json:"name"`
+	Source        string  `json:"source"`
+	Region        string  `json:"region,omitempty"`
+	OldPrice      float64 `json:"old_price"`
+	NewPrice      float64 `json:"new_price"`
+	ChangePercent float64 `json:"change_percent"`
+}
+
+// maxNotableMoves bounds the moves kept in a diff
+const maxNotableMoves = 20
+
+// addMove records the move if it is at least minPercent
+func (d *ScrapeDiff) addMove(move PriceMove, minPercent float64) {
+	if move.OldPrice <= 0 {
+		return
+	}
+	move.ChangePercent = math.Round((move.NewPrice-move.OldPrice)/move.OldPrice*10000) / 100
+	if math.Abs(move.ChangePercent) < minPercent || move.ChangePercent == 0 {
+		return
+	}
+	d.NotableMoves = append(d.NotableMoves, move)
+}
+
+// finish sorts the moves, largest first, and keeps maxNotableMoves of them
+func (d *ScrapeDiff) finish() {
+	sort.SliceStable(d.NotableMoves, func(i, j int) bool {
+		return math.Abs(d.NotableMoves[i].ChangePercent) > math.Abs(d.NotableMoves[j].ChangePercent)
+	})
+	if len(d.NotableMoves) > maxNotableMoves {
+		d.NotableMoves = d.NotableMoves[:maxNotableMoves]
+	}
+	if d.NotableMoves == nil {
+		d.NotableMoves = []PriceMove{}
+	}
+}
+
+func (s *Scraper) scrapeAll(scheduled bool) (ScrapeResult, error) {
+	if !s.running.TryLock() {
+		return ScrapeResult{}, errScrapeInProgress
+	}
+	defer s.running.Unlock()
+	return s.scrapeHeld(scheduled)
+}
+
+// scrapeHeld scrapes every source. The caller holds s.running.
+func (s *Scraper) scrapeHeld(scheduled bool) (result ScrapeResult, err error) {
+	defer result.Diff.finish()
+
+	log.Println("Starting price scraping...")
+
+	var notDue map[int]bool
+	if scheduled {
+		var err error
+		if _, notDue, err = s.db.ScheduledCards(context.Background()); err != nil {
+			log.Printf("Error loading card schedules, storing every card: %v", err)
+		}
+	}
+
+	start := time.Now()
+	cardsUpdated := 0
+	result.PerSource = make(map[string]SourceResult)
+	defer func() {
+		result.Duration = time.Since(start)
+		s.webhook.Notify(WebhookPayload{
+			Event:          "scrape.completed",
+			CardsUpdated:   cardsUpdated,
+			CardsFound:     result.CardsFound,
+			PricesInserted: result.PricesInserted,
+			Sources:        result.PerSource,
+			DurationMS:     result.Duration.Milliseconds(),
+			Errors:         errorStrings(result.Errors),
+			FinishedAt:     time.Now(),
+		})
+	}()
+
+	c := s.newCollector()
+
+	// Add some sample cards to test the system
+	if err := s.seedSampleData(); err != nil {
+		log.Printf("Error seeding sample data: %v", err)
+	}
+
+	for _, source := range s.sources {
+		if !s.health.available(source.Name()) {
+			log.Printf("Skipping %s, it is cooling down after repeated failures", source.Name())
+			result.PerSource[source.Name()] = SourceResult{Skipped: true}
+			continue
+		}
+
+		inserted := result.Diff.UpdatedPrices
+		sourceResult, storeErrors := s.scrapeSource(c, source, scheduled, func(results []ScrapedCard) []error {
+			updated, errs := s.storeResults(results, notDue, &result.Diff)
+			cardsUpdated += updated
+			return errs
+		})
+		result.CardsFound += sourceResult.CardsFound
+		if err := sourceResult.Err; err != nil {
+			if sourceResult.Suspect {
+				log.Printf("WARNING: %s may be broken, keeping its last good prices: %v", source.Name(), err)
+			} else {
+				log.Printf("Error scraping %s: %v", source.Name(), err)
+			}
+			result.Errors = append(result.Errors, fmt.Errorf("%s: %w", source.Name(), err))
+			result.PerSource[source.Name()] = sourceResult
+			continue
+		}
+
+		sourceResult.PricesInserted = result.Diff.UpdatedPrices - inserted
+		result.PricesInserted += sourceResult.PricesInserted
+		sourcePricesInserted.WithLabelValues(source.Name()).Add(float64(sourceResult.PricesInserted))
+		for _, err := range storeErrors {
+			result.Errors = append(result.Errors, fmt.Errorf("%s: %w", source.Name(), err))
+		}
+		result.PerSource[source.Name()] = sourceResult
+	}
+
+	if s.cfg.StoreRawHTML {
+		if pruned, err := s.db.PruneSnapshots(context.Background(), s.cfg.SnapshotRetention); err != nil {
+			log.Printf("Error pruning snapshots: %v", err)
+		} else if pruned > 0 {
+			log.Printf("Deleted %d snapshots older than %s", pruned, s.cfg.SnapshotRetention)
+		}
+	}
+
+	// The change metrics compare the new prices with the ones before them
+	if _, err := s.db.RefreshChangeMetrics(context.Background(), false, nil); err != nil {
+		log.Printf("Error refreshing change metrics: %v", err)
+	}
+
+	// After scraping, get updated data and broadcast to clients. The
+	// replica may not have the new prices yet.
+	ctx := store.WithPrimaryReads(context.Background())
+	cards, err := s.db.GetCardsForFrontend(ctx, store.CardFilter{MinSources: s.cfg.MinSources, Rates: usdRates(ctx, s.rates)})
+	if err != nil {
+		log.Printf("Error getting cards for broadcast: %v", err)
+		result.Errors = append(result.Errors, err)
+		return result, err
+	}
+
+	s.hub.broadcastUpdate(cards)
+	log.Printf("Scraping complete. Broadcasted %d cards to clients", len(cards))
+	return result, nil
+}
+
+// scrapeSource runs the source, checks its card count and hands the results
+// to save, returning the run's SourceResult and save's errors. The hashes of
+// the pages parsed are stored only once save returned no errors: the pages
+// of a run that timed out, failed, tripped the card count check or wasn't
+// stored are parsed again on the next run.
+func (s *Scraper) scrapeSource(c *colly.Collector, source Source, skipUnchanged bool, save func([]ScrapedCard) []error) (SourceResult, []error) {
+	start := time.Now()
+	results, pages, err := s.runSource(c, source, skipUnchanged, source.Scrape)
+	// skipped pages don't add cards, so only runs that parsed every page
+	// are comparable
+	if err == nil && pages.unchanged.Load() == 0 {
+		err = s.checkCardCount(source.Name(), len(results))
+	}
+	result := SourceResult{
+		CardsFound: len(results),
+		TimedOut:   errors.Is(err, errSourceTimeout),
+		Suspect:    errors.Is(err, errPossibleBreakage),
+		Err:        err,
+	}
+	if err != nil {
+		result.Duration = time.Since(start)
+		return result, nil
+	}
+
+	saveErrors := save(results)
+	if len(saveErrors) == 0 {
+		s.savePageHashes(pages)
+	}
+	result.Duration = time.Since(start)
+	return result, saveErrors
+}
+
+// RescrapeCard searches the query-capable sources for a single card and
+// stores the prices whose names match it, attached to the card's ID so they
+// land on it even if it was renamed
+func (s *Scraper) RescrapeCard(ctx context.Context, cardID int) (*store.CardWithPrices, error) {
+	if !s.running.TryLock() {
+		return nil, errScrapeInProgress
+	}
+	defer s.running.Unlock()
+
+	// only the card is needed here, not its prices in USD
+	current, err := s.db.GetCardWithPrices(ctx, cardID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s.rescrape(ctx, current.Card)
+	ctx = store.WithPrimaryReads(ctx)
+	return s.db.GetCardWithPrices(ctx, cardID, usdRates(ctx, s.rates))
+}
+
+// ScrapeDueCards rescrapes the cards whose own scrape_interval has elapsed
+// since their last rescrape or price. It returns how many cards it rescraped.
+func (s *Scraper) ScrapeDueCards(ctx context.Context) (int, error) {
+	if !s.running.TryLock() {
+		return 0, errScrapeInProgress
+	}
+	defer s.running.Unlock()
+
+	// only query sources can scrape a single card, without them the due
+	// cards wait for the next full scrape
+	if !s.hasQuerySource() {
+		return 0, nil
+	}
+
+	due, _, err := s.db.ScheduledCards(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for _, card := range due {
+		s.rescrape(ctx, card)
+	}
+	return len(due), nil
+}
+
+func (s *Scraper) hasQuerySource() bool {
+	for _, source := range s.sources {
+		if _, ok := source.(QuerySource); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// rescrape searches the query-capable sources for the card and stores the
+// matching prices. The caller holds s.running.
+func (s *Scraper) rescrape(ctx context.Context, card store.Card) {
+	cardID := card.ID
+	query := card.Name
+	if card.CardNumber != "" && normalize.CardNumberFromName(query) == "" {
+		query += " " + card.CardNumber
+	}
+	logctx.Printf(ctx, "Rescraping card %d with query %q...", cardID, query)
+	if err := s.db.MarkScrapeAttempt(ctx, cardID); err != nil {
+		logctx.Printf(ctx, "Error rescraping card %d: %v", cardID, err)
+	}
+
+	wantName := normalize.CardName(card.Name)
+	c := s.newCollector()
+	for _, source := range s.sources {
+		querySource, ok := source.(QuerySource)
+		if !ok || !s.health.available(source.Name()) {
+			continue
+		}
+
+		results, _, err := s.runSource(c, source, false, func(sc *colly.Collector) ([]ScrapedCard, error) {
+			return querySource.ScrapeQuery(sc, query)
+		})
+		if err != nil {
+			logctx.Printf(ctx, "Error rescraping %s: %v", source.Name(), err)
+			continue
+		}
+
+		for _, result := range results {
+			if normalize.CardName(result.Card.Name) != wantName {
+				continue
+			}
+			price := result.Price
+			price.CardID = cardID
+			if err := s.db.InsertPrice(price); err != nil {
+				logctx.Printf(ctx, "Error inserting price: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Scraper) seedSampleData() error {
+	log.Println("Seeding sample data...")
+
+	sampleCards := []struct {
+		name   string
+		set    string
+		rarity string
+		prices []struct {
+			source string
+			price  float64
+		}
+	}{
+		{
+			name:   "Charizard ex",
+			set:    "Scarlet & Violet 151",
+			rarity: "Special Illustration Rare",
+			prices: []struct {
+				source string
+				price  float64
+			}{
+				{"TCGPlayer", 389.99 + float64(time.Now().Unix()%20) - 10}, // Add some variance
+				{"PriceCharting", 395.50 + float64(time.Now().Unix()%15) - 7},
+			},
+		},
+		{
+			name:   "Pikachu ex",
+			set:    "Scarlet & Violet 151",
+			rarity: "Ultra Rare",
+			prices: []struct {
+				source string
+				price  float64
+			}{
+				{"TCGPlayer", 124.50 + float64(time.Now().Unix()%10) - 5},
+				{"PriceCharting", 128.75 + float64(time.Now().Unix()%8) - 4},
+			},
+		},
+		{
+			name:   "Mew ex",
+			set:    "Scarlet & Violet 151",
+			rarity: "Secret Rare",
+			prices: []struct {
+				source string
+				price  float64
+			}{
+				{"TCGPlayer", 156.75 + float64(time.Now().Unix()%12) - 6},
+				{"PriceCharting", 162.25 + float64(time.Now().Unix()%9) - 4},
+			},
+		},
+	}
+
+	for _, cardData := range sampleCards {
+		card := store.Card{
+			Name:      cardData.name,
+			SetName:   cardData.set,
+			Rarity:    cardData.rarity,
+			Condition: normalize.DefaultCondition,
+		}
+
+		cardID, err := s.db.InsertCard(card)
+		if err != nil {
+			log.Printf("Error inserting sample card %s: %v", card.Name, err)
+			continue
+		}
+
+		for _, priceData := range cardData.prices {
+			price := store.Price{
+				CardID:   cardID,
+				Source:   priceData.source,
+				Price:    priceData.price,
+				Currency: "USD",
+				URL:      "https://example.com/sample-data",
+			}
+
+			if err := s.db.InsertPrice(price); err != nil {
+				log.Printf("Error inserting sample price for %s: %v", card.Name, err)
+			}
+		}
+	}
+
+	log.Println("Sample data seeding completed")
+	return nil
+}
+
+// storeResults inserts the scraped cards and their prices, skipping the
+// prices of the cards in skip. It returns how many distinct cards got a new
+// price and the errors it ran into.
+func (s *Scraper) storeResults(results []ScrapedCard, skip map[int]bool, diff *ScrapeDiff) (int, []error) {
+	updated := make(map[int]bool)
+	var errs []error
+	for _, result := range results {
+		cardID, created, err := s.db.UpsertCard(result.Card)
+		if err != nil {
+			log.Printf("Error inserting card: %v", err)
+			errs = append(errs, err)
+			continue
+		}
+		if created {
+			diff.NewCards++
+		}
+		if skip[cardID] {
+			continue
+		}
+
+		priceEntry := result.Price
+		priceEntry.CardID = cardID
+		previous, hadPrice, err := s.db.LatestPrice(context.Background(), cardID, priceEntry.Source, priceEntry.Region)
+		if err != nil {
+			log.Printf("Error loading previous price: %v", err)
+		}
+		if err := s.db.InsertPrice(priceEntry); err != nil {
+			log.Printf("Error inserting price: %v", err)
+			errs = append(errs, err)
+			continue
+		}
+		updated[cardID] = true
+		diff.UpdatedPrices++
+		if hadPrice {
+			diff.addMove(PriceMove{
+				CardID:   cardID,
+				Name:     result.Card.Name,
+				Source:   priceEntry.Source,
+				Region:   priceEntry.Region,
+				OldPrice: previous,
+				NewPrice: normalize.RoundPrice(priceEntry.Price, priceEntry.Currency),
+			}, s.cfg.NotableMovePercent)
+		}
+	}
+	return len(updated), errs
+}
+
+// runScheduler runs an initial scrape, then one every ScrapeInterval or on
+// the SCRAPE_CRON schedule when it is set
+func runScheduler(scraper *Scraper, cfg *Config) {
+	// A cron expression like "0 3 * * *" replaces the fixed interval
+	schedule := cfg.ScrapeSchedule
+	if schedule != nil {
+		log.Printf("Scheduler enabled, scrapes use cron expression %q", cfg.ScrapeCron)
+	} else {
+		log.Printf("Scheduler enabled, scraping every %s", cfg.ScrapeInterval)
+	}
+
+	// Initial scrape
+	log.Println("Starting initial scrape...")
+	runScheduledScrape(scraper.db, "initial", scraper.ScrapePrices)
+
+	if schedule != nil {
+		for {
+			next := schedule.Next(time.Now())
+			log.Printf("Next scheduled scrape at %s", next.Format(time.RFC3339))
+			time.Sleep(time.Until(next))
+
+			log.Println("Starting scheduled scrape...")
+			runScheduledScrape(scraper.db, "scheduled", scraper.ScrapeScheduled)
+		}
+	}
+
+	ticker := time.NewTicker(cfg.ScrapeInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		log.Println("Starting scheduled scrape...")
+		runScheduledScrape(scraper.db, "scheduled", scraper.ScrapeScheduled)
+	}
+}
+
+// runScheduledScrape runs one of the scheduler's scrapes and logs its
+// result. It first takes the database's scrape lock, so when several
+// instances share a database only one of them scrapes and the others skip.
+func runScheduledScrape(db *Database, task string, scrape func() (ScrapeResult, error)) {
+	label := strings.ToUpper(task[:1]) + task[1:]
+	release, acquired, err := db.TryScrapeLock(context.Background())
+	if err != nil {
+		log.Printf("%s scrape skipped, the scrape lock couldn't be checked: %v", label, err)
+		return
+	}
+	if !acquired {
+		log.Printf("%s scrape skipped, another instance holds the scrape lock", label)
+		return
+	}
+	log.Println("Acquired the scrape lock")
+	defer release()
+
+	var result ScrapeResult
+	err = recoverScrape(task, func() (err error) {
+		result, err = scrape()
+		return err
+	})
+	if err != nil {
+		log.Printf("%s scrape failed: %v", label, err)
+		return
+	}
+	log.Printf("%s scrape done: %s", label, result)
+}
+
+// runDueCardScrapes rescrapes the cards with their own scrape_interval as
+// they come due, checking every tick
+func runDueCardScrapes(scraper *Scraper, tick time.Duration) {
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for range ticker.C {
+		// another instance scraping covers them, try again next tick
+		release, acquired, err := scraper.db.TryScrapeLock(context.Background())
+		if err != nil {
+			log.Printf("Error checking the scrape lock: %v", err)
+			continue
+		}
+		if !acquired {
+			continue
+		}
+
+		var count int
+		err = recoverScrape("due_cards", func() (err error) {
+			count, err = scraper.ScrapeDueCards(context.Background())
+			return err
+		})
+		release()
+		switch {
+		case errors.Is(err, errScrapeInProgress):
+			// the running scrape covers them, try again next tick
+		case err != nil:
+			log.Printf("Error scraping due cards: %v", err)
+		case count > 0:
+			log.Printf("Rescraped %d due cards", count)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gocolly/colly/v2"
+
+	"Pokemonscraper/internal/store"
+)
+
+// fakeSource visits page when it has one, and returns its cards and err
+// after delay
+type fakeSource struct {
+	name  string
+	page  string
+	delay time.Duration
+	cards []ScrapedCard
+	err   error
+}
+
+func (f fakeSource) Name() string { return f.name }
+
+func (f fakeSource) Scrape(c *colly.Collector) ([]ScrapedCard, error) {
+	if f.page != "" {
+		if err := c.Visit(f.page); err != nil {
+			return nil, err
+		}
+	}
+	time.Sleep(f.delay)
+	return f.cards, f.err
+}
+
+// memoryPageHashes is a pageHashStore in a map
+type memoryPageHashes struct {
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+func (m *memoryPageHashes) PageHash(_ context.Context, pageURL string) (string, time.Time, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hash, found := m.hashes[pageURL]
+	return hash, time.Now(), found, nil
+}
+
+func (m *memoryPageHashes) SavePageHash(_ context.Context, pageURL, hash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hashes[pageURL] = hash
+	return nil
+}
+
+func TestSlowSourceTimesOut(t *testing.T) {
+	cfg := &Config{SourceTimeout: 50 * time.Millisecond, SourceTimeouts: map[string]time.Duration{"patient": time.Second}}
+	scraper := NewScraper(nil, nil, nil, cfg)
+	card := ScrapedCard{Card: store.Card{Name: "Pikachu"}, Price: store.Price{Price: 4.5}}
+	sources := []fakeSource{
+		{name: "Slow", delay: 5 * time.Second, cards: []ScrapedCard{card}},
+		{name: "Fast", cards: []ScrapedCard{card}},
+		// SOURCE_TIMEOUTS gives it longer than SOURCE_TIMEOUT
+		{name: "Patient", delay: 100 * time.Millisecond, cards: []ScrapedCard{card}},
+	}
+
+	start := time.Now()
+	c := scraper.newCollector()
+	results := make(map[string][]ScrapedCard)
+	errs := make(map[string]error)
+	for _, source := range sources {
+		results[source.name], _, errs[source.name] = scraper.runSource(c, source, false, source.Scrape)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("the scrape took %s, the slow source wasn't abandoned", elapsed)
+	}
+
+	if err := errs["Slow"]; !errors.Is(err, errSourceTimeout) || len(results["Slow"]) != 0 {
+		t.Errorf("slow source returned %d cards and %v, want it timed out without cards", len(results["Slow"]), err)
+	}
+	for _, name := range []string{"Fast", "Patient"} {
+		if err := errs[name]; err != nil || len(results[name]) != 1 {
+			t.Errorf("%s source returned %d cards and %v, want its card", name, len(results[name]), err)
+		}
+	}
+}
+
+func TestPageHashesSavedAfterStore(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, "<table><tr><td>Pikachu</td><td>$4.50</td></tr></table>")
+	}))
+	t.Cleanup(server.Close)
+	card := ScrapedCard{Card: store.Card{Name: "Pikachu"}, Price: store.Price{Price: 4.5}}
+	stored := func([]ScrapedCard) []error { return nil }
+
+	tests := []struct {
+		name      string
+		source    fakeSource
+		lastCount int
+		save      func([]ScrapedCard) []error
+		wantSaved bool
+	}{
+		{"stored", fakeSource{cards: []ScrapedCard{card}}, 0, stored, true},
+		{"timed out", fakeSource{delay: time.Second, cards: []ScrapedCard{card}}, 0, stored, false},
+		{"failed", fakeSource{err: errors.New("parse error")}, 0, stored, false},
+		{"too few cards", fakeSource{cards: []ScrapedCard{card}}, 10, stored, false},
+		{"not stored", fakeSource{cards: []ScrapedCard{card}}, 0, func([]ScrapedCard) []error {
+			return []error{errors.New("insert failed")}
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &Config{SourceTimeout: 100 * time.Millisecond, MinCardsPercent: 50, PageHashMaxAge: time.Hour}
+			scraper := NewScraper(nil, nil, nil, cfg)
+			hashes := &memoryPageHashes{hashes: make(map[string]string)}
+			scraper.pageHashes = hashes
+			if test.lastCount > 0 {
+				scraper.lastCardCounts["Fake"] = test.lastCount
+			}
+
+			source := test.source
+			source.name = "Fake"
+			source.page = server.URL + "/prices"
+			scraper.scrapeSource(colly.NewCollector(), source, true, test.save)
+
+			_, saved := hashes.hashes[source.page]
+			if saved != test.wantSaved {
+				t.Errorf("page hash saved = %t, want %t", saved, test.wantSaved)
+			}
+		})
+	}
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"Pokemonscraper/internal/collect"
+	"Pokemonscraper/internal/normalize"
+	"Pokemonscraper/internal/store"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"github.com/gocolly/colly/v2"
+)
+
+type tcgPlayerSource struct{}
+
+func (tcgPlayerSource) Name() string { return "TCGPlayer" }
+
+func (t tcgPlayerSource) Scrape(c *colly.Collector) ([]ScrapedCard, error) {
+	log.Println("Scraping TCGPlayer...")
+	return t.scrape(c, "https://www.tcgplayer.com/categories/trading-and-collectible-card-games/pokemon/price-guides/sv-scarlet-and-violet-151")
+}
+
+func (t tcgPlayerSource) ScrapeQuery(c *colly.Collector, query string) ([]ScrapedCard, error) {
+	return t.scrape(c, "https://www.tcgplayer.com/search/pokemon/product?q="+url.QueryEscape(query))
+}
+
+func (tcgPlayerSource) scrape(c *colly.Collector, pageURL string) ([]ScrapedCard, error) {
+	var results []ScrapedCard
+	c.OnHTML(".search-result", func(e *colly.HTMLElement) {
+		if pageUnchanged(e.Response) {
+			return
+		}
+		name := strings.TrimSpace(e.ChildText(".card-name"))
+		priceText := strings.TrimSpace(e.ChildText(".market-price"))
+
+		if name == "" {
+			return
+		}
+
+		if normalize.IsPricePlaceholder(priceText) {
+			log.Printf("Skipping %s: price %q looks like a JS placeholder, %s appears to be JS-rendered",
+				name, priceText, e.Request.URL)
+			return
+		}
+
+		price := normalize.ExtractPrice(priceText)
+		if price <= 0 {
+			return
+		}
+
+		imageURL := ""
+		if src := strings.TrimSpace(e.ChildAttr("img", "src")); src != "" {
+			imageURL = e.Request.AbsoluteURL(src)
+		}
+
+		results = append(results, ScrapedCard{
+			Card: store.Card{
+				Name:      name,
+				SetName:   normalize.DefaultSetName,
+				Rarity:    strings.TrimSpace(e.ChildText(".rarity")),
+				Condition: normalize.ConditionOrDefault(e.ChildText(".condition")),
+				ImageURL:  imageURL,
+			},
+			Price: store.Price{
+				Source:   "TCGPlayer",
+				Price:    price,
+				Currency: normalize.CurrencyFromText(priceText),
+				URL:      e.Request.URL.String(),
+			},
+		})
+	})
+
+	if err := c.Visit(pageURL); err != nil {
+		return nil, err
+	}
+	c.Wait()
+	return results, nil
+}
+
+type priceChartingSource struct {
+	// Headers are the header words the price columns are found by,
+	// priceColumnHeaders when nil
+	Headers map[string]string
+}
+
+func (priceChartingSource) Name() string { return "PriceCharting" }
+
+func (p priceChartingSource) Scrape(c *colly.Collector) ([]ScrapedCard, error) {
+	log.Println("Scraping PriceCharting...")
+	return p.scrape(c, "https://www.pricecharting.com/search-products?q=pokemon+151&type=prices")
+}
+
+func (p priceChartingSource) ScrapeQuery(c *colly.Collector, query string) ([]ScrapedCard, error) {
+	return p.scrape(c, "https://www.pricecharting.com/search-products?type=prices&q="+url.QueryEscape("pokemon 151 "+query))
+}
+
+func (p priceChartingSource) scrape(c *colly.Collector, pageURLs ...string) ([]ScrapedCard, error) {
+	headers := p.Headers
+	if headers == nil {
+		headers = priceColumnHeaders
+	}
+
+	var results []ScrapedCard
+	c.OnHTML("table", func(e *colly.HTMLElement) {
+		if pageUnchanged(e.Response) {
+			return
+		}
+		columns := priceColumns(e.DOM, headers)
+		if len(columns) == 0 {
+			return
+		}
+		indexes := make([]int, 0, len(columns))
+		for index := range columns {
+			indexes = append(indexes, index)
+		}
+		sort.Ints(indexes)
+
+		e.DOM.Find("tr").Each(func(_ int, row *goquery.Selection) {
+			cells := row.ChildrenFiltered("td")
+			if cells.Length() < 2 {
+				return
+			}
+
+			name := strings.TrimSpace(row.Find(".title").First().Text())
+			if name == "" {
+				name = strings.TrimSpace(cells.Eq(0).Text())
+			}
+			console := strings.TrimSpace(row.Find(".console").First().Text())
+			if console == "" {
+				console = strings.TrimSpace(cells.Eq(1).Text())
+			}
+			if name == "" {
+				return
+			}
+
+			placeholders := 0
+			for _, index := range indexes {
+				priceType := columns[index]
+				priceText := strings.TrimSpace(cells.Eq(index).Text())
+				if normalize.IsPricePlaceholder(priceText) {
+					placeholders++
+					continue
+				}
+
+				price := normalize.ExtractPrice(priceText)
+				if price <= 0 {
+					continue
+				}
+
+				condition, source := priceTypeCondition(priceType)
+				results = append(results, ScrapedCard{
+					Card: store.Card{
+						Name:        name,
+						SetName:     normalize.SetNameFromConsole(console),
+						Condition:   condition,
+						ProductType: productTypeFromName(name),
+					},
+					Price: store.Price{
+						Source:   source,
+						Price:    price,
+						Currency: normalize.CurrencyFromText(priceText),
+						URL:      e.Request.URL.String(),
+					},
+				})
+			}
+
+			if placeholders > 0 && placeholders == len(columns) {
+				log.Printf("Skipping %s: its prices look like JS placeholders, %s appears to be JS-rendered",
+					name, e.Request.URL)
+			}
+		})
+	})
+
+	for _, pageURL := range pageURLs {
+		if err := c.Visit(pageURL); err != nil {
+			return nil, err
+		}
+	}
+	c.Wait()
+	return results, nil
+}
+
+// priceColumnHeaders maps words of a results table header to the price type
+// of its column. The longest word found in a header wins, so "Ungraded"
+// isn't read as "graded". PRICE_COLUMN_HEADERS adds more, see
+// Config.PriceColumnHeaders.
+var priceColumnHeaders = map[string]string{
+	"loose":    store.PriceTypeLoose,
+	"ungraded": store.PriceTypeLoose,
+	"used":     store.PriceTypeLoose,
+	"complete": store.PriceTypeComplete,
+	"cib":      store.PriceTypeComplete,
+	"new":      store.PriceTypeNew,
+	"sealed":   store.PriceTypeNew,
+	"graded":   store.PriceTypeGraded,
+	"psa":      store.PriceTypeGraded,
+}
+
+// priceColumnClasses maps the classes PriceCharting puts on price cells to
+// their price type, for tables without a header
+var priceColumnClasses = map[string]string{
+	"used_price":   store.PriceTypeLoose,
+	"cib_price":    store.PriceTypeComplete,
+	"new_price":    store.PriceTypeNew,
+	"graded_price": store.PriceTypeGraded,
+}
+
+// defaultPriceColumns is the column layout the CSV scraper reads: name,
+// console, then loose, complete, new and graded
+var defaultPriceColumns = map[int]string{
+	2: store.PriceTypeLoose,
+	3: store.PriceTypeComplete,
+	4: store.PriceTypeNew,
+	5: store.PriceTypeGraded,
+}
+
+// priceColumns finds which cells of the table's rows hold which price type:
+// from the header if it names them in headers, else from the cells'
+// classes, else defaultPriceColumns for the results table. Other tables get
+// none.
+func priceColumns(table *goquery.Selection, headers map[string]string) map[int]string {
+	columns := make(map[int]string)
+	table.Find("tr").FilterFunction(func(_ int, row *goquery.Selection) bool {
+		return row.ChildrenFiltered("th").Length() > 0
+	}).First().Children().Each(func(index int, cell *goquery.Selection) {
+		if priceType := priceTypeFromHeader(cell.Text(), headers); priceType != "" {
+			columns[index] = priceType
+		}
+	})
+	if len(columns) > 0 {
+		return columns
+	}
+
+	table.Find("tr").FilterFunction(func(_ int, row *goquery.Selection) bool {
+		return row.ChildrenFiltered("td").Length() > 0
+	}).First().ChildrenFiltered("td").Each(func(index int, cell *goquery.Selection) {
+		for class, priceType := range priceColumnClasses {
+			if cell.HasClass(class) {
+				columns[index] = priceType
+			}
+		}
+	})
+	if len(columns) > 0 {
+		return columns
+	}
+	if table.Is("#games_table") {
+		return defaultPriceColumns
+	}
+	return nil
+}
+
+// priceTypeFromHeader returns the price type a column header names, going
+// by the words in headers, or ""
+func priceTypeFromHeader(header string, headers map[string]string) string {
+	header = strings.ToLower(strings.Join(strings.Fields(header), " "))
+	best, priceType := "", ""
+	for word, wordType := range headers {
+		if len(word) > len(best) && strings.Contains(header, word) {
+			best, priceType = word, wordType
+		}
+	}
+	return priceType
+}
+
+// priceTypeCondition returns the condition and source a price type is
+// stored under. Loose prices are the raw card price the other sources track.
+func priceTypeCondition(priceType string) (string, string) {
+	if priceType == store.PriceTypeLoose {
+		return normalize.DefaultCondition, "PriceCharting"
+	}
+	label := strings.ToUpper(priceType[:1]) + priceType[1:]
+	return label, store.SourceLabel{Provider: "PriceCharting", PriceType: priceType}.String()
+}
+
+// priceChartingSealedSource searches PriceCharting for sealed 151 products
+// and keeps only the results that are sealed
+type priceChartingSealedSource struct {
+	Queries []string
+	// Headers are passed on to priceChartingSource
+	Headers map[string]string
+}
+
+func (priceChartingSealedSource) Name() string { return "PriceCharting Sealed" }
+
+func (p priceChartingSealedSource) Scrape(c *colly.Collector) ([]ScrapedCard, error) {
+	log.Println("Scraping PriceCharting sealed products...")
+	return p.ScrapeQuery(c, "")
+}
+
+// ScrapeQuery narrows every configured search down by the query
+func (p priceChartingSealedSource) ScrapeQuery(c *colly.Collector, query string) ([]ScrapedCard, error) {
+	var pageURLs []string
+	for _, sealedQuery := range p.Queries {
+		q := strings.TrimSpace("pokemon 151 " + sealedQuery + " " + query)
+		pageURLs = append(pageURLs, "https://www.pricecharting.com/search-products?type=prices&q="+url.QueryEscape(q))
+	}
+
+	results, err := priceChartingSource{Headers: p.Headers}.scrape(c, pageURLs...)
+	if err != nil {
+		return nil, err
+	}
+
+	// the searches overlap, so the same product can come back more than
+	// once. The new price is the sealed one, the loose price is only used
+	// when a product has none.
+	newCondition, _ := priceTypeCondition(store.PriceTypeNew)
+	looseCondition, _ := priceTypeCondition(store.PriceTypeLoose)
+	seen := make(map[string]bool)
+	var sealed []ScrapedCard
+	for _, condition := range []string{newCondition, looseCondition} {
+		for _, result := range results {
+			key := result.Card.Name + "|" + result.Card.SetName
+			if result.Card.ProductType != store.ProductTypeSealed || seen[key] || result.Card.Condition != condition {
+				continue
+			}
+			seen[key] = true
+			result.Card.Condition = "Sealed"
+			result.Price.Source = "PriceCharting"
+			sealed = append(sealed, result)
+		}
+	}
+	return sealed, nil
+}
+
+// sealedKeywords mark a product name as a sealed product rather than a card
+var sealedKeywords = []string{
+	"booster box", "booster bundle", "booster pack", "elite trainer box", "etb",
+	"collection", "blister", "tin", "display", "case",
+}
+
+// productTypeFromName guesses whether a PriceCharting product is sealed from
+// its name. Other names are empty rather than single, so they don't undo a
+// product_type set by hand.
+func productTypeFromName(name string) string {
+	words := " " + normalize.CardName(name) + " "
+	for _, keyword := range sealedKeywords {
+		if strings.Contains(words, " "+keyword+" ") {
+			return store.ProductTypeSealed
+		}
+	}
+	return ""
+}
+
+// priceChartingGradesSource scrapes the full price guide table of
+// PriceCharting product pages (PSA 10, BGS 10, CGC 10, ...). Each grade is
+// stored as its own card condition, so graded prices don't mix with raw ones.
+type priceChartingGradesSource struct {
+	URLs []string
+}
+
+func (priceChartingGradesSource) Name() string { return "PriceCharting grades" }
+
+func (g priceChartingGradesSource) Scrape(c *colly.Collector) ([]ScrapedCard, error) {
+	log.Printf("Scraping PriceCharting grade tables from %d product pages...", len(g.URLs))
+
+	var results []ScrapedCard
+	c.OnHTML("html", func(e *colly.HTMLElement) {
+		if pageUnchanged(e.Response) {
+			return
+		}
+		name, console := collect.ProductTitle(e.DOM)
+		if name == "" {
+			log.Printf("No product name on %s, is it a product page?", e.Request.URL)
+			return
+		}
+		setName := normalize.SetNameFromConsole(console)
+
+		e.DOM.Find("#full-prices tr").Each(func(_ int, row *goquery.Selection) {
+			cells := row.Find("td")
+			if cells.Length() < 2 {
+				return
+			}
+
+			grade := strings.Join(strings.Fields(cells.Eq(0).Text()), " ")
+			priceText := strings.TrimSpace(cells.Eq(1).Text())
+
+			// ungraded is the loose price the other sources already track,
+			// and grades without sales show "-"
+			price := normalize.ExtractPrice(priceText)
+			if grade == "" || strings.EqualFold(grade, "Ungraded") || price <= 0 {
+				return
+			}
+
+			results = append(results, ScrapedCard{
+				Card: store.Card{
+					Name:      name,
+					SetName:   setName,
+					Condition: grade,
+				},
+				Price: store.Price{
+					Source:   store.SourceLabel{Provider: "PriceCharting", PriceType: store.PriceTypeGraded, Grade: grade}.String(),
+					Price:    price,
+					Currency: normalize.CurrencyFromText(priceText),
+					URL:      e.Request.URL.String(),
+				},
+			})
+		})
+	})
+
+	for _, pageURL := range g.URLs {
+		if err := c.Visit(pageURL); err != nil {
+			log.Printf("Error visiting %s: %v", pageURL, err)
+		}
+	}
+	c.Wait()
+	return results, nil
+}
+
+// JSONSource reads prices from a JSON API instead of parsing HTML. The
+// response is expected in PriceCharting's /api/products shape, see the README
+// for how to find the endpoint for a site.
+type JSONSource struct {
+	SourceName string
+	URL        string
+	// Region is recorded with every price, e.g. "EU" for a source that
+	// prices by the Accept-Language header
+	Region string
+}
+
+// GenericSourceSpec describes a table-based price site by its selectors, so
+// a site can be added from GENERIC_SOURCES without writing a Source.
+// Selectors inside a row are relative to it.
+type GenericSourceSpec struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+
+	RowSelector   string `json:"row_selector"`
+	NameSelector  string `json:"name_selector"`
+	PriceSelector string `json:"price_selector"`
+	// SetSelector reads the set from the row, like PriceCharting's console
+	// column. Without it every card is in Set, or the default set.
+	SetSelector       string `json:"set_selector,omitempty"`
+	Set               string `json:"set,omitempty"`
+	ConditionSelector string `json:"condition_selector,omitempty"`
+	// NextPageSelector is a link to the next results page, if any
+	NextPageSelector string `json:"next_page_selector,omitempty"`
+	Currency         string `json:"currency,omitempty"`
+	// Counts stored with the price when the site shows them, e.g.
+	// "1,204 listings" or a PSA population
+	ListingsSelector   string `json:"listings_selector,omitempty"`
+	PopulationSelector string `json:"population_selector,omitempty"`
+}
+
+// GenericSource scrapes a site described by a GenericSourceSpec
+type GenericSource struct {
+	Spec GenericSourceSpec
+}
+
+// loadGenericSources reads and validates the GENERIC_SOURCES file, a JSON
+// array of GenericSourceSpec
+func loadGenericSources(path string) ([]GenericSourceSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var specs []GenericSourceSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	names := make(map[string]bool)
+	var errs []error
+	for i := range specs {
+		spec := &specs[i]
+		if err := spec.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("source %d (%s): %v", i+1, spec.Name, err))
+			continue
+		}
+		if names[strings.ToLower(spec.Name)] {
+			errs = append(errs, fmt.Errorf("source %d: the name %s is used twice", i+1, spec.Name))
+		}
+		names[strings.ToLower(spec.Name)] = true
+	}
+	return specs, errors.Join(errs...)
+}
+
+// validate checks the spec and fills in its defaults
+func (spec *GenericSourceSpec) validate() error {
+	spec.Name = strings.TrimSpace(spec.Name)
+	if spec.Name == "" {
+		return errors.New("name is required")
+	}
+	if u, err := url.Parse(spec.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("url %q is not an http(s) URL", spec.URL)
+	}
+
+	selectors := []struct {
+		field, selector string
+		required        bool
+	}{
+		{"row_selector", spec.RowSelector, true},
+		{"name_selector", spec.NameSelector, true},
+		{"price_selector", spec.PriceSelector, true},
+		{"set_selector", spec.SetSelector, false},
+		{"condition_selector", spec.ConditionSelector, false},
+		{"next_page_selector", spec.NextPageSelector, false},
+		{"listings_selector", spec.ListingsSelector, false},
+		{"population_selector", spec.PopulationSelector, false},
+	}
+	for _, s := range selectors {
+		if strings.TrimSpace(s.selector) == "" {
+			if s.required {
+				return fmt.Errorf("%s is required", s.field)
+			}
+			continue
+		}
+		if _, err := cascadia.Compile(s.selector); err != nil {
+			return fmt.Errorf("%s %q is not a valid CSS selector: %v", s.field, s.selector, err)
+		}
+	}
+
+	// without a currency SOURCE_CURRENCIES applies
+	spec.Currency = strings.ToUpper(strings.TrimSpace(spec.Currency))
+	if spec.Currency != "" && !normalize.CurrencyCodePattern.MatchString(spec.Currency) {
+		return fmt.Errorf("currency %q is not a 3-letter code", spec.Currency)
+	}
+	if strings.TrimSpace(spec.Set) == "" {
+		spec.Set = normalize.DefaultSetName
+	}
+	return nil
+}
+
+func (g GenericSource) Name() string { return g.Spec.Name }
+
+func (g GenericSource) Scrape(c *colly.Collector) ([]ScrapedCard, error) {
+	log.Printf("Scraping %s...", g.Name())
+	spec := g.Spec
+
+	var results []ScrapedCard
+	c.OnHTML(spec.RowSelector, func(e *colly.HTMLElement) {
+		if pageUnchanged(e.Response) {
+			return
+		}
+		name := strings.Join(strings.Fields(e.ChildText(spec.NameSelector)), " ")
+		priceText := strings.TrimSpace(e.ChildText(spec.PriceSelector))
+		if name == "" {
+			return
+		}
+		if normalize.IsPricePlaceholder(priceText) {
+			log.Printf("Skipping %s: price %q looks like a JS placeholder, %s appears to be JS-rendered",
+				name, priceText, e.Request.URL)
+			return
+		}
+		price := normalize.ExtractPrice(priceText)
+		if price <= 0 {
+			return
+		}
+		currency := normalize.CurrencyFromText(priceText)
+		if currency == "" {
+			currency = spec.Currency
+		}
+
+		setName := spec.Set
+		if spec.SetSelector != "" {
+			setName = normalize.SetNameFromConsole(e.ChildText(spec.SetSelector))
+		}
+		condition := normalize.DefaultCondition
+		if spec.ConditionSelector != "" {
+			condition = normalize.ConditionOrDefault(e.ChildText(spec.ConditionSelector))
+		}
+
+		results = append(results, ScrapedCard{
+			Card: store.Card{
+				Name:        name,
+				SetName:     setName,
+				Condition:   condition,
+				ProductType: productTypeFromName(name),
+			},
+			Price: store.Price{
+				Source:     g.Name(),
+				Price:      price,
+				Currency:   currency,
+				URL:        e.Request.URL.String(),
+				Listings:   childCount(e, spec.ListingsSelector),
+				Population: childCount(e, spec.PopulationSelector),
+			},
+		})
+	})
+
+	if spec.NextPageSelector != "" {
+		c.OnHTML(spec.NextPageSelector, func(e *colly.HTMLElement) {
+			if next := e.Attr("href"); next != "" {
+				e.Request.Visit(e.Request.AbsoluteURL(next))
+			}
+		})
+	}
+
+	if err := c.Visit(spec.URL); err != nil {
+		return nil, err
+	}
+	c.Wait()
+	return results, nil
+}
+
+// jsonProductsResponse is the body of a JSON products endpoint. Prices are
+// whole cents, as PriceCharting returns them. Listings and population are
+// optional.
+type jsonProductsResponse struct {
+	Status   string `json:"status"`
+	Products []struct {
+		ID          string `json:"id"`
+		ProductName string `json:"product-name"`
+		ConsoleName string `json:"console-name"`
+		LoosePrice  int    `json:"loose-price"`
+		Condition   string `json:"condition"`
+		Listings    *int   `json:"listings"`
+		Population  *int   `json:"population"`
+	} `json:"products"`
+}
+
+func (j *JSONSource) Name() string { return j.SourceName }
+
+func (j *JSONSource) Scrape(c *colly.Collector) ([]ScrapedCard, error) {
+	log.Printf("Fetching JSON from %s...", j.Name())
+	return j.scrape(c, j.URL)
+}
+
+// ScrapeQuery sets the q parameter of the endpoint URL to the query
+func (j *JSONSource) ScrapeQuery(c *colly.Collector, query string) ([]ScrapedCard, error) {
+	endpoint, err := url.Parse(j.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON source URL: %v", err)
+	}
+	params := endpoint.Query()
+	params.Set("q", query)
+	endpoint.RawQuery = params.Encode()
+
+	return j.scrape(c, endpoint.String())
+}
+
+func (j *JSONSource) scrape(c *colly.Collector, endpoint string) ([]ScrapedCard, error) {
+	var results []ScrapedCard
+	var parseErr error
+	c.OnResponse(func(r *colly.Response) {
+		if pageUnchanged(r) {
+			return
+		}
+
+		var body jsonProductsResponse
+		if err := json.Unmarshal(r.Body, &body); err != nil {
+			parseErr = fmt.Errorf("failed to decode JSON from %s: %v", r.Request.URL, err)
+			return
+		}
+		if body.Status != "" && body.Status != "success" {
+			parseErr = fmt.Errorf("JSON endpoint %s returned status %q", r.Request.URL, body.Status)
+			return
+		}
+
+		for _, product := range body.Products {
+			if product.ProductName == "" || product.LoosePrice <= 0 {
+				continue
+			}
+
+			setName := normalize.SetNameFromConsole(product.ConsoleName)
+
+			results = append(results, ScrapedCard{
+				Card: store.Card{
+					Name:      product.ProductName,
+					SetName:   setName,
+					Condition: normalize.ConditionOrDefault(product.Condition),
+				},
+				Price: store.Price{
+					Source:     j.Name(),
+					Price:      float64(product.LoosePrice) / 100,
+					Region:     j.Region,
+					URL:        r.Request.URL.String(),
+					Listings:   nonNegative(product.Listings),
+					Population: nonNegative(product.Population),
+				},
+			})
+		}
+	})
+
+	if err := c.Visit(endpoint); err != nil {
+		return nil, err
+	}
+	c.Wait()
+
+	if parseErr != nil {
+		return nil, parseErr
+	}
+	return results, nil
+}
+
+// childCount reads a count like "1,204 listings" from the element's child
+// matching selector. It is nil without a selector or a number.
+func childCount(e *colly.HTMLElement, selector string) *int {
+	if selector == "" {
+		return nil
+	}
+	return parseCount(e.ChildText(selector))
+}
+
+// parseCount returns the first whole number in the text, thousands
+// separators included, or nil if there is none
+func parseCount(text string) *int {
+	digits := countPattern.FindString(text)
+	if digits == "" {
+		return nil
+	}
+	count, err := strconv.Atoi(strings.NewReplacer(",", "", ".", "", " ", "").Replace(digits))
+	if err != nil {
+		return nil
+	}
+	return &count
+}
+
+var countPattern = regexp.MustCompile(`\d{1,3}(?:[,. ]\d{3})+\b|\d+`)
+
+// nonNegative drops negative counts, which no source means
+func nonNegative(count *int) *int {
+	if count == nil || *count < 0 {
+		return nil
+	}
+	return count
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gocolly/colly/v2"
+
+	"Pokemonscraper/internal/normalize"
+	"Pokemonscraper/internal/store"
+)
+
+func TestConfiguredSources(t *testing.T) {
+	names := func(cfg *Config) []string {
+		var names []string
+		for _, source := range configuredSources(cfg) {
+			names = append(names, source.Name())
+		}
+		return names
+	}
+
+	if got := names(&Config{}); len(got) != 0 {
+		t.Errorf("default sources = %v, want none", got)
+	}
+	if got := names(&Config{ScrapeTCGPlayer: true, ScrapePriceCharting: true}); !slices.Equal(got, []string{"TCGPlayer", "PriceCharting"}) {
+		t.Errorf("sources = %v, want TCGPlayer and PriceCharting", got)
+	}
+	// the JSON source replaces the search pages
+	cfg := &Config{ScrapeTCGPlayer: true, ScrapePriceCharting: true, JSONSourceURL: "https://example.com/api", JSONSourceName: "PriceCharting"}
+	if got := names(cfg); len(got) != 1 {
+		t.Errorf("sources with JSON_SOURCE_URL = %v, want only the JSON source", got)
+	}
+}
+
+// fixtureServer serves testdata
+func fixtureServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestPriceChartingGradesSource(t *testing.T) {
+	server := fixtureServer(t)
+	source := priceChartingGradesSource{URLs: []string{server.URL + "/grades.html"}}
+
+	results, err := source.Scrape(colly.NewCollector())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ungraded is the loose price, grades without a price are skipped
+	want := []struct {
+		condition, source string
+		price             float64
+	}{
+		{"Grade 9", "pricecharting:graded:grade9", 512},
+		{"PSA 10", "pricecharting:graded:psa10", 2100},
+		{"BGS 10", "pricecharting:graded:bgs10", 2450},
+	}
+	if len(results) != len(want) {
+		t.Fatalf("got %d prices, want %d: %+v", len(results), len(want), results)
+	}
+	for i, w := range want {
+		got := results[i]
+		if got.Card.Name != "Charizard ex #199" || got.Card.SetName != "Scarlet & Violet 151" {
+			t.Errorf("price %d is for %q of %q, want Charizard ex #199 of Scarlet & Violet 151", i, got.Card.Name, got.Card.SetName)
+		}
+		if got.Card.Condition != w.condition || got.Price.Source != w.source || got.Price.Price != w.price {
+			t.Errorf("price %d = %s %s %v, want %s %s %v", i,
+				got.Card.Condition, got.Price.Source, got.Price.Price, w.condition, w.source, w.price)
+		}
+	}
+}
+
+// exampleGenericSources is a GENERIC_SOURCES file for the generic.html
+// fixture, {{url}} is replaced by the fixture server's
+const exampleGenericSources = `[
+	{
+		"name": "Example",
+		"url": "{{url}}/generic.html",
+		"row_selector": "table.prices tr.card-row",
+		"name_selector": "td.name",
+		"price_selector": "td.price",
+		"set_selector": "td.set",
+		"condition_selector": "td.condition",
+		"next_page_selector": "a.next",
+		"listings_selector": "td.listings",
+		"currency": "usd"
+	}
+]`
+
+func TestGenericSource(t *testing.T) {
+	server := fixtureServer(t)
+	path := filepath.Join(t.TempDir(), "sources.json")
+	if err := os.WriteFile(path, []byte(strings.ReplaceAll(exampleGenericSources, "{{url}}", server.URL)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	specs, err := loadGenericSources(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(specs) != 1 || specs[0].Currency != "USD" {
+		t.Fatalf("loaded %+v, want one USD source", specs)
+	}
+
+	results, err := GenericSource{Spec: specs[0]}.Scrape(colly.NewCollector())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pikachu's price is a placeholder and Mew's is missing, the booster
+	// box comes from the next page
+	listings := func(n int) *int { return &n }
+	want := []ScrapedCard{
+		{
+			Card:  store.Card{Name: "Charizard ex #199", SetName: "Scarlet & Violet 151", Condition: "Near Mint"},
+			Price: store.Price{Source: "Example", Price: 389.99, Currency: "USD", URL: server.URL + "/generic.html", Listings: listings(1204)},
+		},
+		{
+			Card:  store.Card{Name: "Scarlet & Violet 151 Booster Box", SetName: "Scarlet & Violet 151", Condition: normalize.DefaultCondition, ProductType: store.ProductTypeSealed},
+			Price: store.Price{Source: "Example", Price: 150, Currency: "EUR", URL: server.URL + "/generic-2.html", Listings: listings(88)},
+		},
+	}
+	if !reflect.DeepEqual(results, want) {
+		t.Errorf("scraped\n%+v\nwant\n%+v", results, want)
+	}
+}
+
+func TestGenericSourceSpecValidate(t *testing.T) {
+	valid := GenericSourceSpec{Name: "Example", URL: "https://example.com/prices", RowSelector: "tr", NameSelector: "td.name", PriceSelector: "td.price"}
+	if err := valid.validate(); err != nil {
+		t.Fatalf("valid spec: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		change func(spec *GenericSourceSpec)
+	}{
+		{"no name", func(spec *GenericSourceSpec) { spec.Name = " " }},
+		{"ftp url", func(spec *GenericSourceSpec) { spec.URL = "ftp://example.com" }},
+		{"no row selector", func(spec *GenericSourceSpec) { spec.RowSelector = "" }},
+		{"bad price selector", func(spec *GenericSourceSpec) { spec.PriceSelector = "td[" }},
+		{"bad set selector", func(spec *GenericSourceSpec) { spec.SetSelector = ">>" }},
+		{"bad currency", func(spec *GenericSourceSpec) { spec.Currency = "dollars" }},
+	}
+	for _, test := range tests {
+		spec := valid
+		test.change(&spec)
+		if err := spec.validate(); err == nil {
+			t.Errorf("%s: validate accepted %+v", test.name, spec)
+		}
+	}
+}
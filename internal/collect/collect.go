@@ -0,0 +1,71 @@
+// Package collect holds the colly helpers the API server's sources and the
+// CSV scraper share.
+package collect
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gocolly/colly/v2"
+	"github.com/gocolly/colly/v2/debug"
+	"golang.org/x/net/html/charset"
+)
+
+// ProductTitle reads the card name and set from a PriceCharting product page
+// title, which holds the name followed by a link to the console/set
+func ProductTitle(doc *goquery.Selection) (string, string) {
+	title := doc.Find("#product_name").First()
+
+	setName := strings.TrimSpace(title.Find("a").First().Text())
+	name := strings.TrimSpace(title.Clone().Children().Remove().End().Text())
+	if name == "" {
+		name = strings.TrimSpace(doc.Find("title").Text())
+	}
+	return name, setName
+}
+
+// NewDebugger returns a colly LogDebugger when enabled, writing to path if
+// set or stderr otherwise. The returned func closes the file.
+func NewDebugger(enabled bool, path string) (debug.Debugger, func(), error) {
+	if !enabled {
+		return nil, func() {}, nil
+	}
+	if path == "" {
+		return &debug.LogDebugger{}, func() {}, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, func() {}, fmt.Errorf("failed to open debug file: %v", err)
+	}
+	return &debug.LogDebugger{Output: file}, func() { file.Close() }, nil
+}
+
+// TranscodeResponse converts an HTML body to UTF-8 before it is parsed.
+// colly already handles a charset in the Content-Type header, this covers
+// pages that only declare it in a <meta> tag. Register it before any other
+// OnResponse callback.
+func TranscodeResponse(r *colly.Response) {
+	contentType := r.Headers.Get("Content-Type")
+	if strings.Contains(strings.ToLower(contentType), "charset") {
+		return
+	}
+
+	enc, name, certain := charset.DetermineEncoding(r.Body, contentType)
+	if name == "utf-8" || (!certain && utf8.Valid(r.Body)) {
+		return
+	}
+
+	body, err := enc.NewDecoder().Bytes(r.Body)
+	if err != nil {
+		log.Printf("Error transcoding %s from %s: %v", r.Request.URL, name, err)
+		return
+	}
+
+	log.Printf("Transcoded %s from %s to UTF-8", r.Request.URL, name)
+	r.Body = body
+}
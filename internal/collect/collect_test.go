@@ -0,0 +1,63 @@
+package collect
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// scrapeLatin1 serves the Latin-1 fixture with the Content-Type and returns
+// the row's name and console as parsed
+func scrapeLatin1(t *testing.T, contentType string) (string, string) {
+	t.Helper()
+	page, err := os.ReadFile(filepath.Join("testdata", "latin1.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		w.Write(page)
+	}))
+	t.Cleanup(server.Close)
+
+	var name, console string
+	c := colly.NewCollector()
+	c.OnResponse(TranscodeResponse)
+	c.OnHTML("#games_table tbody tr", func(e *colly.HTMLElement) {
+		name = strings.TrimSpace(e.ChildText("td.title"))
+		console = strings.TrimSpace(e.ChildText("td.console"))
+	})
+	if err := c.Visit(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	return name, console
+}
+
+func TestTranscodeResponseLatin1(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+	}{
+		// only the <meta> tag names the charset, TranscodeResponse
+		// converts the page
+		{"meta tag", "text/html"},
+		// colly converts the page itself, TranscodeResponse leaves it
+		{"header", "text/html; charset=ISO-8859-1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, console := scrapeLatin1(t, test.contentType)
+			if name != "Flabébé Pokémon Méga" {
+				t.Errorf("name = %q, want %q", name, "Flabébé Pokémon Méga")
+			}
+			if console != "Pokémon Écarlate et Violet 151" {
+				t.Errorf("console = %q, want %q", console, "Pokémon Écarlate et Violet 151")
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Package config reads typed, validated settings from the environment.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reader reads typed settings from the environment, collecting the
+// invalid ones so they can be reported together
+type Reader struct {
+	errs []error
+}
+
+// Fail records key as invalid
+func (e *Reader) Fail(key string, err error) {
+	e.errs = append(e.errs, fmt.Errorf("%s: %v", key, err))
+}
+
+// Err returns every invalid setting recorded, or nil
+func (e *Reader) Err() error {
+	return errors.Join(e.errs...)
+}
+
+// Duration parses key as a duration of at least min, e.g. "30m"
+func (e *Reader) Duration(key, defaultValue string, min time.Duration) time.Duration {
+	value := Get(key, defaultValue)
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		e.Fail(key, fmt.Errorf("%q is not a duration like 30s or 1h", value))
+		return 0
+	}
+	if d < min {
+		e.Fail(key, fmt.Errorf("%s is shorter than the minimum of %s", d, min))
+	}
+	return d
+}
+
+// Int parses key as an integer of at least min
+func (e *Reader) Int(key string, defaultValue, min int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		e.Fail(key, fmt.Errorf("%q is not a number", value))
+		return defaultValue
+	}
+	if n < min {
+		e.Fail(key, fmt.Errorf("%d is below the minimum of %d", n, min))
+	}
+	return n
+}
+
+// Float parses key as a number of at least min
+func (e *Reader) Float(key string, defaultValue, min float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		e.Fail(key, fmt.Errorf("%q is not a number", value))
+		return defaultValue
+	}
+	if f < min {
+		e.Fail(key, fmt.Errorf("%g is below the minimum of %g", f, min))
+	}
+	return f
+}
+
+// Bool parses key as true or false
+func (e *Reader) Bool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.Fail(key, fmt.Errorf("%q is not true or false", value))
+		return defaultValue
+	}
+	return b
+}
+
+// Get returns the environment variable key, or defaultValue when it is unset
+// or empty
+func Get(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// SplitList splits a comma-separated setting, dropping empty entries
+func SplitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,54 @@
+// Package logctx carries a request's correlation ID and client IP in its
+// context, for log lines of the work done on its behalf.
+package logctx
+
+import (
+	"context"
+	"log"
+	"strings"
+)
+
+// requestIDKey is the context key the request's correlation ID is stored
+// under
+type requestIDKey struct{}
+
+// clientIPKey is the context key the client's IP is stored under
+type clientIPKey struct{}
+
+// WithRequestID returns ctx carrying the request's correlation ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the correlation ID stored by WithRequestID, or ""
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// WithClientIP returns ctx carrying the client's IP
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// ClientIP returns the IP stored by WithClientIP, or ""
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// Printf is log.Printf prefixed with the request's correlation ID and client
+// IP, if ctx has them
+func Printf(ctx context.Context, format string, args ...interface{}) {
+	var prefix []string
+	if id := RequestID(ctx); id != "" {
+		prefix = append(prefix, id)
+	}
+	if ip := ClientIP(ctx); ip != "" {
+		prefix = append(prefix, ip)
+	}
+	if len(prefix) > 0 {
+		format = "[" + strings.Join(prefix, " ") + "] " + format
+	}
+	log.Printf(format, args...)
+}
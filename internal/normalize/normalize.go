@@ -0,0 +1,370 @@
+// Package normalize turns the prices, set names, conditions and card names
+// sources scrape into the forms cards are stored and matched under.
+package normalize
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"Pokemonscraper/internal/config"
+)
+
+// pricePlaceholders are what price cells show before the page's JavaScript
+// has filled them in
+var pricePlaceholders = []string{"loading", "...", "…", "{{"}
+
+// IsPricePlaceholder reports whether a scraped price is empty or a JS
+// placeholder rather than an actual price
+func IsPricePlaceholder(priceText string) bool {
+	text := strings.ToLower(strings.TrimSpace(priceText))
+	if text == "" {
+		return true
+	}
+
+	for _, placeholder := range pricePlaceholders {
+		if strings.Contains(text, placeholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// PriceColumnScale is the scale of prices.price, DECIMAL(10,2)
+const PriceColumnScale = 2
+
+// currencyPrecision is the number of decimals prices are rounded to per
+// currency, currencies not listed use PriceColumnScale. Precisions above the
+// column scale are capped, the column can't hold them.
+var currencyPrecision = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+}
+
+// Config holds the settings that change how values are normalized
+type Config struct {
+	// PRICE_PRECISION overrides currencyPrecision as "JPY=0,KRW=0"
+	PricePrecision map[string]int
+	// SET_NAME_ALIASES adds set name variants as
+	// "variant=Set Name;variant=Set Name"
+	SetNameAliases map[string]string
+	// DEFAULT_CONDITION overrides DefaultCondition, as a code or a name
+	DefaultCondition string
+	// SOURCE_CURRENCIES sets the currency of a source's prices without a
+	// symbol as "eBay=GBP,Cardmarket=EUR", by lower-cased source name
+	SourceCurrencies map[string]string
+}
+
+// ReadConfig reads the normalization settings from the environment,
+// recording invalid ones in env
+func ReadConfig(env *config.Reader) Config {
+	cfg := Config{
+		PricePrecision:   make(map[string]int),
+		SetNameAliases:   make(map[string]string),
+		SourceCurrencies: make(map[string]string),
+	}
+
+	for _, entry := range config.SplitList(os.Getenv("PRICE_PRECISION")) {
+		currency, value, ok := strings.Cut(entry, "=")
+		currency = strings.ToUpper(strings.TrimSpace(currency))
+		if !ok || !CurrencyCodePattern.MatchString(currency) {
+			env.Fail("PRICE_PRECISION", fmt.Errorf("%q is not currency=decimals", entry))
+			continue
+		}
+		precision, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || precision < 0 {
+			env.Fail("PRICE_PRECISION", fmt.Errorf("decimals %q of %q is not a number of at least 0", value, entry))
+			continue
+		}
+		cfg.PricePrecision[currency] = precision
+	}
+
+	for _, entry := range strings.Split(os.Getenv("SET_NAME_ALIASES"), ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		variant, setName, ok := strings.Cut(entry, "=")
+		if !ok || SetName(variant) == "" || strings.TrimSpace(setName) == "" {
+			env.Fail("SET_NAME_ALIASES", fmt.Errorf("%q is not variant=Set Name", entry))
+			continue
+		}
+		cfg.SetNameAliases[SetName(variant)] = strings.TrimSpace(setName)
+	}
+
+	for _, entry := range config.SplitList(os.Getenv("SOURCE_CURRENCIES")) {
+		name, currency, ok := strings.Cut(entry, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			env.Fail("SOURCE_CURRENCIES", fmt.Errorf("%q is not source=currency", entry))
+			continue
+		}
+		currency = strings.ToUpper(strings.TrimSpace(currency))
+		if !CurrencyCodePattern.MatchString(currency) {
+			env.Fail("SOURCE_CURRENCIES", fmt.Errorf("currency %q is not a 3-letter code", currency))
+			continue
+		}
+		cfg.SourceCurrencies[strings.ToLower(strings.TrimSpace(name))] = currency
+	}
+
+	if value := os.Getenv("DEFAULT_CONDITION"); value != "" {
+		if cfg.DefaultCondition = Condition(value); cfg.DefaultCondition == "" {
+			env.Fail("DEFAULT_CONDITION", fmt.Errorf("%q is not a known condition", value))
+		}
+	}
+	return cfg
+}
+
+// Configure applies cfg on top of the built-in settings. It is meant to be
+// called once at startup, before anything is normalized.
+func Configure(cfg Config) {
+	maps.Copy(currencyPrecision, cfg.PricePrecision)
+	maps.Copy(setNameAliases, cfg.SetNameAliases)
+	maps.Copy(sourceCurrencies, cfg.SourceCurrencies)
+	if cfg.DefaultCondition != "" {
+		DefaultCondition = cfg.DefaultCondition
+	}
+}
+
+// PricePrecision returns the decimals a price in the currency is kept to
+func PricePrecision(currency string) int {
+	precision, ok := currencyPrecision[strings.ToUpper(currency)]
+	if !ok || precision > PriceColumnScale {
+		return PriceColumnScale
+	}
+	return precision
+}
+
+// RoundPrice rounds the amount half away from zero to the currency's
+// precision, dropping float artifacts such as 389.99000000001
+func RoundPrice(amount float64, currency string) float64 {
+	scale := math.Pow10(PricePrecision(currency))
+	return math.Round(amount*scale) / scale
+}
+
+// FormatPrice is RoundPrice as the exact decimal string that is stored
+func FormatPrice(amount float64, currency string) string {
+	return strconv.FormatFloat(RoundPrice(amount, currency), 'f', PricePrecision(currency), 64)
+}
+
+// currencySymbols are the symbols CurrencyFromText recognizes, longest
+// first. A bare "$" is left out, Canada and Australia use it too.
+var currencySymbols = []struct{ symbol, currency string }{
+	{"US$", "USD"},
+	{"CA$", "CAD"},
+	{"AU$", "AUD"},
+	{"C$", "CAD"},
+	{"A$", "AUD"},
+	{"€", "EUR"},
+	{"£", "GBP"},
+	{"¥", "JPY"},
+}
+
+// sourceCurrencies are the SOURCE_CURRENCIES entries, see SourceCurrency
+var sourceCurrencies = make(map[string]string)
+
+// SourceCurrency is the currency of the source's prices without a symbol:
+// its SOURCE_CURRENCIES entry, or USD
+func SourceCurrency(source string) string {
+	if currency, ok := sourceCurrencies[strings.ToLower(source)]; ok {
+		return currency
+	}
+	return "USD"
+}
+
+// CurrencyFromText returns the currency a price's symbol names, or "" when
+// it has none, for the source's SOURCE_CURRENCIES default to apply
+func CurrencyFromText(priceText string) string {
+	for _, s := range currencySymbols {
+		if strings.Contains(priceText, s.symbol) {
+			return s.currency
+		}
+	}
+	return ""
+}
+
+func ExtractPrice(priceText string) float64 {
+	// Remove currency symbols and extract numeric value
+	re := regexp.MustCompile(`[\d,]+\.?\d*`)
+	matches := re.FindString(strings.ReplaceAll(priceText, ",", ""))
+
+	if matches == "" {
+		return 0
+	}
+
+	price, err := strconv.ParseFloat(matches, 64)
+	if err != nil {
+		return 0
+	}
+
+	return price
+}
+
+var (
+	cardNumberPattern = regexp.MustCompile(`#\s*(\w+)`)
+	nonAlphanumeric   = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+// DefaultSetName is used when a scraped row doesn't say which set it is from
+const DefaultSetName = "Scarlet & Violet 151"
+
+// setNameAliases maps the SetName form of common set name variants
+// to the name cards are stored under. SET_NAME_ALIASES adds more, see
+// Config.
+var setNameAliases = map[string]string{
+	"scarlet violet 151":     DefaultSetName,
+	"scarlet and violet 151": DefaultSetName,
+	"sv 151":                 DefaultSetName,
+	"sv151":                  DefaultSetName,
+	"sv3pt5":                 DefaultSetName,
+	"151":                    DefaultSetName,
+}
+
+// CanonicalSetName returns the name cards of a set are stored under when
+// setName is one of its known variants
+func CanonicalSetName(setName string) (string, bool) {
+	canonical, ok := setNameAliases[SetName(setName)]
+	return canonical, ok
+}
+
+// SetNameFromConsole turns PriceCharting's console column, which holds the
+// set for cards (e.g. "Pokemon Scarlet & Violet 151"), into the set name.
+// Values that don't look like a Pokemon set fall back to the default set.
+func SetNameFromConsole(console string) string {
+	console = strings.Join(strings.Fields(console), " ")
+	if console == "" {
+		return DefaultSetName
+	}
+
+	if setName, ok := setNameAliases[SetName(console)]; ok {
+		return setName
+	}
+
+	// Only "Pokemon ..." consoles are sets, anything else is another TCG or
+	// a category
+	lower := strings.ToLower(console)
+	if !strings.HasPrefix(lower, "pokemon ") && !strings.HasPrefix(lower, "pokémon ") {
+		return DefaultSetName
+	}
+	_, setName, _ := strings.Cut(console, " ")
+	return setName
+}
+
+// ConditionNames maps the normalized condition codes to the name cards are
+// stored under
+var ConditionNames = map[string]string{
+	"NM":  "Near Mint",
+	"LP":  "Lightly Played",
+	"MP":  "Moderately Played",
+	"HP":  "Heavily Played",
+	"DMG": "Damaged",
+}
+
+// conditionAliases maps the conditionKey form of the condition strings
+// sources use to a code in ConditionNames. Cardmarket's grades (MT, EX, GD,
+// PL, PO) are folded into the closest TCGPlayer one. They are tried in
+// order, so an alias comes before the shorter ones it starts with.
+var conditionAliases = []struct{ alias, code string }{
+	{"near mint or better", "NM"},
+	{"moderately played", "MP"},
+	{"heavily played", "HP"},
+	{"lightly played", "LP"},
+	{"light played", "LP"},
+	{"near mint", "NM"},
+	{"excellent", "LP"},
+	{"damaged", "DMG"},
+	{"played", "MP"},
+	{"good", "MP"},
+	{"poor", "HP"},
+	{"mint", "NM"},
+	{"nm m", "NM"},
+	{"dmg", "DMG"},
+	{"nm", "NM"}, {"mt", "NM"},
+	{"lp", "LP"}, {"ex", "LP"},
+	{"mp", "MP"}, {"gd", "MP"},
+	{"hp", "HP"}, {"pl", "HP"},
+	{"po", "DMG"},
+}
+
+// DefaultCondition is stored when a source doesn't say what condition a
+// listing is in. DEFAULT_CONDITION overrides it, see Config.
+var DefaultCondition = ConditionNames["NM"]
+
+// Condition turns a scraped condition such as "Lightly Played
+// Holofoil" or "NM/M" into its stored name. It returns "" when the string
+// isn't a known condition.
+func Condition(raw string) string {
+	key := conditionKey(raw)
+	for _, alias := range conditionAliases {
+		if key == alias.alias {
+			return ConditionNames[alias.code]
+		}
+	}
+
+	// TCGPlayer appends the printing, e.g. "Near Mint Reverse Holofoil"
+	for _, alias := range conditionAliases {
+		if len(alias.alias) > 2 && strings.HasPrefix(key, alias.alias+" ") {
+			return ConditionNames[alias.code]
+		}
+	}
+	return ""
+}
+
+// conditionKey lowercases a condition and collapses punctuation and
+// whitespace to single spaces, so "NM/M" and "nm-m" are both "nm m"
+func conditionKey(raw string) string {
+	return strings.TrimSpace(nonAlphanumeric.ReplaceAllString(strings.ToLower(raw), " "))
+}
+
+// ConditionOrDefault is Condition falling back to DefaultCondition
+func ConditionOrDefault(raw string) string {
+	if condition := Condition(raw); condition != "" {
+		return condition
+	}
+	return DefaultCondition
+}
+
+// CardKey builds the key two scraped cards are compared on, so that
+// "Charizard EX #199" and "charizard ex" in "Pokemon Scarlet & Violet 151"
+// resolve to the same card
+func CardKey(name, setName, number string) string {
+	if number == "" {
+		number = CardNumberFromName(name)
+	}
+	return CardName(name) + "|" + SetName(setName) + "|" + CardNumber(number)
+}
+
+// CardName lowercases the name, drops any "#123" card number and
+// collapses punctuation and whitespace to single spaces
+func CardName(name string) string {
+	name = cardNumberPattern.ReplaceAllString(strings.ToLower(name), " ")
+	return strings.TrimSpace(nonAlphanumeric.ReplaceAllString(name, " "))
+}
+
+// SetName is CardName without the leading "pokemon"
+// PriceCharting puts in front of its set names
+func SetName(setName string) string {
+	return strings.TrimPrefix(CardName(setName), "pokemon ")
+}
+
+// CardNumber drops the set size ("199/165") and leading zeros
+func CardNumber(number string) string {
+	number, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(number)), "/")
+	number = strings.TrimPrefix(number, "#")
+	if trimmed := strings.TrimLeft(number, "0"); trimmed != "" {
+		number = trimmed
+	}
+	return number
+}
+
+// CardNumberFromName returns the "#123" card number from a scraped name
+func CardNumberFromName(name string) string {
+	if match := cardNumberPattern.FindStringSubmatch(name); match != nil {
+		return CardNumber(match[1])
+	}
+	return ""
+}
+
+var CurrencyCodePattern = regexp.MustCompile(`^[A-Z]{3}$`)
@@ -0,0 +1,123 @@
+package normalize
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsPricePlaceholder(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		{"", true},
+		{"   ", true},
+		{"Loading...", true},
+		{"loading", true},
+		{"…", true},
+		{"{{ price }}", true},
+		{"$4.50", false},
+		// missing prices rather than placeholders, ExtractPrice reads
+		// them as 0 and they are skipped like any price that isn't positive
+		{"-", false},
+		{"N/A", false},
+	}
+	for _, test := range tests {
+		if got := IsPricePlaceholder(test.text); got != test.want {
+			t.Errorf("IsPricePlaceholder(%q) = %t, want %t", test.text, got, test.want)
+		}
+	}
+}
+
+func TestExtractPrice(t *testing.T) {
+	tests := []struct {
+		text string
+		want float64
+	}{
+		{"$4.50", 4.5},
+		{"$1,024.50", 1024.5},
+		{"US$ 12", 12},
+		{"-", 0},
+		{"N/A", 0},
+		{"", 0},
+		{"Loading...", 0},
+	}
+	for _, test := range tests {
+		if got := ExtractPrice(test.text); got != test.want {
+			t.Errorf("ExtractPrice(%q) = %v, want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestRoundPrice(t *testing.T) {
+	tests := []struct {
+		amount    float64
+		currency  string
+		want      float64
+		formatted string
+	}{
+		{389.99000000001, "USD", 389.99, "389.99"},
+		{389.98999999999, "USD", 389.99, "389.99"},
+		{0.1 + 0.2, "USD", 0.3, "0.30"},
+		{2.675, "EUR", 2.68, "2.68"},
+		{12, "usd", 12, "12.00"},
+		{1499.5, "JPY", 1500, "1500"},
+		{1499.4999999, "jpy", 1499, "1499"},
+		{38999.00000001, "KRW", 38999, "38999"},
+	}
+	for _, test := range tests {
+		if got := RoundPrice(test.amount, test.currency); got != test.want {
+			t.Errorf("RoundPrice(%v, %s) = %v, want %v", test.amount, test.currency, got, test.want)
+		}
+		if got := FormatPrice(test.amount, test.currency); got != test.formatted {
+			t.Errorf("FormatPrice(%v, %s) = %q, want %q", test.amount, test.currency, got, test.formatted)
+		}
+	}
+}
+
+func TestCondition(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{"NM", "Near Mint"},
+		{"Near Mint", "Near Mint"},
+		{"NM/M", "Near Mint"},
+		{"nm-m", "Near Mint"},
+		{"Near Mint or Better", "Near Mint"},
+		{"Near Mint Reverse Holofoil", "Near Mint"},
+		{"Lightly Played Holofoil", "Lightly Played"},
+		{"Light Played", "Lightly Played"},
+		{"EX", "Lightly Played"},
+		{"Moderately Played 1st Edition", "Moderately Played"},
+		{"Played", "Moderately Played"},
+		{"GD", "Moderately Played"},
+		{"Heavily Played", "Heavily Played"},
+		{"PL", "Heavily Played"},
+		{"Damaged", "Damaged"},
+		{"PO", "Damaged"},
+		// the set-name normalization drops a "pokemon" prefix, this doesn't
+		{"Pokemon Near Mint", ""},
+		{"#12", ""},
+		{"", ""},
+		{"Sealed", ""},
+		// two-letter codes only match whole
+		{"EXtra", ""},
+	}
+	for _, test := range tests {
+		if got := Condition(test.raw); got != test.want {
+			t.Errorf("Condition(%q) = %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestConditionAliasOrder(t *testing.T) {
+	// a shorter alias listed first would shadow the longer one as a prefix
+	for i, alias := range conditionAliases {
+		for _, earlier := range conditionAliases[:i] {
+			if len(earlier.alias) > 2 && strings.HasPrefix(alias.alias, earlier.alias+" ") {
+				t.Errorf("%q comes after %q, which it starts with", alias.alias, earlier.alias)
+			}
+		}
+	}
+}
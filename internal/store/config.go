@@ -0,0 +1,118 @@
+package store
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"Pokemonscraper/internal/config"
+)
+
+// DatabaseConfig is the part of the configuration NewDatabase needs. It is
+// split out so the CSV scraper's database sink can load it on its own.
+type DatabaseConfig struct {
+	URL                string        // DATABASE_URL, overrides the fields below
+	ReadURL            string        // DATABASE_URL_READ, a replica for read-only queries
+	Host               string        // DB_HOST
+	Port               string        // DB_PORT
+	User               string        // DB_USER
+	Password           string        // DB_PASSWORD
+	Name               string        // DB_NAME
+	SSLMode            string        // DB_SSLMODE
+	Schema             string        // DB_SCHEMA, where the tables live
+	SlowQueryThreshold time.Duration // SLOW_QUERY_THRESHOLD, 0 disables the slow query log
+	TrendStablePercent float64       // TREND_STABLE_PERCENT, see ClassifyTrend
+}
+
+// ConnectionString returns DATABASE_URL or the DB_* settings as a lib/pq
+// connection string, with DB_SCHEMA as its search_path
+func (c DatabaseConfig) ConnectionString() string {
+	if c.URL != "" {
+		return withSearchPath(c.URL, c.Schema)
+	}
+	return withSearchPath(fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
+		c.Host, c.Port, c.User, c.Password, c.Name, c.SSLMode), c.Schema)
+}
+
+// ReadConnectionString is DATABASE_URL_READ with DB_SCHEMA as its
+// search_path
+func (c DatabaseConfig) ReadConnectionString() string {
+	return withSearchPath(c.ReadURL, c.Schema)
+}
+
+// passwordSettingPattern matches the password settings of a key/value
+// connection string or a URL's query, quoted or not
+var passwordSettingPattern = regexp.MustCompile(`(?i)\b(password|sslpassword)(\s*=\s*)('(?:[^'\\]|\\.)*'|[^\s&]*)`)
+
+// RedactConnectionString masks the passwords of a connection string for
+// the log: the userinfo of a postgres:// URL, its password query
+// parameters, and password= in a key/value string
+func RedactConnectionString(connStr string) string {
+	if scheme, rest, ok := strings.Cut(connStr, "://"); ok {
+		// the userinfo ends at the last @, not parsing the URL keeps
+		// passwords with unescaped characters such as / or # masked too
+		if at := strings.LastIndex(rest, "@"); at >= 0 {
+			user, _, hasPassword := strings.Cut(rest[:at], ":")
+			if hasPassword {
+				connStr = scheme + "://" + user + ":****" + rest[at:]
+			}
+		}
+	}
+	return passwordSettingPattern.ReplaceAllString(connStr, "$1$2****")
+}
+
+// schemaPattern matches the schema names DB_SCHEMA accepts: unquoted
+// Postgres identifiers, so they need no escaping in connection strings
+var schemaPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,62}$`)
+
+// withSearchPath adds search_path to a connection string, which lib/pq
+// sends along when connecting so it applies to every pooled connection.
+// The default public schema leaves the string as it is.
+func withSearchPath(connStr, schema string) string {
+	if schema == "" || schema == "public" {
+		return connStr
+	}
+	if strings.HasPrefix(connStr, "postgres://") || strings.HasPrefix(connStr, "postgresql://") {
+		if u, err := url.Parse(connStr); err == nil {
+			query := u.Query()
+			query.Set("search_path", schema)
+			u.RawQuery = query.Encode()
+			return u.String()
+		}
+	}
+	return connStr + " search_path=" + schema
+}
+
+// LoadDatabaseConfig reads and validates just the database settings
+func LoadDatabaseConfig() (DatabaseConfig, error) {
+	env := &config.Reader{}
+	cfg := ReadDatabaseConfig(env)
+	return cfg, env.Err()
+}
+
+func ReadDatabaseConfig(env *config.Reader) DatabaseConfig {
+	cfg := DatabaseConfig{
+		URL:                os.Getenv("DATABASE_URL"),
+		ReadURL:            os.Getenv("DATABASE_URL_READ"),
+		Host:               config.Get("DB_HOST", "localhost"),
+		Port:               config.Get("DB_PORT", "5432"),
+		User:               config.Get("DB_USER", "postgres"),
+		Password:           config.Get("DB_PASSWORD", "password"),
+		Name:               config.Get("DB_NAME", "pokemon_cards"),
+		SSLMode:            config.Get("DB_SSLMODE", "disable"),
+		Schema:             config.Get("DB_SCHEMA", "public"),
+		SlowQueryThreshold: env.Duration("SLOW_QUERY_THRESHOLD", "500ms", 0),
+		TrendStablePercent: env.Float("TREND_STABLE_PERCENT", 2, 0),
+	}
+	if n, err := strconv.Atoi(cfg.Port); err != nil || n < 1 || n > 65535 {
+		env.Fail("DB_PORT", fmt.Errorf("%q is not a number between 1 and 65535", cfg.Port))
+	}
+	if !schemaPattern.MatchString(cfg.Schema) {
+		env.Fail("DB_SCHEMA", fmt.Errorf("%q is not a schema name of letters, digits and underscores", cfg.Schema))
+	}
+	return cfg
+}
@@ -0,0 +1,230 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+
+	"Pokemonscraper/internal/normalize"
+)
+
+// testDatabase connects to TEST_DATABASE_URL with the tables in a schema of
+// their own, dropped when the test ends. Without it the test is skipped.
+func testDatabase(t *testing.T) *Database {
+	t.Helper()
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	schema := fmt.Sprintf("test_%d", time.Now().UnixNano())
+	db, err := NewDatabase(DatabaseConfig{URL: url, Schema: schema})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.conn.Exec(`DROP SCHEMA ` + pq.QuoteIdentifier(schema) + ` CASCADE`); err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+		db.Close()
+	})
+	return db
+}
+
+func TestGetCardsForFrontendStableOrder(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+
+	var ids []int
+	for _, name := range []string{"Pikachu", "Eevee", "Bulbasaur", "Squirtle"} {
+		id, err := db.InsertCard(Card{Name: name, SetName: "Base Set", Condition: "Near Mint"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.InsertPrice(Price{CardID: id, Source: "tcgplayer", Price: 10, Currency: "USD"}); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	// every card ties on price and on updated_at, leaving the id to order them
+	if _, err := db.conn.Exec(`UPDATE cards SET updated_at = '2024-01-01'`); err != nil {
+		t.Fatal(err)
+	}
+
+	order := func() []int {
+		cards, err := db.GetCardsForFrontend(ctx, CardFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []int
+		for _, card := range cards {
+			got = append(got, card.ID)
+		}
+		return got
+	}
+	first, second := order(), order()
+	if !slices.Equal(first, ids) {
+		t.Errorf("first query ordered cards %v, want %v", first, ids)
+	}
+	if !slices.Equal(second, first) {
+		t.Errorf("second query ordered cards %v, first %v", second, first)
+	}
+}
+
+func TestUpsertCardImage(t *testing.T) {
+	db := testDatabase(t)
+
+	card := Card{Name: "Pikachu", SetName: "Base Set", Condition: "Near Mint"}
+	steps := []struct {
+		imageURL string
+		want     sql.NullString
+	}{
+		{"", sql.NullString{}},
+		{"https://example.com/pikachu.jpg", sql.NullString{String: "https://example.com/pikachu.jpg", Valid: true}},
+		{"", sql.NullString{String: "https://example.com/pikachu.jpg", Valid: true}},
+		{"https://example.com/pikachu-2.jpg", sql.NullString{String: "https://example.com/pikachu-2.jpg", Valid: true}},
+	}
+	for i, step := range steps {
+		card.ImageURL = step.imageURL
+		id, err := db.InsertCard(card)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got sql.NullString
+		if err := db.conn.QueryRow(`SELECT image_url FROM cards WHERE id = $1`, id).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != step.want {
+			t.Errorf("after upsert %d with image %q, image_url = %v, want %v", i, step.imageURL, got, step.want)
+		}
+	}
+}
+
+func TestInsertPriceRounds(t *testing.T) {
+	db := testDatabase(t)
+
+	id, err := db.InsertCard(Card{Name: "Charizard", SetName: "Base Set", Condition: "Near Mint"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prices := map[string]struct{ price, want float64 }{
+		"USD": {389.99000000001, 389.99},
+		"JPY": {1499.6, 1500},
+	}
+	for currency, price := range prices {
+		if err := db.InsertPrice(Price{CardID: id, Source: "test", Price: price.price, Currency: currency}); err != nil {
+			t.Fatal(err)
+		}
+		var stored float64
+		if err := db.conn.QueryRow(`SELECT price FROM prices WHERE card_id = $1 AND currency = $2`, id, currency).Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored != price.want {
+			t.Errorf("%v %s stored as %v, want %v", price.price, currency, stored, price.want)
+		}
+	}
+}
+
+func TestGetCardWithPricesInUSD(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+
+	id, err := db.InsertCard(Card{Name: "Charizard", SetName: "Base Set", Condition: "Near Mint"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, price := range []Price{
+		{Source: "tcgplayer", Price: 100, Currency: "USD"},
+		{Source: "cardmarket", Price: 180, Currency: "EUR"},
+		{Source: "yuyutei", Price: 30000, Currency: "JPY"},
+	} {
+		price.CardID = id
+		if err := db.InsertPrice(price); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// EUR has a rate, JPY doesn't and is left out
+	card, err := db.GetCardWithPrices(ctx, id, map[string]float64{"EUR": 0.9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(card.Prices) != 3 {
+		t.Errorf("got %d prices, want all 3 in their own currency", len(card.Prices))
+	}
+	if card.MinPrice != 100 || card.MaxPrice != 200 || card.AvgPrice != 150 || card.Card.Price != 150 {
+		t.Errorf("min %v, max %v, avg %v, price %v, want 100, 200, 150 and 150 USD",
+			card.MinPrice, card.MaxPrice, card.AvgPrice, card.Card.Price)
+	}
+}
+
+func TestMatchKeysMirrorNormalize(t *testing.T) {
+	db := testDatabase(t)
+
+	names := []string{"Charizard ex #199", "Pokémon Scarlet & Violet 151", "Mew-EX (Full Art)", "  Pikachu  #025/165 ", "Mr. Mime", ""}
+	numbers := []string{"199/165", "#025", "000", " 7 ", "SV-P 12", ""}
+	for _, name := range names {
+		var nameKey, setKey string
+		if err := db.conn.QueryRow(`SELECT card_name_key($1), set_name_key($1)`, name).Scan(&nameKey, &setKey); err != nil {
+			t.Fatal(err)
+		}
+		if want := normalize.CardName(name); nameKey != want {
+			t.Errorf("card_name_key(%q) = %q, normalize.CardName = %q", name, nameKey, want)
+		}
+		if want := normalize.SetName(name); setKey != want {
+			t.Errorf("set_name_key(%q) = %q, normalize.SetName = %q", name, setKey, want)
+		}
+	}
+	for _, number := range numbers {
+		var numberKey string
+		if err := db.conn.QueryRow(`SELECT card_number_key($1)`, number).Scan(&numberKey); err != nil {
+			t.Fatal(err)
+		}
+		if want := normalize.CardNumber(number); numberKey != want {
+			t.Errorf("card_number_key(%q) = %q, normalize.CardNumber = %q", number, numberKey, want)
+		}
+	}
+}
+
+func TestMatchCard(t *testing.T) {
+	db := testDatabase(t)
+	ctx := context.Background()
+
+	numbered, _, err := db.UpsertCard(Card{Name: "Charizard ex", SetName: "Scarlet & Violet 151", CardNumber: "199/165", Condition: "Near Mint"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromName, _, err := db.UpsertCard(Card{Name: "Mew ex #151", SetName: "Scarlet & Violet 151", Condition: "Near Mint"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, set, number string
+		want              int
+	}{
+		{"charizard EX", "", "", numbered},
+		{"Charizard ex", "Pokemon Scarlet & Violet 151", "199", numbered},
+		{"Charizard ex", "", "0199", numbered},
+		{"Charizard ex", "", "4", 0},
+		{"Charizard ex", "Obsidian Flames", "", 0},
+		{"Mew ex", "", "151", fromName},
+		{"Mew ex #151", "", "", fromName},
+		{"Mewtwo", "", "", 0},
+	}
+	for _, test := range tests {
+		card, _, found, err := db.MatchCard(ctx, test.name, test.set, test.number)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != (test.want != 0) || card.ID != test.want {
+			t.Errorf("MatchCard(%q, %q, %q) = card %d, found %t, want card %d", test.name, test.set, test.number, card.ID, found, test.want)
+		}
+	}
+}
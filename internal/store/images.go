@@ -0,0 +1,200 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// took this from a collection of
+var builtinCardImages = map[string]string{
+	"charizard": "🔥", "pikachu": "⚡", "mew": "💫", "alakazam": "🔮",
+	"venusaur": "🌿", "blastoise": "🌊", "gengar": "👻", "dragonite": "🐉",
+	"mewtwo": "🧬", "rayquaza": "🌟", "lucario": "⚔️", "garchomp": "🦈",
+	"eevee": "🦊", "snorlax": "😴", "gyarados": "🐲", "machamp": "💪",
+	"psyduck": "🦆", "magikarp": "🐟", "squirtle": "🐢", "bulbasaur": "🌱",
+}
+
+// DefaultCardImage is the emoji of cards without one of their own, and
+// replaces images that aren't valid UTF-8
+const DefaultCardImage = "🎴"
+
+// cardImages is the mapping in use: the built-in emojis with the CARD_IMAGES
+// file on top. Maps are replaced, never modified, so a map returned by
+// CurrentCardImages stays valid.
+var cardImages = struct {
+	sync.RWMutex
+	images map[string]string
+}{images: builtinCardImages}
+
+// CurrentCardImages returns the mapping in use
+func CurrentCardImages() map[string]string {
+	cardImages.RLock()
+	defer cardImages.RUnlock()
+	return cardImages.images
+}
+
+// SetCardImages puts the overrides on top of the built-in mapping and
+// returns the mapping it replaced
+func SetCardImages(overrides map[string]string) map[string]string {
+	images := maps.Clone(builtinCardImages)
+	maps.Copy(images, overrides)
+
+	cardImages.Lock()
+	defer cardImages.Unlock()
+	previous := cardImages.images
+	cardImages.images = images
+	return previous
+}
+
+// LoadCardImages reads the CARD_IMAGES file, a JSON object of Pokémon names
+// to an emoji or an http(s) image URL
+func LoadCardImages(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries map[string]string
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	images := make(map[string]string, len(entries))
+	var errs []error
+	for name, image := range entries {
+		name, image = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(image)
+		switch {
+		case name == "":
+			errs = append(errs, errors.New("a name is empty"))
+		case IsImageURL(image):
+			if u, err := url.Parse(image); err != nil || u.Host == "" {
+				errs = append(errs, fmt.Errorf("%s: %q is not a valid URL", name, image))
+			}
+		case image == "" || !utf8.ValidString(image) || utf8.RuneCountInString(image) > 8:
+			errs = append(errs, fmt.Errorf("%s: %q is neither an emoji nor an http(s) URL", name, image))
+		}
+		images[name] = image
+	}
+	return images, errors.Join(errs...)
+}
+
+// IsImageURL tells an image URL from an emoji in the mapping
+func IsImageURL(image string) bool {
+	return strings.HasPrefix(image, "http://") || strings.HasPrefix(image, "https://")
+}
+
+// matchCardImage returns the mapping's value for the Pokémon in the card's
+// name, "" if none matches. The longest matching name wins, so Mewtwo gets
+// its own image instead of Mew's.
+func matchCardImage(images map[string]string, cardName string) string {
+	cardName = strings.ToLower(cardName)
+	image, matched := "", ""
+	for name, value := range images {
+		if len(name) > len(matched) && strings.Contains(cardName, name) {
+			image, matched = value, name
+		}
+	}
+	return image
+}
+
+// CardEmoji picks the emoji of the Pokémon in the card's name. Cards mapped
+// to an image URL get the default emoji, their picture is in image_url.
+func CardEmoji(cardName string) string {
+	return emojiFor(CurrentCardImages(), cardName)
+}
+
+func emojiFor(images map[string]string, cardName string) string {
+	image := matchCardImage(images, cardName)
+	if image == "" || IsImageURL(image) || !utf8.ValidString(image) {
+		return DefaultCardImage
+	}
+	return image
+}
+
+// ImageRebuild counts what re-applying the image mapping changed
+type ImageRebuild struct {
+	Cards     int `json:"cards"`
+	Updated   int `json:"updated"`
+	ImageURLs int `json:"image_urls"`
+	Emojis    int `json:"emojis"`
+}
+
+// ApplyCardImages re-applies the image mapping to every card. Cards mapped
+// to a URL get it as image_url; image URLs the previous mapping set are
+// cleared when a card isn't mapped to a URL anymore, scraped ones are kept.
+// Emojis aren't stored, cards whose emoji changed are only counted.
+func (db *Database) ApplyCardImages(ctx context.Context, previous, images map[string]string) (ImageRebuild, error) {
+	defer db.observeQuery(ctx, "apply_card_images", time.Now())
+
+	var result ImageRebuild
+	rows, err := db.conn.QueryContext(ctx, `SELECT id, name, COALESCE(image_url, '') FROM cards`)
+	if err != nil {
+		return result, fmt.Errorf("failed to query cards: %v", err)
+	}
+	type imageUpdate struct {
+		id       int
+		imageURL string
+	}
+	var updates []imageUpdate
+	for rows.Next() {
+		var id int
+		var name, imageURL string
+		if err := rows.Scan(&id, &name, &imageURL); err != nil {
+			rows.Close()
+			return result, fmt.Errorf("failed to scan card: %v", err)
+		}
+		result.Cards++
+
+		newURL := imageURL
+		if image := matchCardImage(images, name); IsImageURL(image) {
+			newURL = image
+		} else if old := matchCardImage(previous, name); IsImageURL(old) && old == imageURL {
+			newURL = ""
+		}
+		urlChanged := newURL != imageURL
+		emojiChanged := emojiFor(previous, name) != emojiFor(images, name)
+
+		if urlChanged {
+			updates = append(updates, imageUpdate{id, newURL})
+			result.ImageURLs++
+		}
+		if emojiChanged {
+			result.Emojis++
+		}
+		if urlChanged || emojiChanged {
+			result.Updated++
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return result, fmt.Errorf("error iterating over cards: %v", err)
+	}
+	if len(updates) == 0 {
+		return result, nil
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return result, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+	for _, update := range updates {
+		if _, err := tx.ExecContext(ctx,
+			`UPDATE cards SET image_url = NULLIF($2, '') WHERE id = $1`,
+			update.id, update.imageURL); err != nil {
+			return result, fmt.Errorf("failed to update card %d: %v", update.id, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return result, fmt.Errorf("failed to commit images: %v", err)
+	}
+	return result, nil
+}
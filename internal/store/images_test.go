@@ -0,0 +1,32 @@
+package store
+
+import (
+	"maps"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCardEmojiIsValidUTF8(t *testing.T) {
+	images := maps.Clone(builtinCardImages)
+	// a mapping with mojibake, cards matching it get the default
+	images["raichu"] = "\xf0\x9f\x94"
+	images["jolteon"] = "https://example.com/jolteon.png"
+
+	cardNames := []string{"Missingno"}
+	for name := range images {
+		cardNames = append(cardNames, "Dark "+name+" ex #12")
+	}
+	for _, cardName := range cardNames {
+		if image := emojiFor(images, cardName); image == "" || !utf8.ValidString(image) {
+			t.Errorf("emojiFor(%q) = %q, not a valid UTF-8 emoji", cardName, image)
+		}
+	}
+	for name, image := range builtinCardImages {
+		if !utf8.ValidString(image) {
+			t.Errorf("built-in image of %s is %q, not valid UTF-8", name, image)
+		}
+	}
+	if got := emojiFor(images, "Raichu"); got != DefaultCardImage {
+		t.Errorf("emojiFor(Raichu) = %q, want the default %q", got, DefaultCardImage)
+	}
+}
@@ -0,0 +1,62 @@
+package store
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Price types of PriceCharting's results table. Each is stored as its own
+// card condition and source, like PriceCharting's grades.
+const (
+	PriceTypeLoose    = "loose"
+	PriceTypeComplete = "complete"
+	PriceTypeNew      = "new"
+	PriceTypeGraded   = "graded"
+)
+
+// SourceLabel is what a price's source column says: the provider, and for
+// providers with several price types, which one and its grade. A
+// provider's main price, the raw card price every source tracks, is stored
+// under its plain name, e.g. "TCGPlayer". Other price types are
+// provider:priceType[:grade] in lower case without spaces, e.g.
+// "pricecharting:complete" or "pricecharting:graded:psa10".
+type SourceLabel struct {
+	Provider  string
+	PriceType string
+	Grade     string
+}
+
+// String formats the label as it is stored
+func (l SourceLabel) String() string {
+	if (l.PriceType == "" || l.PriceType == PriceTypeLoose) && l.Grade == "" {
+		return l.Provider
+	}
+	parts := []string{labelPart(l.Provider), labelPart(l.PriceType)}
+	if l.Grade != "" {
+		parts = append(parts, labelPart(l.Grade))
+	}
+	return strings.Join(parts, ":")
+}
+
+// labelPart lower-cases a part of a source label and drops the spaces and
+// colons in it, "PSA 10" becomes "psa10"
+func labelPart(part string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ':' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, part)
+}
+
+// ParseSourceLabel splits a stored source into its parts. Plain names are
+// a provider's main price, their type is loose. The provider is lower case
+// either way, so a provider's labels group together.
+func ParseSourceLabel(source string) SourceLabel {
+	provider, rest, structured := strings.Cut(source, ":")
+	label := SourceLabel{Provider: strings.ToLower(strings.TrimSpace(provider)), PriceType: PriceTypeLoose}
+	if structured {
+		label.PriceType, label.Grade, _ = strings.Cut(rest, ":")
+	}
+	return label
+}
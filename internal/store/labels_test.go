@@ -0,0 +1,40 @@
+package store
+
+import "testing"
+
+func TestSourceLabel(t *testing.T) {
+	tests := []struct {
+		label  SourceLabel
+		source string
+		parsed SourceLabel
+	}{
+		{SourceLabel{Provider: "TCGPlayer"}, "TCGPlayer", SourceLabel{"tcgplayer", PriceTypeLoose, ""}},
+		{SourceLabel{"PriceCharting", PriceTypeLoose, ""}, "PriceCharting", SourceLabel{"pricecharting", PriceTypeLoose, ""}},
+		{SourceLabel{"PriceCharting", PriceTypeComplete, ""}, "pricecharting:complete", SourceLabel{"pricecharting", PriceTypeComplete, ""}},
+		{SourceLabel{"PriceCharting", PriceTypeNew, ""}, "pricecharting:new", SourceLabel{"pricecharting", PriceTypeNew, ""}},
+		{SourceLabel{"PriceCharting", PriceTypeGraded, "PSA 10"}, "pricecharting:graded:psa10", SourceLabel{"pricecharting", PriceTypeGraded, "psa10"}},
+		{SourceLabel{"Price Charting", PriceTypeGraded, "BGS 9.5"}, "pricecharting:graded:bgs9.5", SourceLabel{"pricecharting", PriceTypeGraded, "bgs9.5"}},
+		// a grade alone still needs the structured form
+		{SourceLabel{"PriceCharting", PriceTypeLoose, "Grade: 9"}, "pricecharting:loose:grade9", SourceLabel{"pricecharting", PriceTypeLoose, "grade9"}},
+	}
+	for _, test := range tests {
+		source := test.label.String()
+		if source != test.source {
+			t.Errorf("%+v formats as %q, want %q", test.label, source, test.source)
+		}
+		if got := ParseSourceLabel(source); got != test.parsed {
+			t.Errorf("ParseSourceLabel(%q) = %+v, want %+v", source, got, test.parsed)
+		}
+		// a parsed label formats as the stored source, up to the case of
+		// a plain provider name
+		if again := ParseSourceLabel(source).String(); ParseSourceLabel(again) != test.parsed {
+			t.Errorf("%q doesn't round trip, it formats again as %q", source, again)
+		}
+	}
+}
+
+func TestParseSourceLabelPlainName(t *testing.T) {
+	if got := ParseSourceLabel(" eBay "); got != (SourceLabel{"ebay", PriceTypeLoose, ""}) {
+		t.Errorf("ParseSourceLabel(\" eBay \") = %+v, want ebay's loose price", got)
+	}
+}
@@ -0,0 +1,1408 @@
+package store
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"Pokemonscraper/internal/logctx"
+	"Pokemonscraper/internal/normalize"
+
+	"github.com/lib/pq"
+)
+
+func (db *Database) InsertCard(card Card) (int, error) {
+	cardID, _, err := db.UpsertCard(card)
+	return cardID, err
+}
+
+// UpsertCard is InsertCard that also reports whether the card is new
+func (db *Database) UpsertCard(card Card) (int, bool, error) {
+	defer db.observeQuery(context.Background(), "insert_card", time.Now())
+
+	return insertCard(db.conn, card)
+}
+
+// insertCard inserts the card or updates the existing one, returning its ID
+// and whether it was created. Without a ProductType a new card is a single
+// and an existing one keeps its own.
+func insertCard(ex dbExecutor, card Card) (int, bool, error) {
+	var cardID int
+	var created bool
+	query := `
+		INSERT INTO cards (name, set_name, card_number, rarity, condition, product_type, image_url) 
+		VALUES ($1, $2, $3, $4, $5, COALESCE(NULLIF($6, ''), '` + ProductTypeSingle + `'), NULLIF($7, '')) 
+		ON CONFLICT (name, set_name, card_number, condition) 
+		DO UPDATE SET 
+			updated_at = CURRENT_TIMESTAMP,
+			rarity = EXCLUDED.rarity,
+			product_type = COALESCE(NULLIF($6, ''), cards.product_type),
+			-- a scrape without an image keeps the one we already have
+			image_url = COALESCE(EXCLUDED.image_url, cards.image_url),
+			stale = FALSE
+		RETURNING id, (xmax = 0) AS created`
+
+	err := ex.QueryRow(query, card.Name, card.SetName, card.CardNumber, card.Rarity, card.Condition, card.ProductType,
+		card.ImageURL).Scan(&cardID, &created)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to insert/update card: %v", err)
+	}
+
+	log.Printf("Inserted/Updated card: %s (ID: %d)", card.Name, cardID)
+	return cardID, created, nil
+}
+
+func (db *Database) InsertPrice(price Price) error {
+	defer db.observeQuery(context.Background(), "insert_price", time.Now())
+
+	return insertPrice(db.conn, price)
+}
+
+// LatestPrice returns the card's last price from the source and region.
+// It reads the primary, the price is compared with one about to be stored.
+func (db *Database) LatestPrice(ctx context.Context, cardID int, source, region string) (float64, bool, error) {
+	defer db.observeQuery(ctx, "latest_price", time.Now())
+
+	var price float64
+	err := db.conn.QueryRowContext(ctx, `
+		SELECT price FROM prices
+		WHERE card_id = $1 AND source = $2 AND COALESCE(region, '') = $3
+		ORDER BY scraped_at DESC
+		LIMIT 1`, cardID, source, region).Scan(&price)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to query latest price: %v", err)
+	}
+	return price, true, nil
+}
+
+// insertPrice stores the price as scraped now unless ScrapedAt is set
+func insertPrice(ex dbExecutor, price Price) error {
+	scrapedAt := price.ScrapedAt
+	if scrapedAt.IsZero() {
+		scrapedAt = time.Now()
+	}
+
+	// sent as text so no float artifacts reach the DECIMAL column
+	amount := normalize.FormatPrice(price.Price, price.Currency)
+
+	query := `INSERT INTO prices (card_id, source, price, currency, url, scraped_at, region, listings, population)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9)`
+	_, err := ex.Exec(query, price.CardID, price.Source, amount, price.Currency, price.URL, scrapedAt, price.Region,
+		price.Listings, price.Population)
+	if err != nil {
+		return fmt.Errorf("failed to insert price: %v", err)
+	}
+
+	log.Printf("Inserted price: $%s for card ID %d from %s", amount, price.CardID, price.Source)
+	return nil
+}
+
+// latestPricesSQL is the latest_prices CTE, each source's latest price per
+// card. It goes after a WITH.
+const latestPricesSQL = `
+		latest_prices AS (
+			SELECT DISTINCT ON (card_id, source, COALESCE(region, '')) 
+				card_id, source, COALESCE(region, '') as region, price, COALESCE(currency, 'USD') as currency,
+				scraped_at, listings, population
+			FROM prices 
+			ORDER BY card_id, source, COALESCE(region, ''), scraped_at DESC
+		)`
+
+// priceWindowsSQL is latestPricesSQL and the previous_prices CTE the change
+// metrics are computed from, the price each source had at least an hour
+// before its latest. It goes after a WITH.
+const priceWindowsSQL = latestPricesSQL + `,
+		previous_prices AS (
+			SELECT DISTINCT ON (p.card_id, p.source, COALESCE(p.region, '')) 
+				p.card_id, p.source, COALESCE(p.region, '') as region, p.price as prev_price
+			FROM prices p
+			WHERE p.scraped_at < (
+				SELECT MAX(scraped_at) - INTERVAL '1 hour' 
+				FROM prices p2 
+				WHERE p2.card_id = p.card_id AND p2.source = p.source
+					AND COALESCE(p2.region, '') = COALESCE(p.region, '')
+			)
+			ORDER BY p.card_id, p.source, COALESCE(p.region, ''), p.scraped_at DESC
+		)`
+
+// changeMetricsViewSQL materializes previous_prices, the costly part of the
+// change metrics, for GetCardsForFrontend to compare the latest prices with.
+// Scrapes refresh it once they are done, other price changes such as
+// imports need a RefreshChangeMetrics.
+const changeMetricsViewSQL = `
+	CREATE MATERIALIZED VIEW IF NOT EXISTS card_change_metrics AS
+		WITH ` + priceWindowsSQL + `
+		SELECT card_id, source, region, prev_price, CURRENT_TIMESTAMP as computed_at
+		FROM previous_prices;
+
+	CREATE UNIQUE INDEX IF NOT EXISTS card_change_metrics_source ON card_change_metrics (card_id, source, region);`
+
+// createChangeMetricsView creates the card_change_metrics view. With rebuild
+// it is dropped first, so it picks up a changed definition. A view from
+// before it held each source's prev_price is rebuilt either way.
+func (db *Database) createChangeMetricsView(ctx context.Context, rebuild bool) error {
+	if !rebuild {
+		var outdated bool
+		err := db.conn.QueryRowContext(ctx, `
+			SELECT to_regclass('card_change_metrics') IS NOT NULL AND NOT EXISTS (
+				SELECT 1 FROM pg_attribute
+				WHERE attrelid = to_regclass('card_change_metrics') AND attname = 'prev_price'
+			)`).Scan(&outdated)
+		if err != nil {
+			return fmt.Errorf("failed to check change metrics view: %v", err)
+		}
+		rebuild = outdated
+	}
+	if rebuild {
+		if _, err := db.conn.ExecContext(ctx, `DROP MATERIALIZED VIEW IF EXISTS card_change_metrics`); err != nil {
+			return fmt.Errorf("failed to drop change metrics view: %v", err)
+		}
+	}
+	if _, err := db.conn.ExecContext(ctx, changeMetricsViewSQL); err != nil {
+		return fmt.Errorf("failed to create change metrics view: %v", err)
+	}
+	return nil
+}
+
+// RefreshChangeMetrics recomputes card_change_metrics and returns how many
+// cards it holds. progress is called as each step starts, it may be nil.
+func (db *Database) RefreshChangeMetrics(ctx context.Context, rebuild bool, progress func(step string)) (int, error) {
+	defer db.observeQuery(ctx, "refresh_change_metrics", time.Now())
+
+	if progress == nil {
+		progress = func(string) {}
+	}
+
+	if rebuild {
+		// creating the view computes it, no refresh needed after
+		progress("rebuilding view")
+		if err := db.createChangeMetricsView(ctx, true); err != nil {
+			return 0, err
+		}
+	} else {
+		progress("refreshing view")
+		// CONCURRENTLY keeps the view readable while it refreshes
+		if _, err := db.conn.ExecContext(ctx, `REFRESH MATERIALIZED VIEW CONCURRENTLY card_change_metrics`); err != nil {
+			return 0, fmt.Errorf("failed to refresh change metrics view: %v", err)
+		}
+	}
+
+	progress("counting cards")
+	var count int
+	if err := db.conn.QueryRowContext(ctx, `SELECT COUNT(DISTINCT card_id) FROM card_change_metrics`).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count change metrics: %v", err)
+	}
+	return count, nil
+}
+
+// usdRatesSQL is the usd_rates CTE prices are converted to USD with, as
+// price / rate. It goes after a WITH and takes the currency codes and their
+// rates per USD as $1 and $2, see usdRatesArgs. USD is always 1, other
+// currencies without a rate aren't in it so their prices drop out of joins.
+const usdRatesSQL = `
+		usd_rates AS (
+			SELECT 'USD' as currency, 1::float8 as rate
+			UNION ALL
+			SELECT currency, rate FROM UNNEST($1::text[], $2::float8[]) AS r(currency, rate)
+			WHERE currency <> 'USD' AND rate > 0
+		)`
+
+// usdRatesArgs is the $1 and $2 of usdRatesSQL
+func usdRatesArgs(rates map[string]float64) []interface{} {
+	codes := make([]string, 0, len(rates))
+	values := make([]float64, 0, len(rates))
+	for code, rate := range rates {
+		codes = append(codes, code)
+		values = append(values, rate)
+	}
+	return []interface{}{pq.Array(codes), pq.Array(values)}
+}
+
+// Enhanced method to get cards with better price calculations
+func (db *Database) GetCardsForFrontend(ctx context.Context, filter CardFilter) ([]Card, error) {
+	defer db.observeQuery(ctx, "get_cards", time.Now())
+
+	logctx.Printf(ctx, "Fetching cards for frontend...")
+
+	query := `
+		WITH ` + latestPricesSQL + `,` + usdRatesSQL + `,
+		card_stats AS (
+			SELECT 
+				lp.card_id,
+				AVG(lp.price / r.rate) as avg_price,
+				COUNT(DISTINCT lp.source) as source_count,
+				STRING_AGG(DISTINCT lp.source, ', ' ORDER BY lp.source) as sources,
+				AVG(COALESCE((lp.price - pp.prev_price) / r.rate, 0)) as avg_change,
+				AVG(CASE 
+					WHEN pp.prev_price IS NOT NULL AND pp.prev_price > 0 
+					THEN ((lp.price - pp.prev_price) / pp.prev_price) * 100 
+					ELSE 0 
+				END) as avg_change_percent,
+				MAX(lp.scraped_at) as last_scraped,
+				-- scraped_at as timestamptz so the JSON carries an offset
+				JSON_AGG(JSON_BUILD_OBJECT(
+					'source', lp.source,
+					'region', lp.region,
+					'price', lp.price / r.rate,
+					'currency', NULLIF(lp.currency, 'USD'),
+					'original_price', CASE WHEN lp.currency <> 'USD' THEN lp.price END,
+					'scraped_at', lp.scraped_at AT TIME ZONE current_setting('TimeZone'),
+					'listings', lp.listings,
+					'population', lp.population
+				) ORDER BY lp.source) as source_prices
+			FROM latest_prices lp
+			JOIN usd_rates r ON r.currency = lp.currency
+			LEFT JOIN card_change_metrics pp ON lp.card_id = pp.card_id AND lp.source = pp.source
+				AND lp.region = pp.region
+			GROUP BY lp.card_id
+		),
+		price_range AS (
+			SELECT p.card_id, MAX(p.price / r.rate) as high_52w, MIN(p.price / r.rate) as low_52w
+			FROM prices p
+			JOIN usd_rates r ON r.currency = COALESCE(p.currency, 'USD')
+			WHERE p.scraped_at >= CURRENT_TIMESTAMP - INTERVAL '52 weeks'
+			GROUP BY p.card_id
+		)
+		SELECT 
+			c.id, c.name, c.set_name, c.card_number, c.rarity, c.condition, c.product_type,
+			COALESCE(c.image_url, '') as image_url,
+			COALESCE(cs.avg_price, 0) as price,
+			COALESCE(cs.avg_change, 0) as change,
+			COALESCE(cs.avg_change_percent, 0) as change_percent,
+			COALESCE(pr.high_52w, 0) as high_52w,
+			COALESCE(pr.low_52w, 0) as low_52w,
+			-- the range is partial unless the card has a price from before it
+			NOT EXISTS (
+				SELECT 1 FROM prices p
+				WHERE p.card_id = c.id AND p.scraped_at < CURRENT_TIMESTAMP - INTERVAL '52 weeks'
+			) as range_52w_partial,
+			COALESCE(cs.sources, 'Unknown') as source,
+			COALESCE(cs.source_prices, '[]') as source_prices,
+			cs.last_scraped,
+			c.created_at, c.updated_at
+		FROM cards c
+		LEFT JOIN card_stats cs ON c.id = cs.card_id
+		LEFT JOIN price_range pr ON c.id = pr.card_id`
+
+	var where []string
+	if !filter.IncludeUnpriced {
+		where = append(where, "cs.avg_price IS NOT NULL AND cs.avg_price > 0")
+	}
+	args := usdRatesArgs(filter.Rates)
+	if filter.Condition != "" {
+		args = append(args, filter.Condition)
+		where = append(where, fmt.Sprintf("LOWER(c.condition) = LOWER($%d)", len(args)))
+	}
+	if filter.ProductType != "" {
+		args = append(args, filter.ProductType)
+		where = append(where, fmt.Sprintf("c.product_type = $%d", len(args)))
+	}
+	if len(filter.IDs) > 0 {
+		args = append(args, pq.Array(filter.IDs))
+		where = append(where, fmt.Sprintf("c.id = ANY($%d)", len(args)))
+	}
+	if filter.MinSources > 1 {
+		args = append(args, filter.MinSources)
+		where = append(where, fmt.Sprintf("cs.source_count >= $%d", len(args)))
+	}
+	if filter.PriceMin > 0 {
+		args = append(args, filter.PriceMin)
+		where = append(where, fmt.Sprintf("cs.avg_price >= $%d", len(args)))
+	}
+	if filter.PriceMax > 0 {
+		args = append(args, filter.PriceMax)
+		where = append(where, fmt.Sprintf("cs.avg_price <= $%d", len(args)))
+	}
+	if !filter.IncludeStale {
+		where = append(where, "NOT c.stale")
+	}
+
+	if len(where) > 0 {
+		query += `
+		WHERE ` + strings.Join(where, " AND ")
+	}
+	query += `
+		ORDER BY cs.avg_price DESC NULLS LAST, c.updated_at DESC, c.id
+		LIMIT 100`
+
+	rows, err := db.reader(ctx).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cards: %v", err)
+	}
+	defer rows.Close()
+	var cards []Card
+	for rows.Next() {
+		var card Card
+		var source string
+		var sourcePrices []byte
+
+		err := rows.Scan(&card.ID, &card.Name, &card.SetName, &card.CardNumber,
+			&card.Rarity, &card.Condition, &card.ProductType, &card.ImageURL, &card.Price, &card.Change,
+			&card.ChangePercent, &card.High52w, &card.Low52w, &card.Range52wPartial, &source, &sourcePrices,
+			&card.LastScraped, &card.CreatedAt, &card.UpdatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan card: %v", err)
+		}
+
+		card.Source = source
+
+		// Per-source breakdown, every price of a card row shares its condition
+		if err := json.Unmarshal(sourcePrices, &card.Sources); err != nil {
+			return nil, fmt.Errorf("failed to decode source prices: %v", err)
+		}
+		for i := range card.Sources {
+			card.Sources[i].Condition = card.Condition
+			card.Sources[i].Price = normalize.RoundPrice(card.Sources[i].Price, "USD")
+		}
+		card.Trend = ClassifyTrend(card.ChangePercent, db.trendStablePercent)
+
+		// Assign emoji based on card name
+		card.Image = CardEmoji(card.Name)
+
+		cards = append(cards, card)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	logctx.Printf(ctx, "Retrieved %d cards from database", len(cards))
+	return cards, nil
+}
+
+// ClassifyTrend turns a card's change since its previous prices into a
+// badge: "rising" or "falling" once it leaves the ±stablePercent band,
+// "stable" within it
+func ClassifyTrend(changePercent, stablePercent float64) string {
+	switch {
+	case changePercent > stablePercent:
+		return "rising"
+	case changePercent < -stablePercent:
+		return "falling"
+	default:
+		return "stable"
+	}
+}
+
+// Stats are the totals /api/stats reports
+type Stats struct {
+	Cards       int           `json:"total_cards"`
+	PricedCards int           `json:"priced_cards"`
+	Prices      int           `json:"total_prices"`
+	LastScraped *time.Time    `json:"last_scraped"`
+	Sources     []SourceStats `json:"sources"`
+
+	// Providers groups Sources by provider with ?group=provider
+	Providers []ProviderStats `json:"providers,omitempty"`
+}
+
+// ProviderStats is a provider's sources, one per price type and grade
+type ProviderStats struct {
+	Provider string        `json:"provider"`
+	Sources  []SourceStats `json:"sources"`
+}
+
+// GroupByProvider groups the sources by the provider of their label, in
+// the order the providers first appear
+func GroupByProvider(sources []SourceStats) []ProviderStats {
+	var providers []ProviderStats
+	index := make(map[string]int)
+	for _, source := range sources {
+		provider := ParseSourceLabel(source.Name).Provider
+		i, ok := index[provider]
+		if !ok {
+			i = len(providers)
+			index[provider] = i
+			providers = append(providers, ProviderStats{Provider: provider})
+		}
+		providers[i].Sources = append(providers[i].Sources, source)
+	}
+	return providers
+}
+
+// SourceStats is one source's share of the latest prices
+type SourceStats struct {
+	Name        string     `json:"name"`
+	PriceType   string     `json:"price_type,omitempty"`
+	Grade       string     `json:"grade,omitempty"`
+	Cards       int        `json:"cards"`
+	AvgPrice    float64    `json:"avg_price"`
+	LastScraped *time.Time `json:"last_scraped"`
+	// Enabled and LastSuccess come from the source's health, they are
+	// missing for sources that are no longer configured
+	Enabled     *bool      `json:"enabled,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// GetStats returns the card and price totals and, per source, how many
+// cards its latest prices cover and their average
+func (db *Database) GetStats(ctx context.Context) (*Stats, error) {
+	defer db.observeQuery(ctx, "get_stats", time.Now())
+
+	var stats Stats
+	err := db.reader(ctx).QueryRowContext(ctx, `
+		SELECT
+			(SELECT COUNT(*) FROM cards),
+			(SELECT COUNT(DISTINCT card_id) FROM prices),
+			(SELECT COUNT(*) FROM prices),
+			(SELECT MAX(scraped_at) FROM prices)`).Scan(&stats.Cards, &stats.PricedCards, &stats.Prices, &stats.LastScraped)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query totals: %v", err)
+	}
+
+	rows, err := db.reader(ctx).QueryContext(ctx, `
+		WITH `+latestPricesSQL+`
+		SELECT source, COUNT(DISTINCT card_id), AVG(price), MAX(scraped_at)
+		FROM latest_prices
+		GROUP BY source
+		ORDER BY source`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query source stats: %v", err)
+	}
+	defer rows.Close()
+
+	stats.Sources = []SourceStats{}
+	for rows.Next() {
+		var source SourceStats
+		if err := rows.Scan(&source.Name, &source.Cards, &source.AvgPrice, &source.LastScraped); err != nil {
+			return nil, fmt.Errorf("failed to scan source stats: %v", err)
+		}
+		source.AvgPrice = normalize.RoundPrice(source.AvgPrice, "USD")
+		label := ParseSourceLabel(source.Name)
+		source.PriceType, source.Grade = label.PriceType, label.Grade
+		stats.Sources = append(stats.Sources, source)
+	}
+	return &stats, rows.Err()
+}
+
+// SetValue is what completing a set costs at current prices
+type SetValue struct {
+	Set         string  `json:"set"`
+	Total       float64 `json:"total"`
+	Cards       int     `json:"cards"`
+	PricedCards int     `json:"priced_cards"`
+	// MostExpensive are the priced cards driving the total, priciest first
+	MostExpensive []SetCard `json:"most_expensive"`
+	// Unpriced cards have no price from any source and aren't in the total
+	Unpriced []SetCard `json:"unpriced"`
+}
+
+// SetCard is a card of a set with its cheapest latest price
+type SetCard struct {
+	CardID     int     `json:"card_id"`
+	Name       string  `json:"name"`
+	CardNumber string  `json:"card_number"`
+	Price      float64 `json:"price,omitempty"`
+	Source     string  `json:"source,omitempty"`
+}
+
+var ErrSetNotFound = errors.New("set not found")
+
+// GetSetValue sums the cheapest latest price of every unique single card of
+// the set. Cards count once whatever their condition, the cheapest price
+// of any condition and source is taken. Prices are compared and summed in
+// USD, converted with rates, see CardFilter.Rates. top bounds MostExpensive.
+func (db *Database) GetSetValue(ctx context.Context, setName string, top int, rates map[string]float64) (*SetValue, error) {
+	defer db.observeQuery(ctx, "get_set_value", time.Now())
+
+	args := append(usdRatesArgs(rates), setName, ProductTypeSingle)
+	rows, err := db.reader(ctx).QueryContext(ctx, `
+		WITH `+latestPricesSQL+`,`+usdRatesSQL+`,
+		usd_prices AS (
+			SELECT lp.card_id, lp.source, lp.price / r.rate as price
+			FROM latest_prices lp
+			JOIN usd_rates r ON r.currency = lp.currency
+		)
+		SELECT
+			MIN(c.id),
+			MIN(c.name),
+			COALESCE(c.card_number, ''),
+			MIN(up.price),
+			(ARRAY_AGG(up.source ORDER BY up.price) FILTER (WHERE up.price IS NOT NULL))[1]
+		FROM cards c
+		LEFT JOIN usd_prices up ON up.card_id = c.id
+		WHERE LOWER(c.set_name) = LOWER($3) AND c.product_type = $4
+		GROUP BY LOWER(c.name), COALESCE(c.card_number, '')
+		ORDER BY MIN(up.price) DESC NULLS LAST, MIN(c.name)`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query set cards: %v", err)
+	}
+	defer rows.Close()
+
+	value := SetValue{Set: setName, MostExpensive: []SetCard{}, Unpriced: []SetCard{}}
+	for rows.Next() {
+		var card SetCard
+		var price sql.NullFloat64
+		var source sql.NullString
+		if err := rows.Scan(&card.CardID, &card.Name, &card.CardNumber, &price, &source); err != nil {
+			return nil, fmt.Errorf("failed to scan set card: %v", err)
+		}
+		value.Cards++
+
+		if !price.Valid {
+			value.Unpriced = append(value.Unpriced, card)
+			continue
+		}
+		card.Price, card.Source = normalize.RoundPrice(price.Float64, "USD"), source.String
+		value.PricedCards++
+		value.Total += card.Price
+		if len(value.MostExpensive) < top {
+			value.MostExpensive = append(value.MostExpensive, card)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+	if value.Cards == 0 {
+		return nil, ErrSetNotFound
+	}
+
+	value.Total = normalize.RoundPrice(value.Total, "USD")
+	return &value, nil
+}
+
+// Arbitrage is a card whose latest prices from different sources are far
+// apart, so it can be bought from one and sold on another
+type Arbitrage struct {
+	CardID    int    `json:"card_id"`
+	Name      string `json:"name"`
+	SetName   string `json:"set_name"`
+	Condition string `json:"condition"`
+	// Spread is the priciest price minus the cheapest, SpreadPercent is
+	// that relative to the cheapest
+	Spread        float64        `json:"spread"`
+	SpreadPercent float64        `json:"spread_percent"`
+	Cheapest      ArbitragePrice `json:"cheapest"`
+	Priciest      ArbitragePrice `json:"priciest"`
+	// Sources are the card's latest prices, cheapest first
+	Sources []ArbitragePrice `json:"sources"`
+}
+
+// ArbitragePrice is a source's latest price of an Arbitrage card, in USD.
+// Prices in other currencies keep their amount in OriginalPrice.
+type ArbitragePrice struct {
+	Source        string  `json:"source"`
+	Region        string  `json:"region,omitempty"`
+	Price         float64 `json:"price"`
+	Currency      string  `json:"currency,omitempty"`
+	OriginalPrice float64 `json:"original_price,omitempty"`
+}
+
+// GetArbitrage compares the latest price of every source for each card and
+// returns the cards whose spread is more than minPercent of their cheapest
+// price, largest spread first. toUSD converts prices in other currencies,
+// those it can't convert are left out. limit bounds the cards returned.
+func (db *Database) GetArbitrage(ctx context.Context, minPercent float64, limit int,
+	toUSD func(amount float64, currency string) (float64, bool)) ([]Arbitrage, error) {
+	defer db.observeQuery(ctx, "get_arbitrage", time.Now())
+
+	rows, err := db.reader(ctx).QueryContext(ctx, `
+		WITH `+latestPricesSQL+`
+		SELECT c.id, c.name, c.set_name, c.condition, lp.source, lp.region, lp.price, lp.currency
+		FROM latest_prices lp
+		JOIN cards c ON c.id = lp.card_id
+		WHERE NOT c.stale AND lp.price > 0 AND lp.card_id IN (
+			SELECT card_id FROM latest_prices GROUP BY card_id HAVING COUNT(DISTINCT source) > 1
+		)
+		ORDER BY c.id, lp.source, lp.region`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query latest prices: %v", err)
+	}
+	defer rows.Close()
+
+	var cards []Arbitrage
+	for rows.Next() {
+		var card Arbitrage
+		var price ArbitragePrice
+		err := rows.Scan(&card.CardID, &card.Name, &card.SetName, &card.Condition,
+			&price.Source, &price.Region, &price.Price, &price.Currency)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan latest price: %v", err)
+		}
+
+		if price.Currency == "USD" {
+			price.Currency = ""
+		} else {
+			converted, ok := toUSD(price.Price, price.Currency)
+			if !ok {
+				continue
+			}
+			price.OriginalPrice = price.Price
+			price.Price = normalize.RoundPrice(converted, "USD")
+		}
+
+		if n := len(cards); n == 0 || cards[n-1].CardID != card.CardID {
+			cards = append(cards, card)
+		}
+		last := &cards[len(cards)-1]
+		last.Sources = append(last.Sources, price)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	arbitrage := []Arbitrage{}
+	for _, card := range cards {
+		sort.SliceStable(card.Sources, func(i, j int) bool {
+			return card.Sources[i].Price < card.Sources[j].Price
+		})
+		// prices that couldn't be converted may have left a single source
+		sources := make(map[string]bool)
+		for _, price := range card.Sources {
+			sources[price.Source] = true
+		}
+		if len(sources) < 2 {
+			continue
+		}
+
+		card.Cheapest, card.Priciest = card.Sources[0], card.Sources[len(card.Sources)-1]
+		card.Spread = normalize.RoundPrice(card.Priciest.Price-card.Cheapest.Price, "USD")
+		card.SpreadPercent = math.Round(card.Spread/card.Cheapest.Price*10000) / 100
+		if card.SpreadPercent > minPercent {
+			arbitrage = append(arbitrage, card)
+		}
+	}
+
+	sort.SliceStable(arbitrage, func(i, j int) bool {
+		if arbitrage[i].SpreadPercent != arbitrage[j].SpreadPercent {
+			return arbitrage[i].SpreadPercent > arbitrage[j].SpreadPercent
+		}
+		return arbitrage[i].Spread > arbitrage[j].Spread
+	})
+	if len(arbitrage) > limit {
+		arbitrage = arbitrage[:limit]
+	}
+	return arbitrage, nil
+}
+
+var ErrCardNotFound = errors.New("card not found")
+
+// GetCardWithPrices returns a card with the latest price from each source.
+// The prices keep their currency, the card's price and the min, max and
+// average are in USD, converted with rates like CardFilter.Rates. Prices in
+// a currency without a rate are left out of them.
+func (db *Database) GetCardWithPrices(ctx context.Context, cardID int, rates map[string]float64) (*CardWithPrices, error) {
+	defer db.observeQuery(ctx, "get_card_with_prices", time.Now())
+
+	var result CardWithPrices
+	card := &result.Card
+
+	err := db.reader(ctx).QueryRowContext(ctx, `
+		SELECT id, name, set_name, COALESCE(card_number, ''), COALESCE(rarity, ''), condition, product_type,
+			COALESCE(image_url, ''), created_at, updated_at
+		FROM cards WHERE id = $1`, cardID).Scan(&card.ID, &card.Name, &card.SetName, &card.CardNumber,
+		&card.Rarity, &card.Condition, &card.ProductType, &card.ImageURL, &card.CreatedAt, &card.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrCardNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query card: %v", err)
+	}
+
+	rows, err := db.reader(ctx).QueryContext(ctx, `
+		SELECT DISTINCT ON (source, COALESCE(region, ''))
+			id, card_id, source, price, currency, COALESCE(region, ''), COALESCE(url, ''), scraped_at,
+			listings, population
+		FROM prices
+		WHERE card_id = $1
+		ORDER BY source, COALESCE(region, ''), scraped_at DESC`, cardID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query prices: %v", err)
+	}
+	defer rows.Close()
+
+	result.Prices = []Price{}
+	converted := 0
+	for rows.Next() {
+		var price Price
+		if err := rows.Scan(&price.ID, &price.CardID, &price.Source, &price.Price, &price.Currency,
+			&price.Region, &price.URL, &price.ScrapedAt, &price.Listings, &price.Population); err != nil {
+			return nil, fmt.Errorf("failed to scan price: %v", err)
+		}
+		result.Prices = append(result.Prices, price)
+
+		rate := 1.0
+		if price.Currency != "USD" {
+			if rate = rates[price.Currency]; rate <= 0 {
+				continue
+			}
+		}
+		usd := price.Price / rate
+		if converted == 0 || usd < result.MinPrice {
+			result.MinPrice = usd
+		}
+		if usd > result.MaxPrice {
+			result.MaxPrice = usd
+		}
+		result.AvgPrice += usd
+		converted++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	if converted > 0 {
+		result.AvgPrice /= float64(converted)
+		card.Price = result.AvgPrice
+	}
+	return &result, nil
+}
+
+// ScheduledCards looks at the cards with their own scrape_interval. due holds
+// the ones whose interval has elapsed since their last scrape attempt or
+// price, whichever is later, notDue the ids of the others. Cards without an
+// interval are in neither.
+func (db *Database) ScheduledCards(ctx context.Context) ([]Card, map[int]bool, error) {
+	defer db.observeQuery(ctx, "scheduled_cards", time.Now())
+
+	rows, err := db.conn.QueryContext(ctx, `
+		SELECT c.id, c.name, c.set_name, COALESCE(c.card_number, ''), COALESCE(c.rarity, ''), c.condition,
+			c.product_type, COALESCE(GREATEST(c.last_scrape_attempt_at, MAX(p.scraped_at)) + c.scrape_interval <= CURRENT_TIMESTAMP, TRUE)
+		FROM cards c
+		LEFT JOIN prices p ON p.card_id = c.id
+		WHERE c.scrape_interval IS NOT NULL AND NOT c.stale
+		GROUP BY c.id
+		ORDER BY c.id`)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query card schedules: %v", err)
+	}
+	defer rows.Close()
+
+	var due []Card
+	notDue := make(map[int]bool)
+	for rows.Next() {
+		var card Card
+		var isDue bool
+		if err := rows.Scan(&card.ID, &card.Name, &card.SetName, &card.CardNumber, &card.Rarity, &card.Condition,
+			&card.ProductType, &isDue); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan card schedule: %v", err)
+		}
+		if isDue {
+			due = append(due, card)
+		} else {
+			notDue[card.ID] = true
+		}
+	}
+	return due, notDue, rows.Err()
+}
+
+// MarkScrapeAttempt records that the card was just searched for, so a card
+// no source finds isn't due again before its interval is up
+func (db *Database) MarkScrapeAttempt(ctx context.Context, cardID int) error {
+	defer db.observeQuery(ctx, "mark_scrape_attempt", time.Now())
+
+	_, err := db.conn.ExecContext(ctx, `UPDATE cards SET last_scrape_attempt_at = CURRENT_TIMESTAMP WHERE id = $1`, cardID)
+	if err != nil {
+		return fmt.Errorf("failed to record scrape attempt: %v", err)
+	}
+	return nil
+}
+
+// SetScrapeInterval sets how often the card is scraped, 0 puts it back on the
+// global schedule
+func (db *Database) SetScrapeInterval(ctx context.Context, cardID int, interval time.Duration) error {
+	defer db.observeQuery(ctx, "set_scrape_interval", time.Now())
+
+	result, err := db.conn.ExecContext(ctx,
+		`UPDATE cards SET scrape_interval = NULLIF($2, 0) * INTERVAL '1 second' WHERE id = $1`,
+		cardID, int64(interval.Seconds()))
+	if err != nil {
+		return fmt.Errorf("failed to set scrape interval: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrCardNotFound
+	}
+	return nil
+}
+
+var ErrMergeIntoItself = errors.New("a card can't be merged into itself")
+
+// MergeCards moves mergeID's prices to keepID and deletes mergeID, in one
+// transaction. A price keepID already has from the same source, region and
+// scrape time is a duplicate and is dropped instead of moved. keepID also
+// takes over the image URL and scrape interval if it has none. It returns
+// the number of prices moved, or ErrCardNotFound when either card doesn't
+// exist.
+func (db *Database) MergeCards(ctx context.Context, keepID, mergeID int) (int, error) {
+	defer db.observeQuery(ctx, "merge_cards", time.Now())
+
+	if keepID == mergeID {
+		return 0, ErrMergeIntoItself
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// lock both rows so a scrape can't add prices to mergeID meanwhile
+	var found int
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM (SELECT id FROM cards WHERE id IN ($1, $2) FOR UPDATE) locked`,
+		keepID, mergeID).Scan(&found); err != nil {
+		return 0, fmt.Errorf("failed to lock cards: %v", err)
+	}
+	if found != 2 {
+		return 0, ErrCardNotFound
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM prices m
+		USING prices k
+		WHERE m.card_id = $2 AND k.card_id = $1
+			AND k.source = m.source AND COALESCE(k.region, '') = COALESCE(m.region, '')
+			AND k.scraped_at = m.scraped_at`, keepID, mergeID); err != nil {
+		return 0, fmt.Errorf("failed to drop duplicate prices: %v", err)
+	}
+
+	result, err := tx.ExecContext(ctx, `UPDATE prices SET card_id = $1 WHERE card_id = $2`, keepID, mergeID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to move prices: %v", err)
+	}
+	moved, _ := result.RowsAffected()
+
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE cards k SET
+			image_url = COALESCE(k.image_url, m.image_url),
+			scrape_interval = COALESCE(k.scrape_interval, m.scrape_interval),
+			updated_at = CURRENT_TIMESTAMP
+		FROM cards m
+		WHERE k.id = $1 AND m.id = $2`, keepID, mergeID); err != nil {
+		return 0, fmt.Errorf("failed to update card: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM cards WHERE id = $1`, mergeID); err != nil {
+		return 0, fmt.Errorf("failed to delete merged card: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit merge: %v", err)
+	}
+	return int(moved), nil
+}
+
+var ErrCardConflict = errors.New("another card already has this name, set, number and condition")
+
+// PatchCard sets the given columns of the card and bumps updated_at,
+// leaving the others as they are. The columns must come from
+// CardPatchFields, a nil value stores NULL. It returns ErrCardNotFound, or
+// ErrCardConflict when the change would duplicate another card.
+func (db *Database) PatchCard(ctx context.Context, cardID int, changes map[string]interface{}) error {
+	defer db.observeQuery(ctx, "patch_card", time.Now())
+
+	columns := slices.Sorted(maps.Keys(changes))
+	sets := make([]string, 0, len(columns)+1)
+	args := []interface{}{cardID}
+	for _, column := range columns {
+		if _, ok := CardPatchFields[column]; !ok {
+			return fmt.Errorf("%s can't be changed", column)
+		}
+		args = append(args, changes[column])
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
+	sets = append(sets, "updated_at = CURRENT_TIMESTAMP")
+
+	result, err := db.conn.ExecContext(ctx,
+		`UPDATE cards SET `+strings.Join(sets, ", ")+` WHERE id = $1`, args...)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" {
+		return ErrCardConflict
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update card: %v", err)
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return ErrCardNotFound
+	}
+	return nil
+}
+
+// CardName returns the card's name, or ErrCardNotFound
+func (db *Database) CardName(ctx context.Context, cardID int) (string, error) {
+	var name string
+	err := db.reader(ctx).QueryRowContext(ctx, `SELECT name FROM cards WHERE id = $1`, cardID).Scan(&name)
+	if err == sql.ErrNoRows {
+		return "", ErrCardNotFound
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query card: %v", err)
+	}
+	return name, nil
+}
+
+// PriceHistory calls each with every price of the card, oldest first, as
+// the rows are read so a long history isn't held in memory
+func (db *Database) PriceHistory(ctx context.Context, cardID int, each func(Price) error) error {
+	defer db.observeQuery(ctx, "price_history", time.Now())
+
+	rows, err := db.reader(ctx).QueryContext(ctx, `
+		SELECT id, card_id, source, price, currency, COALESCE(region, ''), COALESCE(url, ''), scraped_at,
+			listings, population
+		FROM prices
+		WHERE card_id = $1
+		ORDER BY scraped_at, id`, cardID)
+	if err != nil {
+		return fmt.Errorf("failed to query price history: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var price Price
+		if err := rows.Scan(&price.ID, &price.CardID, &price.Source, &price.Price, &price.Currency,
+			&price.Region, &price.URL, &price.ScrapedAt, &price.Listings, &price.Population); err != nil {
+			return fmt.Errorf("failed to scan price: %v", err)
+		}
+		if err := each(price); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+var ErrPriceNotFound = errors.New("no price found")
+
+// PriceBefore returns the card's last price from the source scraped before
+// the given time. It returns ErrCardNotFound or ErrPriceNotFound when there
+// is none.
+func (db *Database) PriceBefore(ctx context.Context, cardID int, source string, before time.Time) (*Price, error) {
+	defer db.observeQuery(ctx, "price_before", time.Now())
+
+	var price Price
+	err := db.reader(ctx).QueryRowContext(ctx, `
+		SELECT id, card_id, source, price, currency, COALESCE(region, ''), COALESCE(url, ''), scraped_at,
+			listings, population
+		FROM prices
+		WHERE card_id = $1 AND LOWER(source) = LOWER($2) AND scraped_at < $3
+		ORDER BY scraped_at DESC
+		LIMIT 1`, cardID, source, before).Scan(&price.ID, &price.CardID, &price.Source, &price.Price,
+		&price.Currency, &price.Region, &price.URL, &price.ScrapedAt, &price.Listings, &price.Population)
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := db.reader(ctx).QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM cards WHERE id = $1)`, cardID).Scan(&exists); err != nil {
+			return nil, fmt.Errorf("failed to query card: %v", err)
+		}
+		if !exists {
+			return nil, ErrCardNotFound
+		}
+		return nil, ErrPriceNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query price: %v", err)
+	}
+	return &price, nil
+}
+
+// scrapeLockKey is the Postgres advisory lock the scheduled scrapes of every
+// instance sharing the database take
+const scrapeLockKey = 151151
+
+// TryScrapeLock takes the scrape lock without waiting. Advisory locks
+// belong to a session, so the lock keeps a connection out of the pool until
+// release is called. acquired is false when another instance holds it.
+func (db *Database) TryScrapeLock(ctx context.Context) (release func(), acquired bool, err error) {
+	conn, err := db.conn.Conn(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to get a connection: %v", err)
+	}
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, scrapeLockKey).Scan(&acquired); err != nil {
+		conn.Close()
+		return nil, false, fmt.Errorf("failed to take scrape lock: %v", err)
+	}
+	if !acquired {
+		conn.Close()
+		return nil, false, nil
+	}
+
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, scrapeLockKey); err != nil {
+			// closing the session is the only other way to let go of the
+			// lock, so the connection mustn't go back to the pool
+			log.Printf("Error releasing the scrape lock, dropping its connection: %v", err)
+			conn.Raw(func(any) error { return driver.ErrBadConn })
+		}
+		conn.Close()
+	}, true, nil
+}
+
+// PageHash returns the stored content hash of a scraped page and when the
+// page was last parsed
+func (db *Database) PageHash(ctx context.Context, pageURL string) (string, time.Time, bool, error) {
+	defer db.observeQuery(ctx, "page_hash", time.Now())
+
+	var hash string
+	var parsedAt time.Time
+	err := db.conn.QueryRowContext(ctx, `SELECT hash, parsed_at FROM page_hashes WHERE url = $1`, pageURL).Scan(&hash, &parsedAt)
+	if err == sql.ErrNoRows {
+		return "", time.Time{}, false, nil
+	}
+	if err != nil {
+		return "", time.Time{}, false, fmt.Errorf("failed to query page hash: %v", err)
+	}
+	return hash, parsedAt, true, nil
+}
+
+// SavePageHash stores the content hash of a page that was just parsed
+func (db *Database) SavePageHash(ctx context.Context, pageURL, hash string) error {
+	defer db.observeQuery(ctx, "save_page_hash", time.Now())
+
+	_, err := db.conn.ExecContext(ctx, `
+		INSERT INTO page_hashes (url, hash, parsed_at) VALUES ($1, $2, CURRENT_TIMESTAMP)
+		ON CONFLICT (url) DO UPDATE SET hash = EXCLUDED.hash, parsed_at = EXCLUDED.parsed_at`,
+		pageURL, hash)
+	if err != nil {
+		return fmt.Errorf("failed to save page hash: %v", err)
+	}
+	return nil
+}
+
+// PageSnapshot is the raw body of a page as it was scraped
+type PageSnapshot struct {
+	URL         string
+	ContentType string
+	Body        []byte
+	ScrapedAt   time.Time
+}
+
+var ErrSnapshotNotFound = errors.New("no snapshot found")
+
+// SaveSnapshot stores a gzipped copy of a scraped page's body
+func (db *Database) SaveSnapshot(ctx context.Context, pageURL, contentType string, body []byte) error {
+	defer db.observeQuery(ctx, "save_snapshot", time.Now())
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(body); err != nil {
+		return fmt.Errorf("failed to compress snapshot: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress snapshot: %v", err)
+	}
+
+	if len(contentType) > 255 {
+		contentType = contentType[:255]
+	}
+	_, err := db.conn.ExecContext(ctx,
+		`INSERT INTO page_snapshots (url, content_type, body) VALUES ($1, $2, $3)`,
+		pageURL, contentType, compressed.Bytes())
+	if err != nil {
+		return fmt.Errorf("failed to save snapshot: %v", err)
+	}
+	return nil
+}
+
+// Snapshot returns the last snapshot of the page scraped before the given
+// time, uncompressed, or ErrSnapshotNotFound
+func (db *Database) Snapshot(ctx context.Context, pageURL string, before time.Time) (PageSnapshot, error) {
+	defer db.observeQuery(ctx, "snapshot", time.Now())
+
+	snapshot := PageSnapshot{URL: pageURL}
+	var compressed []byte
+	err := db.reader(ctx).QueryRowContext(ctx, `
+		SELECT content_type, body, scraped_at FROM page_snapshots
+		WHERE url = $1 AND scraped_at < $2
+		ORDER BY scraped_at DESC, id DESC
+		LIMIT 1`, pageURL, before).Scan(&snapshot.ContentType, &compressed, &snapshot.ScrapedAt)
+	if err == sql.ErrNoRows {
+		return snapshot, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to query snapshot: %v", err)
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to read snapshot: %v", err)
+	}
+	if snapshot.Body, err = io.ReadAll(zr); err != nil {
+		return snapshot, fmt.Errorf("failed to read snapshot: %v", err)
+	}
+	return snapshot, nil
+}
+
+// PruneSnapshots deletes the snapshots older than maxAge and returns how
+// many it deleted
+func (db *Database) PruneSnapshots(ctx context.Context, maxAge time.Duration) (int64, error) {
+	defer db.observeQuery(ctx, "prune_snapshots", time.Now())
+
+	result, err := db.conn.ExecContext(ctx,
+		`DELETE FROM page_snapshots WHERE scraped_at < $1`, time.Now().Add(-maxAge))
+	if err != nil {
+		return 0, fmt.Errorf("failed to prune snapshots: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+// PruneStaleCards handles cards without a price newer than maxAge. By default
+// they are marked stale, which hides them from /api/cards, and cards that got
+// fresh prices are unmarked. With remove set they are deleted instead. It
+// returns the cards that were marked or removed.
+func (db *Database) PruneStaleCards(maxAge time.Duration, remove bool) ([]Card, error) {
+	defer db.observeQuery(context.Background(), "prune_stale_cards", time.Now())
+
+	cutoff := time.Now().Add(-maxAge)
+	noFreshPrice := `NOT EXISTS (SELECT 1 FROM prices p WHERE p.card_id = c.id AND p.scraped_at > $1)`
+
+	query := `UPDATE cards c SET stale = TRUE WHERE NOT c.stale AND ` + noFreshPrice + ` RETURNING c.id, c.name, c.set_name`
+	if remove {
+		query = `DELETE FROM cards c WHERE ` + noFreshPrice + ` RETURNING c.id, c.name, c.set_name`
+	} else {
+		unmark := `UPDATE cards c SET stale = FALSE WHERE c.stale AND NOT (` + noFreshPrice + `)`
+		if _, err := db.conn.Exec(unmark, cutoff); err != nil {
+			return nil, fmt.Errorf("failed to unmark fresh cards: %v", err)
+		}
+	}
+
+	rows, err := db.conn.Query(query, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to prune stale cards: %v", err)
+	}
+	defer rows.Close()
+
+	var pruned []Card
+	for rows.Next() {
+		var card Card
+		if err := rows.Scan(&card.ID, &card.Name, &card.SetName); err != nil {
+			return nil, fmt.Errorf("failed to scan pruned card: %v", err)
+		}
+		pruned = append(pruned, card)
+	}
+	return pruned, rows.Err()
+}
+
+// ImportItem is one card and its prices in a POST /api/import batch
+type ImportItem struct {
+	Card   Card    `json:"card"`
+	Prices []Price `json:"prices"`
+}
+
+// ImportResult reports what happened to one ImportItem
+type ImportResult struct {
+	Index  int    `json:"index"`
+	CardID int    `json:"card_id,omitempty"`
+	Prices int    `json:"prices"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+var ErrImportTooLarge = errors.New("import batch is too large")
+
+// ErrInvalidImport is wrapped by the ImportCards errors for bodies that
+// aren't a JSON array of ImportItems
+var ErrInvalidImport = errors.New("invalid import")
+
+// ImportCards stream-decodes a JSON array of ImportItems and inserts them in
+// a single transaction. The whole batch is decoded before the transaction
+// begins, so a slow or broken upload doesn't hold it open. Each item runs in
+// its own savepoint, so an invalid item is reported and skipped without
+// failing the others. Decoding errors, which wrap ErrInvalidImport and the
+// reader's error, and batches over maxItems import nothing.
+func (db *Database) ImportCards(ctx context.Context, body io.Reader, maxItems int) ([]ImportResult, error) {
+	defer db.observeQuery(ctx, "import_cards", time.Now())
+
+	items, err := decodeImportItems(body, maxItems)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	results := make([]ImportResult, 0, len(items))
+	for index := range items {
+		result := ImportResult{Index: index, Status: "ok"}
+		if err := importItem(tx, &items[index], &result); err != nil {
+			result.Status = "error"
+			result.Error = err.Error()
+			result.CardID = 0
+			result.Prices = 0
+		}
+		results = append(results, result)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit import: %v", err)
+	}
+	return results, nil
+}
+
+// decodeImportItems decodes a JSON array of at most maxItems ImportItems,
+// one item at a time
+func decodeImportItems(body io.Reader, maxItems int) ([]ImportItem, error) {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("%w: expected a JSON array of cards: %w", ErrInvalidImport, err)
+	} else if tok != json.Delim('[') {
+		return nil, fmt.Errorf("%w: expected a JSON array of cards", ErrInvalidImport)
+	}
+
+	var items []ImportItem
+	for index := 0; dec.More(); index++ {
+		if index >= maxItems {
+			return nil, fmt.Errorf("%w: at most %d items", ErrImportTooLarge, maxItems)
+		}
+
+		var item ImportItem
+		if err := dec.Decode(&item); err != nil {
+			return nil, fmt.Errorf("%w: item %d: %w", ErrInvalidImport, index, err)
+		}
+		items = append(items, item)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("%w: JSON array: %w", ErrInvalidImport, err)
+	}
+	return items, nil
+}
+
+// importItem validates and inserts one item inside a savepoint
+func importItem(tx *sql.Tx, item *ImportItem, result *ImportResult) error {
+	if err := ValidateImportItem(item); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("SAVEPOINT import_item"); err != nil {
+		return fmt.Errorf("failed to create savepoint: %v", err)
+	}
+
+	err := func() error {
+		cardID, _, err := insertCard(tx, item.Card)
+		if err != nil {
+			return err
+		}
+		result.CardID = cardID
+
+		for _, price := range item.Prices {
+			price.CardID = cardID
+			if err := insertPrice(tx, price); err != nil {
+				return err
+			}
+			result.Prices++
+		}
+		return nil
+	}()
+
+	if err != nil {
+		if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT import_item"); rbErr != nil {
+			return fmt.Errorf("%v (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+
+	if _, err := tx.Exec("RELEASE SAVEPOINT import_item"); err != nil {
+		return fmt.Errorf("failed to release savepoint: %v", err)
+	}
+	return nil
+}
+
+// ValidateImportItem checks the required fields and fills in defaults
+func ValidateImportItem(item *ImportItem) error {
+	item.Card.Name = strings.TrimSpace(item.Card.Name)
+	item.Card.SetName = strings.TrimSpace(item.Card.SetName)
+	if item.Card.Name == "" {
+		return errors.New("card name is required")
+	}
+	if item.Card.SetName == "" {
+		return errors.New("card set_name is required")
+	}
+	switch item.Card.ProductType {
+	case "", ProductTypeSingle, ProductTypeSealed:
+	default:
+		return fmt.Errorf("card product_type must be %s or %s", ProductTypeSingle, ProductTypeSealed)
+	}
+
+	// graded conditions such as "PSA 10" are kept as they are
+	if condition := normalize.Condition(item.Card.Condition); condition != "" {
+		item.Card.Condition = condition
+	} else if strings.TrimSpace(item.Card.Condition) == "" {
+		item.Card.Condition = normalize.DefaultCondition
+	}
+
+	for i := range item.Prices {
+		price := &item.Prices[i]
+		if strings.TrimSpace(price.Source) == "" {
+			return fmt.Errorf("price %d: source is required", i)
+		}
+		if math.IsNaN(price.Price) || math.IsInf(price.Price, 0) || price.Price <= 0 {
+			return fmt.Errorf("price %d: price must be a positive number", i)
+		}
+		if price.Currency == "" {
+			price.Currency = "USD"
+		}
+		price.Currency = strings.ToUpper(price.Currency)
+		if !normalize.CurrencyCodePattern.MatchString(price.Currency) {
+			return fmt.Errorf("price %d: invalid currency %q", i, price.Currency)
+		}
+	}
+	return nil
+}
+
+// MatchCard finds the card whose normalized name, set and number match the
+// given ones. An empty set or number matches any. It also returns the
+// normalization key it compared on. The cards' keys are the stored
+// name_key, set_key and number_key columns.
+func (db *Database) MatchCard(ctx context.Context, name, setName, number string) (Card, string, bool, error) {
+	defer db.observeQuery(ctx, "match_card", time.Now())
+
+	key := normalize.CardKey(name, setName, number)
+	nameKey, setKey, numberKey := normalize.CardName(name), normalize.SetName(setName), normalize.CardNumber(number)
+	if numberKey == "" {
+		numberKey = normalize.CardNumberFromName(name)
+	}
+
+	var card Card
+	err := db.conn.QueryRowContext(ctx, `
+		SELECT id, name, set_name, COALESCE(card_number, ''), COALESCE(rarity, ''), condition, product_type
+		FROM cards
+		WHERE name_key = $1
+			AND ($2 = '' OR set_key = $2)
+			AND ($3 = '' OR number_key = $3)
+		ORDER BY id
+		LIMIT 1`, nameKey, setKey, numberKey,
+	).Scan(&card.ID, &card.Name, &card.SetName, &card.CardNumber, &card.Rarity, &card.Condition, &card.ProductType)
+	if err == sql.ErrNoRows {
+		return Card{}, key, false, nil
+	}
+	if err != nil {
+		return Card{}, key, false, fmt.Errorf("failed to match card: %v", err)
+	}
+	return card, key, true, nil
+}
+
+// CardPatchField describes a card column PATCH /api/cards/{id} may change
+type CardPatchField struct {
+	MaxLength int
+	// Nullable columns are cleared by null or ""
+	Nullable bool
+}
+
+// CardPatchFields is the allowlist of PATCH /api/cards/{id}, by JSON field
+// and column name, which are the same
+var CardPatchFields = map[string]CardPatchField{
+	"name":         {MaxLength: 255},
+	"set_name":     {MaxLength: 255},
+	"card_number":  {MaxLength: 50, Nullable: true},
+	"rarity":       {MaxLength: 100, Nullable: true},
+	"condition":    {MaxLength: 50},
+	"product_type": {MaxLength: 20},
+	"image_url":    {MaxLength: 2048, Nullable: true},
+}
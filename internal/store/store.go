@@ -0,0 +1,561 @@
+// Package store is the Postgres database of cards and their prices, shared
+// by the API server and the CSV scraper's database sink.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"Pokemonscraper/internal/logctx"
+
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type Card struct {
+	ID            int     `json:"id"`
+	Name          string  `json:"name"`
+	SetName       string  `json:"set_name"`
+	CardNumber    string  `json:"card_number"`
+	Rarity        string  `json:"rarity"`
+	Condition     string  `json:"condition"`
+	ProductType   string  `json:"product_type"`
+	Price         float64 `json:"price"`
+	Change        float64 `json:"change"`
+	ChangePercent float64 `json:"changePercent"`
+	Source        string  `json:"source"`
+	Image         string  `json:"image"`
+	ImageURL      string  `json:"image_url"`
+	// High52w and Low52w are the highest and lowest prices of the trailing
+	// 52 weeks. Range52wPartial is set when the card's price history is
+	// shorter than that, so the range covers less than a year.
+	High52w         float64 `json:"high_52w"`
+	Low52w          float64 `json:"low_52w"`
+	Range52wPartial bool    `json:"range_52w_partial"`
+	// Trend classifies ChangePercent as rising, falling or stable, see
+	// ClassifyTrend. Only card listings set it.
+	Trend string `json:"trend,omitempty"`
+	// Prices holds Price in the currencies asked for with ?currencies=.
+	// EstimatedCurrencies lists the ones without an exchange rate, whose
+	// price is the USD one.
+	Prices              map[string]float64 `json:"prices,omitempty"`
+	EstimatedCurrencies []string           `json:"estimated_currencies,omitempty"`
+	Sources             []SourcePrice      `json:"sources"`
+	LastScraped         *time.Time         `json:"last_scraped"`
+	CreatedAt           time.Time          `json:"created_at"`
+	UpdatedAt           time.Time          `json:"updated_at"`
+}
+
+// SourcePrice is one source's latest price for a card, in USD. Prices in
+// other currencies keep their amount in OriginalPrice.
+type SourcePrice struct {
+	Source        string    `json:"source"`
+	Region        string    `json:"region,omitempty"`
+	Price         float64   `json:"price"`
+	Currency      string    `json:"currency,omitempty"`
+	OriginalPrice float64   `json:"original_price,omitempty"`
+	Condition     string    `json:"condition"`
+	ScrapedAt     time.Time `json:"scraped_at"`
+
+	Listings   *int `json:"listings,omitempty"`
+	Population *int `json:"population,omitempty"`
+}
+
+// CardFilter narrows down the cards returned by GetCardsForFrontend. The
+// zero value returns all cards.
+type CardFilter struct {
+	Condition    string
+	ProductType  string
+	IDs          []int
+	IncludeStale bool
+	// IncludeUnpriced keeps cards without a price, such as ones added by
+	// hand, with a price of 0 and no sources
+	IncludeUnpriced bool
+	// MinSources keeps only cards priced by at least this many distinct
+	// sources, 0 and 1 keep every priced card
+	MinSources int
+	// PriceMin and PriceMax bound the card's average price, 0 leaves that
+	// side open
+	PriceMin float64
+	PriceMax float64
+	// Rates are the exchange rates, in units of each currency per USD, that
+	// prices in other currencies are converted to USD with before they are
+	// averaged. Prices in a currency without a rate are left out.
+	Rates map[string]float64
+}
+
+// Product types a card row can be. Anything that isn't a single card, such
+// as booster boxes and ETBs, is stored as sealed.
+const (
+	ProductTypeSingle = "single"
+	ProductTypeSealed = "sealed"
+)
+
+type Price struct {
+	ID        int       `json:"id"`
+	CardID    int       `json:"card_id"`
+	Source    string    `json:"source"`
+	Price     float64   `json:"price"`
+	Currency  string    `json:"currency"`
+	Region    string    `json:"region,omitempty"`
+	URL       string    `json:"url"`
+	ScrapedAt time.Time `json:"scraped_at"`
+
+	// Supply context from sources that show it: the listings for sale and
+	// the graded population. Nil when the source doesn't say.
+	Listings   *int `json:"listings,omitempty"`
+	Population *int `json:"population,omitempty"`
+}
+
+type CardWithPrices struct {
+	Card     Card    `json:"card"`
+	Prices   []Price `json:"prices"`
+	MinPrice float64 `json:"min_price"`
+	MaxPrice float64 `json:"max_price"`
+	AvgPrice float64 `json:"avg_price"`
+}
+
+type Database struct {
+	conn pool
+
+	// read serves the read-only queries: a replica when DATABASE_URL_READ is
+	// set, conn otherwise
+	read pool
+
+	// slowQueryThreshold is how long a query may take before it is logged
+	slowQueryThreshold time.Duration
+
+	// trendStablePercent is the change_percent band within which a card's
+	// trend is stable
+	trendStablePercent float64
+
+	// schema holds the tables, the connections' search_path points at it
+	schema string
+}
+
+// dbQueryDuration tracks how long each named DB call takes
+var dbQueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "pokemon_db_query_duration_seconds",
+	Help:    "Duration of database calls by query name.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"query"})
+
+func init() {
+	prometheus.MustRegister(dbQueryDuration)
+}
+
+// RegisterPoolMetrics exposes the connection pools' sql.DBStats, labeled
+// primary and read when a replica is configured
+func RegisterPoolMetrics(db *Database) {
+	pools := map[string]*sql.DB{"primary": db.conn.DB}
+	if db.read != db.conn {
+		pools["read"] = db.read.DB
+	}
+
+	for name, pool := range pools {
+		labels := prometheus.Labels{"pool": name}
+		prometheus.MustRegister(
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        "pokemon_db_pool_wait_seconds_total",
+				Help:        "Time spent waiting for a free database connection.",
+				ConstLabels: labels,
+			}, func() float64 { return pool.Stats().WaitDuration.Seconds() }),
+			prometheus.NewCounterFunc(prometheus.CounterOpts{
+				Name:        "pokemon_db_pool_waits_total",
+				Help:        "Queries that had to wait for a free database connection.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(pool.Stats().WaitCount) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "pokemon_db_pool_in_use",
+				Help:        "Database connections currently in use.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(pool.Stats().InUse) }),
+			prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+				Name:        "pokemon_db_pool_max_open",
+				Help:        "Maximum open database connections.",
+				ConstLabels: labels,
+			}, func() float64 { return float64(pool.Stats().MaxOpenConnections) }),
+		)
+	}
+}
+
+func NewDatabase(cfg DatabaseConfig) (*Database, error) {
+	connStr := cfg.ConnectionString()
+	log.Printf("Connecting to database with connection string: %s", RedactConnectionString(connStr))
+
+	db, err := openPool(connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("Successfully connected to PostgreSQL database")
+
+	database := &Database{conn: pool{db}, read: pool{db}, slowQueryThreshold: cfg.SlowQueryThreshold,
+		trendStablePercent: cfg.TrendStablePercent, schema: cfg.Schema}
+	if cfg.ReadURL != "" {
+		read, err := openPool(cfg.ReadConnectionString())
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("read replica: %v", err)
+		}
+		database.read = pool{read}
+		log.Println("Successfully connected to the read replica, reads go there")
+	}
+
+	if err := database.createTables(); err != nil {
+		database.Close()
+		return nil, fmt.Errorf("failed to create tables: %v", err)
+	}
+
+	return database, nil
+}
+
+// ErrPoolExhausted is returned by queries that gave up waiting for a free
+// connection, see AcquireGuard
+var ErrPoolExhausted = errors.New("no database connection freed up in time")
+
+// AcquireGuard bounds how long each query run with its context, see
+// WithAcquireGuard, waits for a free connection of an exhausted pool. The
+// query itself may take as long as it takes.
+type AcquireGuard struct {
+	Timeout   time.Duration
+	exhausted atomic.Bool
+}
+
+// Exhausted reports whether a query gave up waiting for a connection
+func (g *AcquireGuard) Exhausted() bool {
+	return g.exhausted.Load()
+}
+
+// acquireGuardKey is the context key of an *AcquireGuard
+type acquireGuardKey struct{}
+
+// WithAcquireGuard makes the queries run with ctx wait for a connection no
+// longer than guard allows
+func WithAcquireGuard(ctx context.Context, guard *AcquireGuard) context.Context {
+	return context.WithValue(ctx, acquireGuardKey{}, guard)
+}
+
+// pool is a connection pool whose queries honor the AcquireGuard of their
+// context. Without one they wait for a connection like *sql.DB does.
+type pool struct {
+	*sql.DB
+}
+
+// guardedConn takes a connection for one query of a guarded context. ok is
+// false without a guard, the query then runs on the pool as usual.
+func (p pool) guardedConn(ctx context.Context) (conn *sql.Conn, ok bool, err error) {
+	guard, _ := ctx.Value(acquireGuardKey{}).(*AcquireGuard)
+	if guard == nil {
+		return nil, false, nil
+	}
+
+	acquireCtx, cancel := context.WithTimeout(ctx, guard.Timeout)
+	defer cancel()
+	conn, err = p.DB.Conn(acquireCtx)
+	if err != nil && ctx.Err() == nil {
+		guard.exhausted.Store(true)
+		err = fmt.Errorf("%w after %s", ErrPoolExhausted, guard.Timeout)
+	}
+	return conn, true, err
+}
+
+// releaseWhenClosed returns conn to the pool once the rows or transaction
+// read from it are closed: Close waits for them, in its own goroutine so the
+// caller gets the rows first. The goroutine lives as long as the rows do.
+func releaseWhenClosed(conn *sql.Conn) {
+	go conn.Close()
+}
+
+func (p pool) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	conn, guarded, err := p.guardedConn(ctx)
+	if !guarded {
+		return p.DB.QueryContext(ctx, query, args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	releaseWhenClosed(conn)
+	return rows, nil
+}
+
+// poolRow is the *sql.Row of a pool. Unlike *sql.Row it can hold an error
+// of its own, so a guarded query that got no connection reports
+// ErrPoolExhausted, and it returns its connection to the pool on Scan.
+type poolRow struct {
+	row  *sql.Row
+	conn *sql.Conn
+	err  error
+}
+
+// Scan is *sql.Row.Scan. It must be called, as with *sql.Row, for the
+// connection to be released.
+func (r *poolRow) Scan(dest ...interface{}) error {
+	if r.err != nil {
+		return r.err
+	}
+	err := r.row.Scan(dest...)
+	if r.conn != nil {
+		// Scan closed the rows, so this doesn't wait
+		r.conn.Close()
+	}
+	return err
+}
+
+func (r *poolRow) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.row.Err()
+}
+
+func (p pool) QueryRowContext(ctx context.Context, query string, args ...interface{}) *poolRow {
+	conn, guarded, err := p.guardedConn(ctx)
+	if !guarded {
+		return &poolRow{row: p.DB.QueryRowContext(ctx, query, args...)}
+	}
+	if err != nil {
+		return &poolRow{err: err}
+	}
+	return &poolRow{row: conn.QueryRowContext(ctx, query, args...), conn: conn}
+}
+
+func (p pool) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	conn, guarded, err := p.guardedConn(ctx)
+	if !guarded {
+		return p.DB.ExecContext(ctx, query, args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ExecContext(ctx, query, args...)
+}
+
+func (p pool) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error) {
+	conn, guarded, err := p.guardedConn(ctx)
+	if !guarded {
+		return p.DB.BeginTx(ctx, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	tx, err := conn.BeginTx(ctx, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	releaseWhenClosed(conn)
+	return tx, nil
+}
+
+// openPool opens and pings a connection pool
+func openPool(connStr string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+
+	// Configure connection pool
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(25)
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to ping database: %v", err)
+	}
+	return db, nil
+}
+
+// Close closes the primary and replica pools
+func (db *Database) Close() error {
+	if db.read != db.conn {
+		db.read.Close()
+	}
+	return db.conn.Close()
+}
+
+// primaryReadsKey marks a context whose reads must see its own writes
+type primaryReadsKey struct{}
+
+// WithPrimaryReads makes the read-only queries run with ctx go to the
+// primary, for reads right after a write that the replica may not have yet
+func WithPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+// reader returns the pool read-only queries run with ctx should use
+func (db *Database) reader(ctx context.Context) pool {
+	if primary, _ := ctx.Value(primaryReadsKey{}).(bool); primary {
+		return db.conn
+	}
+	return db.read
+}
+
+// migrations add the columns introduced after the tables were first created.
+// Each must be safe to run on every startup.
+var migrations = []string{
+	`ALTER TABLE cards ADD COLUMN IF NOT EXISTS stale BOOLEAN NOT NULL DEFAULT FALSE`,
+	`ALTER TABLE prices ADD COLUMN IF NOT EXISTS region VARCHAR(20)`,
+	`ALTER TABLE cards ADD COLUMN IF NOT EXISTS product_type VARCHAR(20) NOT NULL DEFAULT 'single'`,
+	`ALTER TABLE cards ADD COLUMN IF NOT EXISTS image_url TEXT`,
+	`ALTER TABLE cards ADD COLUMN IF NOT EXISTS scrape_interval INTERVAL`,
+	`CREATE INDEX IF NOT EXISTS idx_prices_card_scraped ON prices (card_id, scraped_at)`,
+	`ALTER TABLE prices ADD COLUMN IF NOT EXISTS listings INTEGER`,
+	`ALTER TABLE prices ADD COLUMN IF NOT EXISTS population INTEGER`,
+	// PriceCharting's price types and grades were stored as "PriceCharting
+	// Complete" and "PriceCharting PSA 10" before source labels
+	`UPDATE prices SET source = 'pricecharting:' || LOWER(SUBSTRING(source FROM 15))
+		WHERE source IN ('PriceCharting Complete', 'PriceCharting New', 'PriceCharting Graded')`,
+	`UPDATE prices SET source = 'pricecharting:graded:' || LOWER(REPLACE(SUBSTRING(source FROM 15), ' ', ''))
+		WHERE source ~ '^PriceCharting (PSA|BGS|CGC|SGC|Grade) '`,
+	`CREATE TABLE IF NOT EXISTS page_hashes (
+		url TEXT PRIMARY KEY,
+		hash VARCHAR(64) NOT NULL,
+		parsed_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS page_snapshots (
+		id SERIAL PRIMARY KEY,
+		url TEXT NOT NULL,
+		content_type VARCHAR(255) NOT NULL DEFAULT '',
+		body BYTEA NOT NULL,
+		scraped_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS idx_page_snapshots_url_scraped ON page_snapshots (url, scraped_at)`,
+	`ALTER TABLE cards ADD COLUMN IF NOT EXISTS last_scrape_attempt_at TIMESTAMP`,
+	// the normalized keys MatchCard compares on. The functions mirror
+	// normalize.CardName, SetName and CardNumber, the keys are stored so
+	// matching is an index lookup instead of normalizing every card.
+	`CREATE OR REPLACE FUNCTION card_name_key(value TEXT) RETURNS TEXT AS $$
+		SELECT BTRIM(REGEXP_REPLACE(REGEXP_REPLACE(LOWER(value), '#[\t\n\f\r ]*[0-9a-z_]+', ' ', 'g'), '[^a-z0-9]+', ' ', 'g'))
+	$$ LANGUAGE SQL IMMUTABLE`,
+	`CREATE OR REPLACE FUNCTION set_name_key(value TEXT) RETURNS TEXT AS $$
+		SELECT REGEXP_REPLACE(card_name_key(value), '^pokemon ', '')
+	$$ LANGUAGE SQL IMMUTABLE`,
+	`CREATE OR REPLACE FUNCTION card_number_key(value TEXT) RETURNS TEXT AS $$
+		SELECT COALESCE(NULLIF(LTRIM(n, '0'), ''), n) FROM (
+			SELECT REGEXP_REPLACE(SPLIT_PART(LOWER(BTRIM(COALESCE(value, ''), E' \t\n\r\f\v')), '/', 1), '^#', '') AS n
+		) trimmed
+	$$ LANGUAGE SQL IMMUTABLE`,
+	`ALTER TABLE cards ADD COLUMN IF NOT EXISTS name_key TEXT GENERATED ALWAYS AS (card_name_key(name)) STORED`,
+	`ALTER TABLE cards ADD COLUMN IF NOT EXISTS set_key TEXT GENERATED ALWAYS AS (set_name_key(set_name)) STORED`,
+	// a card without a number may have it in its name, as "#123"
+	`ALTER TABLE cards ADD COLUMN IF NOT EXISTS number_key TEXT GENERATED ALWAYS AS (COALESCE(
+		NULLIF(card_number_key(card_number), ''),
+		card_number_key(SUBSTRING(LOWER(name) FROM '#[\t\n\f\r ]*([0-9a-z_]+)'))
+	)) STORED`,
+	`CREATE INDEX IF NOT EXISTS idx_cards_name_key ON cards (name_key)`,
+}
+
+// observeQuery records the duration of the named DB call and logs it when it
+// took longer than SLOW_QUERY_THRESHOLD. Call it as
+// defer db.observeQuery(ctx, "name", time.Now())
+func (db *Database) observeQuery(ctx context.Context, name string, start time.Time) {
+	elapsed := time.Since(start)
+	dbQueryDuration.WithLabelValues(name).Observe(elapsed.Seconds())
+
+	if db.slowQueryThreshold > 0 && elapsed > db.slowQueryThreshold {
+		logctx.Printf(ctx, "Slow query %s took %s (threshold %s)", name, elapsed, db.slowQueryThreshold)
+	}
+}
+
+func (db *Database) createTables() error {
+	log.Println("Creating database tables if they don't exist...")
+
+	// The search_path names the schema, so once it exists the unqualified
+	// tables below are created in it
+	if db.schema != "" && db.schema != "public" {
+		if _, err := db.conn.Exec(`CREATE SCHEMA IF NOT EXISTS ` + pq.QuoteIdentifier(db.schema)); err != nil {
+			return fmt.Errorf("failed to create schema %s: %v", db.schema, err)
+		}
+		log.Printf("Using schema %s", db.schema)
+	}
+
+	cardTable := `
+	CREATE TABLE IF NOT EXISTS cards (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		set_name VARCHAR(255) NOT NULL,
+		card_number VARCHAR(50),
+		rarity VARCHAR(100),
+		condition VARCHAR(50) DEFAULT 'Near Mint',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(name, set_name, card_number, condition)
+	);`
+
+	priceTable := `
+	CREATE TABLE IF NOT EXISTS prices (
+		id SERIAL PRIMARY KEY,
+		card_id INTEGER REFERENCES cards(id) ON DELETE CASCADE,
+		source VARCHAR(255) NOT NULL,
+		price DECIMAL(10,2) NOT NULL,
+		currency VARCHAR(10) DEFAULT 'USD',
+		url TEXT,
+		scraped_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		INDEX idx_card_source_scraped (card_id, source, scraped_at DESC)
+	);`
+
+	// Create triggers for updating timestamps
+	updateTrigger := `
+	CREATE OR REPLACE FUNCTION update_updated_at_column()
+	RETURNS TRIGGER AS $$
+	BEGIN
+		-- recording a scrape attempt doesn't change the card
+		IF NEW.last_scrape_attempt_at IS DISTINCT FROM OLD.last_scrape_attempt_at THEN
+			RETURN NEW;
+		END IF;
+		NEW.updated_at = CURRENT_TIMESTAMP;
+		RETURN NEW;
+	END;
+	$$ language 'plpgsql';
+
+	DROP TRIGGER IF EXISTS update_cards_updated_at ON cards;
+	CREATE TRIGGER update_cards_updated_at
+		BEFORE UPDATE ON cards
+		FOR EACH ROW
+		EXECUTE FUNCTION update_updated_at_column();`
+
+	if _, err := db.conn.Exec(cardTable); err != nil {
+		return fmt.Errorf("failed to create cards table: %v", err)
+	}
+
+	if _, err := db.conn.Exec(priceTable); err != nil {
+		return fmt.Errorf("failed to create prices table: %v", err)
+	}
+
+	for _, migration := range migrations {
+		if _, err := db.conn.Exec(migration); err != nil {
+			return fmt.Errorf("failed to run migration %q: %v", migration, err)
+		}
+	}
+
+	if _, err := db.conn.Exec(updateTrigger); err != nil {
+		log.Printf("Warning: Failed to create update trigger: %v", err)
+	}
+
+	if err := db.createChangeMetricsView(context.Background(), false); err != nil {
+		log.Printf("Warning: Failed to create change metrics view: %v", err)
+	}
+
+	log.Println("Database tables created successfully")
+	return nil
+}
+
+// dbExecutor is satisfied by both *sql.DB and *sql.Tx, so inserts can run
+// inside a transaction
+type dbExecutor interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
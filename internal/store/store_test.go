@@ -0,0 +1,157 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDriver is a database without tables, every query returns no rows
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) { return fakeConn{}, nil }
+
+type fakeConn struct{}
+
+func (fakeConn) Prepare(string) (driver.Stmt, error) { return fakeStmt{}, nil }
+func (fakeConn) Close() error                        { return nil }
+func (fakeConn) Begin() (driver.Tx, error)           { return fakeTx{}, nil }
+
+type fakeStmt struct{}
+
+func (fakeStmt) Close() error                               { return nil }
+func (fakeStmt) NumInput() int                              { return -1 }
+func (fakeStmt) Exec([]driver.Value) (driver.Result, error) { return driver.ResultNoRows, nil }
+func (fakeStmt) Query([]driver.Value) (driver.Rows, error)  { return fakeRows{}, nil }
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct{}
+
+func (fakeRows) Columns() []string         { return []string{"n"} }
+func (fakeRows) Close() error              { return nil }
+func (fakeRows) Next([]driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("store-fake", fakeDriver{})
+}
+
+// newFakePool returns a pool of a single connection
+func newFakePool(t *testing.T) pool {
+	db, err := sql.Open("store-fake", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return pool{db}
+}
+
+func TestPoolGivesUpOnExhaustedPool(t *testing.T) {
+	p := newFakePool(t)
+	busy, err := p.DB.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	guard := &AcquireGuard{Timeout: 20 * time.Millisecond}
+	ctx := WithAcquireGuard(context.Background(), guard)
+
+	if _, err := p.QueryContext(ctx, "SELECT 1"); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("QueryContext error = %v, want ErrPoolExhausted", err)
+	}
+	if _, err := p.ExecContext(ctx, "SELECT 1"); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("ExecContext error = %v, want ErrPoolExhausted", err)
+	}
+	if err := p.QueryRowContext(ctx, "SELECT 1").Scan(new(int)); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("QueryRowContext error = %v, want ErrPoolExhausted", err)
+	}
+	if _, err := p.BeginTx(ctx, nil); !errors.Is(err, ErrPoolExhausted) {
+		t.Errorf("BeginTx error = %v, want ErrPoolExhausted", err)
+	}
+	if !guard.Exhausted() {
+		t.Error("guard isn't marked exhausted")
+	}
+}
+
+func TestPoolReleasesGuardedConnections(t *testing.T) {
+	p := newFakePool(t)
+	guard := &AcquireGuard{Timeout: time.Second}
+	ctx := WithAcquireGuard(context.Background(), guard)
+
+	// with a single connection, each query needs the last one released
+	for i := 0; i < 3; i++ {
+		rows, err := p.QueryContext(ctx, "SELECT 1")
+		if err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+		for rows.Next() {
+		}
+		rows.Close()
+
+		if err := p.QueryRowContext(ctx, "SELECT 1").Scan(new(int)); err != sql.ErrNoRows {
+			t.Fatalf("query row %d: %v, want sql.ErrNoRows", i, err)
+		}
+		// a row and an exec release their connection before returning
+		if inUse := p.Stats().InUse; inUse != 0 {
+			t.Fatalf("query row %d: %d connections in use after Scan", i, inUse)
+		}
+		if _, err := p.ExecContext(ctx, "SELECT 1"); err != nil {
+			t.Fatalf("exec %d: %v", i, err)
+		}
+		if inUse := p.Stats().InUse; inUse != 0 {
+			t.Fatalf("exec %d: %d connections in use after it", i, inUse)
+		}
+		tx, err := p.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("begin %d: %v", i, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("commit %d: %v", i, err)
+		}
+	}
+	if guard.Exhausted() {
+		t.Error("guard is marked exhausted")
+	}
+}
+
+func TestDecodeImportItemsKeepsReadError(t *testing.T) {
+	body := `[{"card": {"name": "Pikachu"}}, {"card": {"name": "` + strings.Repeat("a", 100) + `"}}]`
+	reader := http.MaxBytesReader(httptest.NewRecorder(), io.NopCloser(strings.NewReader(body)), 50)
+
+	_, err := decodeImportItems(reader, 10)
+	var tooLarge *http.MaxBytesError
+	if !errors.As(err, &tooLarge) {
+		t.Errorf("decodeImportItems error = %v, want a *http.MaxBytesError", err)
+	}
+}
+
+func TestDecodeImportItemsInvalid(t *testing.T) {
+	for _, body := range []string{``, `{"card": {}}`, `[{"card": "Pikachu"}]`, `[{"card": {}}`} {
+		if _, err := decodeImportItems(strings.NewReader(body), 10); !errors.Is(err, ErrInvalidImport) {
+			t.Errorf("decodeImportItems(%q) error = %v, want ErrInvalidImport", body, err)
+		}
+	}
+}
+
+func TestDecodeImportItemsLimit(t *testing.T) {
+	body := `[{"card": {"name": "Pikachu"}}, {"card": {"name": "Mew"}}]`
+	if _, err := decodeImportItems(strings.NewReader(body), 1); !errors.Is(err, ErrImportTooLarge) {
+		t.Errorf("decodeImportItems error = %v, want ErrImportTooLarge", err)
+	}
+	items, err := decodeImportItems(strings.NewReader(body), 2)
+	if err != nil || len(items) != 2 || items[1].Card.Name != "Mew" {
+		t.Errorf("decodeImportItems = %+v, %v, want both items", items, err)
+	}
+}